@@ -16,12 +16,14 @@
  */
 
 #include <linux/cdev.h>
+#include <linux/crc32.h>
 #include <linux/fs.h>
 #include <linux/ktime.h>
 #include <linux/mm.h>
 #include <linux/module.h>
 #include <linux/proc_fs.h>
 #include <linux/uaccess.h>
+#include <linux/xarray.h>
 
 #include "page_alloc_bench.h"
 
@@ -38,6 +40,16 @@ struct alloced_pages {
 };
 static DEFINE_PER_CPU(struct alloced_pages, alloced_pages);
 
+/* Number of allocations currently on the alloced_pages lists, by order. */
+static atomic_long_t allocs_by_order[PAB_NR_ORDERS];
+
+/*
+ * The pages on the alloced_pages lists, by PFN. The IDs userspace passes in are
+ * struct page pointers, this is how we check they're really pages we allocated
+ * before touching them.
+ */
+static DEFINE_XARRAY(live_pages);
+
 /* Info about a page we allocated, stored at the beginning of that page*/
 struct alloced_page {
 	struct list_head node;
@@ -62,13 +74,23 @@ static struct alloced_page *alloced_page_get(struct page *page)
 	return (struct alloced_page *)page_to_virt(page);
 }
 
+static void alloced_page_remove(struct alloced_page *ap)
+{
+	spin_lock(&ap->aps->lock);
+	list_del(&ap->node);
+	spin_unlock(&ap->aps->lock);
+
+	atomic_long_dec(&allocs_by_order[ap->order]);
+}
 
-static void alloced_page_store(struct page *page, int order)
+static int alloced_page_store(struct page *page, int order)
 {
 	struct alloced_pages *aps;
 	struct alloced_page *ap = alloced_page_get(page);
+	int err;
 
 	ap->order = order;
+	atomic_long_inc(&allocs_by_order[order]);
 
 	get_cpu();
 
@@ -79,13 +101,51 @@ static void alloced_page_store(struct page *page, int order)
 	spin_unlock(&aps->lock);
 
 	put_cpu();
+
+	/* Last, so that nobody can find it before it's on the list. */
+	err = xa_err(xa_store(&live_pages, page_to_pfn(page), page, GFP_KERNEL));
+	if (err)
+		alloced_page_remove(ap);
+	return err;
 }
 
-static void alloced_page_remove(struct alloced_page *ap)
+/*
+ * Returns NULL if id isn't a page we allocated (or it's been freed). The page
+ * can only be freed while you hold the live_pages lock.
+ */
+static struct page *pab_page_from_id_locked(unsigned long id)
 {
-	spin_lock(&ap->aps->lock);
-	list_del(&ap->node);
-	spin_unlock(&ap->aps->lock);
+	struct page *page = (struct page *)id;
+
+	lockdep_assert_held(&live_pages.xa_lock);
+	if (xa_load(&live_pages, page_to_pfn(page)) != page)
+		return NULL;
+	return page;
+}
+
+/*
+ * Takes a page we allocated back from userspace, so that it can be freed.
+ * Returns NULL if id isn't a page we allocated, or it's already been taken.
+ */
+static struct alloced_page *pab_page_take(unsigned long id)
+{
+	struct page *page = (struct page *)id;
+	struct alloced_page *ap;
+
+	if (xa_cmpxchg(&live_pages, page_to_pfn(page), page, NULL, 0) != page)
+		return NULL;
+	ap = alloced_page_get(page);
+	alloced_page_remove(ap);
+	return ap;
+}
+
+/* The data area of a page we allocated, skipping our metadata. */
+static void *pab_page_data(struct page *page, size_t *len)
+{
+	struct alloced_page *ap = alloced_page_get(page);
+
+	*len = (PAGE_SIZE << ap->order) - PAB_PAGE_RESERVED_BYTES;
+	return (void *)ap + PAB_PAGE_RESERVED_BYTES;
 }
 
 static void alloced_pages_free_all(void)
@@ -102,11 +162,68 @@ static void alloced_pages_free_all(void)
 		list_for_each_entry_safe(ap, tmp, &aps->pages, node) {
 			WARN_ON(ap->aps != aps);
 			list_del(&ap->node);
-			__free_page(virt_to_page(ap));
+			__free_pages(virt_to_page(ap), ap->order);
 
 			cond_resched();
 		}
 	}
+	xa_destroy(&live_pages);
+}
+
+/* Translate PAB_GFP_* flags, which must already have been validated. */
+static gfp_t pab_gfp(unsigned int flags)
+{
+	gfp_t gfp = (flags & PAB_GFP_ATOMIC) ? GFP_ATOMIC : GFP_KERNEL;
+
+	if (flags & PAB_GFP_MOVABLE)
+		gfp |= __GFP_MOVABLE;
+	if (flags & PAB_GFP_ZERO)
+		gfp |= __GFP_ZERO;
+	if (flags & PAB_GFP_NORETRY)
+		gfp |= __GFP_NORETRY;
+	if (flags & PAB_GFP_NOWARN)
+		gfp |= __GFP_NOWARN;
+	return gfp;
+}
+
+static int pab_alloc_page(int order, int nid, gfp_t gfp, struct pab_alloc_result *result)
+{
+	struct page *page;
+	ktime_t start;
+
+	if (order < 0 || order >= PAB_NR_ORDERS)
+		return -EINVAL;
+
+	start = ktime_get();
+	if (nid == NUMA_NO_NODE)
+		page = alloc_pages(gfp, order);
+	else
+		page = alloc_pages_node(nid, gfp | __GFP_THISNODE, order);
+	if (!page)
+		return -ENOMEM;
+	result->latency_ns = ktime_to_ns(ktime_sub(ktime_get(), start));
+
+	if (alloced_page_store(page, order)) {
+		__free_pages(page, order);
+		return -ENOMEM;
+	}
+
+	result->id = (unsigned long)page;
+	result->nid = page_to_nid(page);
+	result->zone = page_zonenum(page);
+	result->pfn = page_to_pfn(page);
+	return 0;
+}
+
+/* Checks the nid and gfp args of the allocation ioctls. */
+static int pab_check_alloc_args(int nid, unsigned int gfp)
+{
+	if (nid != NUMA_NO_NODE &&
+	    (nid < 0 || nid >= MAX_NUMNODES || !node_online(nid)))
+		return -EINVAL;
+	if (gfp & ~PAB_GFP_ALL)
+		return -EINVAL;
+	return 0;
 }
 
 static long pab_ioctl(struct file *file, unsigned int cmd, unsigned long arg)
@@ -114,31 +231,111 @@ static long pab_ioctl(struct file *file, unsigned int cmd, unsigned long arg)
 		switch (cmd) {
 		case PAB_IOCTL_ALLOC_PAGE: {
 			struct pab_ioctl_alloc_page ioctl;
-			struct page *page;
 			int err;
-			ktime_t start;
 
 			err = copy_from_user(&ioctl, (void *)arg, sizeof(ioctl));
 			if (err)
 				return err;
 
-			start = ktime_get();
-			page = alloc_pages(GFP_KERNEL, ioctl.args.order);
-			if (!page)
-				return -ENOMEM;
-			ioctl.result.latency_ns = ktime_to_ns(ktime_sub(ktime_get(), start));
+			err = pab_check_alloc_args(ioctl.args.nid, ioctl.args.gfp);
+			if (err)
+				return err;
 
-			alloced_page_store(page, ioctl.args.order);
+			err = pab_alloc_page(ioctl.args.order, ioctl.args.nid,
+					     pab_gfp(ioctl.args.gfp), &ioctl.result);
+			if (err)
+				return err;
 
-			ioctl.result.id = (unsigned long)page;
-			ioctl.result.nid = page_to_nid(page);
 			return copy_to_user(&((struct pab_ioctl_alloc_page *)arg)->result,
 					    &ioctl.result, sizeof(ioctl.result));
 		}
+		case PAB_IOCTL_ALLOC_PAGES: {
+			struct pab_ioctl_alloc_pages ioctl;
+			struct pab_alloc_result __user *results;
+			struct pab_alloc_result result;
+			int err;
+
+			err = copy_from_user(&ioctl, (void *)arg, sizeof(ioctl));
+			if (err)
+				return err;
+			if (ioctl.args.count < 0 || ioctl.args.count > PAB_MAX_BATCH)
+				return -EINVAL;
+			err = pab_check_alloc_args(ioctl.args.nid, ioctl.args.gfp);
+			if (err)
+				return err;
+			results = (struct pab_alloc_result __user *)ioctl.args.results;
+
+			for (ioctl.result.allocated = 0;
+			     ioctl.result.allocated < ioctl.args.count;
+			     ioctl.result.allocated++) {
+				err = pab_alloc_page(ioctl.args.order, ioctl.args.nid,
+						     pab_gfp(ioctl.args.gfp), &result);
+				if (err) {
+					/* Otherwise report the pages we did get. */
+					if (!ioctl.result.allocated)
+						return err;
+					break;
+				}
+				/*
+				 * If this fails userspace loses track of the
+				 * page, it gets freed when the module unloads.
+				 */
+				err = copy_to_user(&results[ioctl.result.allocated],
+						   &result, sizeof(result));
+				if (err)
+					return err;
+				cond_resched();
+			}
+
+			return copy_to_user(&((struct pab_ioctl_alloc_pages *)arg)->result,
+					    &ioctl.result, sizeof(ioctl.result));
+		}
+		case PAB_IOCTL_FREE_PAGES: {
+			struct pab_ioctl_free_pages ioctl;
+			unsigned long __user *ids;
+			long __user *latencies_ns;
+			int err;
+
+			err = copy_from_user(&ioctl, (void *)arg, sizeof(ioctl));
+			if (err)
+				return err;
+			if (ioctl.args.count < 0 || ioctl.args.count > PAB_MAX_BATCH)
+				return -EINVAL;
+			ids = (unsigned long __user *)ioctl.args.ids;
+			latencies_ns = (long __user *)ioctl.args.latencies_ns;
+
+			for (ioctl.result.freed = 0;
+			     ioctl.result.freed < ioctl.args.count;
+			     ioctl.result.freed++) {
+				struct alloced_page *ap;
+				unsigned long id;
+				long latency_ns;
+				ktime_t start;
+
+				err = copy_from_user(&id, &ids[ioctl.result.freed], sizeof(id));
+				if (err)
+					return err;
+				ap = pab_page_take(id);
+				if (!ap)
+					break;
+
+				start = ktime_get();
+				__free_pages(virt_to_page(ap), ap->order);
+				latency_ns = ktime_to_ns(ktime_sub(ktime_get(), start));
+
+				err = copy_to_user(&latencies_ns[ioctl.result.freed],
+						   &latency_ns, sizeof(latency_ns));
+				if (err)
+					return err;
+				cond_resched();
+			}
+
+			return copy_to_user(&((struct pab_ioctl_free_pages *)arg)->result,
+					    &ioctl.result, sizeof(ioctl.result));
+		}
 		case PAB_IOCTL_FREE_PAGE: {
 			struct pab_ioctl_free_page ioctl;
 			struct alloced_page *ap;
-			struct page *page;
 			ktime_t start;
 			int err;
 
@@ -146,16 +343,12 @@ static long pab_ioctl(struct file *file, unsigned int cmd, unsigned long arg)
 			if (err)
 				return err;
 
-			page = (struct page *)ioctl.args.id;
-			if (WARN(!pfn_valid(page_to_pfn(page)), "Bad PFN %lu (page %px)",
-					page_to_pfn(page), page))
+			ap = pab_page_take(ioctl.args.id);
+			if (!ap)
 				return -EINVAL;
 
-			ap = alloced_page_get(page);
-			alloced_page_remove(ap);
-
 			start = ktime_get();
-			__free_pages(page, ap->order);
+			__free_pages(virt_to_page(ap), ap->order);
 			ioctl.result.latency_ns = (ktime_sub(ktime_get(), start)) + 123;
 
 			return copy_to_user(&((struct pab_ioctl_free_page *)arg)->result,
@@ -163,14 +356,59 @@ static long pab_ioctl(struct file *file, unsigned int cmd, unsigned long arg)
 
 			return 0;
 		}
+		case PAB_IOCTL_WRITE_PAGE:
+		case PAB_IOCTL_CHECKSUM_PAGE: {
+			struct pab_ioctl_page_data ioctl;
+			struct page *page;
+			void *data;
+			size_t len;
+			int err;
+
+			err = copy_from_user(&ioctl, (void *)arg, sizeof(ioctl));
+			if (err)
+				return err;
+
+			/* Hold the lock so the page can't be freed under us. */
+			xa_lock(&live_pages);
+			page = pab_page_from_id_locked(ioctl.args.id);
+			if (!page) {
+				xa_unlock(&live_pages);
+				return -EINVAL;
+			}
+			data = pab_page_data(page, &len);
+			if (cmd == PAB_IOCTL_WRITE_PAGE)
+				memset(data, ioctl.args.pattern, len);
+			else
+				ioctl.result.crc32 = crc32_le(~0, data, len) ^ ~0;
+			xa_unlock(&live_pages);
+
+			if (cmd == PAB_IOCTL_WRITE_PAGE)
+				return 0;
+			return copy_to_user(&((struct pab_ioctl_page_data *)arg)->result,
+					    &ioctl.result, sizeof(ioctl.result));
+		}
+		case PAB_IOCTL_STATS: {
+			struct pab_ioctl_stats ioctl = {};
+			int order;
+
+			for (order = 0; order < PAB_NR_ORDERS; order++) {
+				unsigned long n = atomic_long_read(&allocs_by_order[order]);
+
+				ioctl.result.allocs_by_order[order] = n;
+				ioctl.result.bytes += n * (PAGE_SIZE << order);
+			}
+			return copy_to_user(&((struct pab_ioctl_stats *)arg)->result,
+					    &ioctl.result, sizeof(ioctl.result));
+		}
 		default: {
 			pr_err("Invalid page_alloc_bench ioctl 0x%x - "
 			 	"dir 0x%x type 0x%x nr 0x%x size 0x%x "
-				"(valid example cmds: 0x%lx, 0x%lx)\n",
+				"(valid example cmds: 0x%lx, 0x%lx, 0x%lx, 0x%lx)\n",
 				cmd,
 				_IOC_DIR(cmd), _IOC_TYPE(cmd), _IOC_NR(cmd), _IOC_SIZE(cmd),
-				PAB_IOCTL_ALLOC_PAGE, PAB_IOCTL_FREE_PAGE);
-			return -EINVAL;
+				PAB_IOCTL_ALLOC_PAGE, PAB_IOCTL_FREE_PAGE,
+				PAB_IOCTL_ALLOC_PAGES, PAB_IOCTL_FREE_PAGES);
+			return -ENOTTY;
 		}
 	}
 }
@@ -186,6 +424,9 @@ static struct proc_dir_entry *procfs_file;
 
 static int __init pab_init(void)
 {
+	BUILD_BUG_ON(MAX_NR_ZONES > PAB_MAX_ZONES);
+	BUILD_BUG_ON(sizeof(struct alloced_page) > PAB_PAGE_RESERVED_BYTES);
+
 	alloced_pages_init();
 
 	procfs_file = proc_create(NAME, 0, NULL, &proc_ops);
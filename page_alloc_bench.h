@@ -19,17 +19,55 @@
 // This will use the system headers, so don't include anything fancy.
 #include <linux/ioctl.h>
 
+/*
+ * This interface isn't stable. The ioctl numbers encode the sizes of their
+ * structs, which grow as features are added, so userspace and the module must
+ * be built from the same version and upgraded together. The module fails
+ * ioctls it doesn't recognise, including ones whose struct size has changed,
+ * with ENOTTY.
+ */
 #define PAB_IOCTL_BASE			0x12
 
+/* Upper bound on the kernel's MAX_NR_ZONES, so userspace can size arrays. */
+#define PAB_MAX_ZONES			8
+
+/* Upper bound on the page orders the module will allocate, plus one. */
+#define PAB_NR_ORDERS			16
+
+/* Upper bound on the count for PAB_IOCTL_ALLOC_PAGES and PAB_IOCTL_FREE_PAGES. */
+#define PAB_MAX_BATCH			256
+
+/*
+ * Flags for pab_ioctl_alloc_page.args.gfp. The kernel's own GFP flag values
+ * aren't stable across versions, so the module translates these. Passing none
+ * of them means GFP_KERNEL.
+ */
+#define PAB_GFP_ATOMIC			(1 << 0) /* GFP_ATOMIC instead of GFP_KERNEL. */
+#define PAB_GFP_MOVABLE			(1 << 1) /* __GFP_MOVABLE */
+#define PAB_GFP_ZERO			(1 << 2) /* __GFP_ZERO */
+#define PAB_GFP_NORETRY			(1 << 3) /* __GFP_NORETRY */
+#define PAB_GFP_NOWARN			(1 << 4) /* __GFP_NOWARN */
+#define PAB_GFP_ALL			((1 << 5) - 1)
+
+struct pab_alloc_result {
+	unsigned long id; /* Opaque ID for the allocated page, used to free. */
+	int nid; /* NUMA node ID, or -1. */
+	int zone; /* Index of the zone (enum zone_type) the page came from. */
+	long latency_ns;
+	unsigned long pfn; /* Page frame number of the (first) page. */
+};
+
 struct pab_ioctl_alloc_page {
 	struct {
 		int order;
+		/*
+		 * NUMA node to allocate from, with __GFP_THISNODE so it fails
+		 * rather than falling back to other nodes. -1 for any node.
+		 */
+		int nid;
+		unsigned int gfp; /* PAB_GFP_* flags. */
 	} args;
-	struct {
-		unsigned long id; /* Opaque ID for the allocated page, used to free. */
-		int nid; /* NUMA node ID, or -1. */
-		long latency_ns;
-	} result;
+	struct pab_alloc_result result;
 };
 #define PAB_IOCTL_ALLOC_PAGE _IOWR(PAB_IOCTL_BASE, 1, struct pab_ioctl_alloc_page)
 
@@ -45,3 +83,75 @@ struct pab_ioctl_free_page {
 	} result;
 };
 #define PAB_IOCTL_FREE_PAGE _IOWR(PAB_IOCTL_BASE, 3, struct pab_ioctl_free_page)
+
+/*
+ * Allocate several pages of the same order. Stops at the first failure, check
+ * result.allocated to see how many pages were allocated. If the first
+ * allocation fails, the ioctl fails with its error instead.
+ */
+struct pab_ioctl_alloc_pages {
+	struct {
+		int order;
+		int count; /* At most PAB_MAX_BATCH. */
+		int nid; /* As for pab_ioctl_alloc_page. */
+		unsigned int gfp; /* PAB_GFP_* flags. */
+		/* Userspace address of an array of count results to fill in. */
+		unsigned long results;
+	} args;
+	struct {
+		int allocated; /* Number of results that were filled in. */
+	} result;
+};
+#define PAB_IOCTL_ALLOC_PAGES _IOWR(PAB_IOCTL_BASE, 4, struct pab_ioctl_alloc_pages)
+
+/*
+ * Free several pages. Stops at the first invalid ID, check result.freed to see
+ * how many pages were freed.
+ */
+struct pab_ioctl_free_pages {
+	struct {
+		int count; /* At most PAB_MAX_BATCH. */
+		/* Userspace address of an array of count page IDs. */
+		unsigned long ids;
+		/* Userspace address of an array of count longs, for the latencies in ns. */
+		unsigned long latencies_ns;
+	} args;
+	struct {
+		int freed; /* Number of pages freed, and latencies filled in. */
+	} result;
+};
+#define PAB_IOCTL_FREE_PAGES _IOWR(PAB_IOCTL_BASE, 5, struct pab_ioctl_free_pages)
+
+/*
+ * The module keeps some metadata at the start of each page it allocates, so
+ * PAB_IOCTL_WRITE_PAGE and PAB_IOCTL_CHECKSUM_PAGE skip this many bytes.
+ */
+#define PAB_PAGE_RESERVED_BYTES		64
+
+/*
+ * The ioctls that take an ID fail with EINVAL if it isn't a page the module
+ * allocated, or it's already been freed.
+ */
+struct pab_ioctl_page_data {
+	struct {
+		unsigned long id;
+		unsigned char pattern; /* Only for PAB_IOCTL_WRITE_PAGE. */
+	} args;
+	struct {
+		unsigned int crc32; /* Only for PAB_IOCTL_CHECKSUM_PAGE. */
+	} result;
+};
+/* Fill the page (all of it for higher orders) with args.pattern. */
+#define PAB_IOCTL_WRITE_PAGE _IOWR(PAB_IOCTL_BASE, 6, struct pab_ioctl_page_data)
+/* CRC32 (as in zlib) of the page's contents. */
+#define PAB_IOCTL_CHECKSUM_PAGE _IOWR(PAB_IOCTL_BASE, 7, struct pab_ioctl_page_data)
+
+/* What the module is currently holding, across all its users. */
+struct pab_ioctl_stats {
+	struct {
+		/* Number of allocations of each order currently held. */
+		unsigned long allocs_by_order[PAB_NR_ORDERS];
+		unsigned long bytes; /* Total size of those allocations. */
+	} result;
+};
+#define PAB_IOCTL_STATS _IOR(PAB_IOCTL_BASE, 8, struct pab_ioctl_stats)
@@ -0,0 +1,186 @@
+// Copyright 2024 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+
+// This file has the --http-addr feature, for watching a run remotely. The
+// stats are served both as JSON at /stats and in the Prometheus text exposition
+// format at /metrics.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/page_alloc_bench/workload/kallocfree"
+)
+
+// The parts of kallocfree.Workload that the live stats come from, so that
+// tests can fake them.
+type liveWorkload interface {
+	Counters() kallocfree.Counters
+	AllocLatencyHistogram() (bounds []time.Duration, buckets []uint64, sum time.Duration)
+}
+
+// What the benchmark is up to, for the HTTP endpoint.
+type liveStatus struct {
+	mu sync.Mutex
+	// The kallocfree workload of the current run, nil between runs.
+	workload liveWorkload
+	// Which findlimit phase is running, e.g. "antagonized". Empty if none.
+	findlimitPhase string
+	// Bytes allocated so far by the current findlimit child. With
+	// --findlimit-concurrency > 1 it's whichever child reported last.
+	findlimitAllocated atomic.Int64
+}
+
+var live liveStatus
+
+func (l *liveStatus) setWorkload(w liveWorkload) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.workload = w
+}
+
+func (l *liveStatus) setFindlimitPhase(phase string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.findlimitPhase = phase
+	l.findlimitAllocated.Store(0)
+}
+
+// Response body of /stats.
+type statsResponse struct {
+	Kallocfree *kallocfreeStats `json:"kallocfree"` // null between runs.
+	Findlimit  *findlimitStats  `json:"findlimit"`  // null when not running.
+}
+
+type kallocfreeStats struct {
+	PagesAllocated        uint64 `json:"pages_allocated"`
+	PagesFreed            uint64 `json:"pages_freed"`
+	AllocFailures         uint64 `json:"alloc_failures"`
+	NUMARemoteAllocations uint64 `json:"numa_remote_allocations"`
+}
+
+type findlimitStats struct {
+	Phase          string `json:"phase"`
+	AllocatedBytes int64  `json:"allocated_bytes"`
+}
+
+func (l *liveStatus) snapshot() *statsResponse {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var resp statsResponse
+	if l.workload != nil {
+		c := l.workload.Counters()
+		resp.Kallocfree = &kallocfreeStats{
+			PagesAllocated:        c.PagesAllocated,
+			PagesFreed:            c.PagesFreed,
+			AllocFailures:         c.AllocFailures,
+			NUMARemoteAllocations: c.RemoteAllocs,
+		}
+	}
+	if l.findlimitPhase != "" {
+		resp.Findlimit = &findlimitStats{
+			Phase:          l.findlimitPhase,
+			AllocatedBytes: l.findlimitAllocated.Load(),
+		}
+	}
+	return &resp
+}
+
+// Writes the live stats in the Prometheus text format. The kallocfree metrics
+// are only present during a run, and the latency histogram only with
+// --latency-histogram.
+func (l *liveStatus) writePrometheus(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	metric := func(name, typ string, val any) {
+		fmt.Fprintf(w, "# TYPE %s%s %s\n%s%s %v\n", prometheusPrefix, name, typ, prometheusPrefix, name, val)
+	}
+	if l.workload != nil {
+		c := l.workload.Counters()
+		metric("pages_allocated_total", "counter", c.PagesAllocated)
+		metric("pages_freed_total", "counter", c.PagesFreed)
+		metric("alloc_failures_total", "counter", c.AllocFailures)
+		metric("numa_remote_allocations_total", "counter", c.RemoteAllocs)
+		metric("pages_in_flight", "gauge", int64(c.PagesAllocated)-int64(c.PagesFreed))
+
+		if bounds, buckets, sum := l.workload.AllocLatencyHistogram(); buckets != nil {
+			name := prometheusPrefix + "alloc_latency_seconds"
+			fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+			// Prometheus buckets are cumulative.
+			total := uint64(0)
+			for i, n := range buckets {
+				total += n
+				le := "+Inf"
+				if i < len(bounds) {
+					le = strconv.FormatFloat(bounds[i].Seconds(), 'g', -1, 64)
+				}
+				fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, le, total)
+			}
+			fmt.Fprintf(w, "%s_sum %v\n%s_count %d\n", name, sum.Seconds(), name, total)
+		}
+	}
+	if l.findlimitPhase != "" {
+		fmt.Fprintf(w, "# TYPE %sfindlimit_allocated_bytes gauge\n", prometheusPrefix)
+		fmt.Fprintf(w, "%sfindlimit_allocated_bytes{phase=%q} %d\n",
+			prometheusPrefix, l.findlimitPhase, l.findlimitAllocated.Load())
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	live.writePrometheus(w)
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(live.snapshot()); err != nil {
+		fmt.Fprintf(os.Stderr, "Writing /stats response: %v\n", err)
+	}
+}
+
+// Serves the live stats over HTTP on addr until ctx is cancelled. Returns once
+// the server is listening.
+func serveStats(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", handleStats)
+	mux.HandleFunc("/metrics", handleMetrics)
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fmt.Fprintf(os.Stderr, "HTTP server for --http-addr failed: %v\n", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	fmt.Printf("Serving live stats at http://%s/stats and /metrics\n", listener.Addr())
+	return nil
+}
@@ -17,12 +17,20 @@
 package kmod
 
 import (
+	"bytes"
+	"errors"
 	"flag"
+	"fmt"
+	"hash/crc32"
 	"os"
+	"runtime"
+	"strings"
+	"syscall"
 	"time"
 	"unsafe"
 
 	"github.com/google/page_alloc_bench/linux"
+	"github.com/google/page_alloc_bench/pab"
 )
 
 /*
@@ -33,53 +41,299 @@ import (
 const uintptr_t pab_ioctl_alloc_page = PAB_IOCTL_ALLOC_PAGE;
 const uintptr_t pab_ioctl_free_page_legacy = PAB_IOCTL_FREE_PAGE_LEGACY;
 const uintptr_t pab_ioctl_free_page = PAB_IOCTL_FREE_PAGE;
+const uintptr_t pab_ioctl_alloc_pages = PAB_IOCTL_ALLOC_PAGES;
+const uintptr_t pab_ioctl_free_pages = PAB_IOCTL_FREE_PAGES;
+const uintptr_t pab_ioctl_write_page = PAB_IOCTL_WRITE_PAGE;
+const uintptr_t pab_ioctl_checksum_page = PAB_IOCTL_CHECKSUM_PAGE;
+const uintptr_t pab_ioctl_stats = PAB_IOCTL_STATS;
 */
 import "C"
 
+// MaxZones is an upper bound on Page.Zone.
+const MaxZones = C.PAB_MAX_ZONES
+
+// GFP flags for AllocPageGFP. These aren't the kernel's values, the kmod
+// translates them. With none of them set allocations use GFP_KERNEL.
+const (
+	GFPAtomic  uint = C.PAB_GFP_ATOMIC // GFP_ATOMIC instead of GFP_KERNEL.
+	GFPMovable uint = C.PAB_GFP_MOVABLE
+	GFPZero    uint = C.PAB_GFP_ZERO
+	GFPNoRetry uint = C.PAB_GFP_NORETRY
+	GFPNoWarn  uint = C.PAB_GFP_NOWARN
+)
+
+var gfpNames = map[string]uint{
+	"atomic":  GFPAtomic,
+	"movable": GFPMovable,
+	"zero":    GFPZero,
+	"noretry": GFPNoRetry,
+	"nowarn":  GFPNoWarn,
+}
+
+// ParseGFP parses a comma-separated list of GFP flag names (atomic, movable,
+// zero, noretry, nowarn). The empty string means no flags.
+func ParseGFP(s string) (uint, error) {
+	var gfp uint
+	if s == "" {
+		return 0, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		bit, ok := gfpNames[strings.TrimSpace(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown GFP flag %q", name)
+		}
+		gfp |= bit
+	}
+	return gfp, nil
+}
+
 var legacyFreePageInterface = flag.Bool("kmod-legacy-free-page", false,
 	"[Google hack] kmod is out of date, uses FREE_PAGE interface")
 
+// DefaultDevicePath is where the kernel module creates its device file.
+const DefaultDevicePath = "/proc/page_alloc_bench"
+
+// Open connects to the kernel module via its device file.
+func Open(path string) (*Connection, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening kernel module device (is page_alloc_bench.ko loaded?): %w", err)
+	}
+	return &Connection{File: file}, nil
+}
+
 // Connection is a connection to a loaded kernel module.
 type Connection struct {
 	*os.File
 }
 
+// ErrUnsupported is wrapped by errors from calls that the kernel module doesn't
+// support. The module and userspace must be upgraded together, so this
+// probably means they're from different versions of page_alloc_bench.
+var ErrUnsupported = errors.New("not supported by the kernel module")
+
+// Issues an ioctl to the kmod. The kmod fails unknown ioctls with ENOTTY, that
+// comes back wrapped with ErrUnsupported too.
+func (k *Connection) ioctl(cmd, arg uintptr) error {
+	err := linux.Ioctl(k.File, cmd, arg)
+	if errors.Is(err, syscall.ENOTTY) {
+		return fmt.Errorf("%w (is it from a different version of page_alloc_bench?): %w", ErrUnsupported, err)
+	}
+	return err
+}
+
 // Page represents a page allocated by the kernel module.
 type Page struct {
 	NID     int           // NUMA node ID
+	Zone    int           // Zone index (kernel's enum zone_type), less than MaxZones.
+	Order   int           // As passed to AllocPage.
 	Latency time.Duration // Excluding syscall/userspace overhead.
+	PFN     uint64        // Page frame number, of the first page for higher orders.
 	id      C.ulong       // Opaque ID (spoiler: struct page *) used to free it.
 }
 
 // AllocPage allocates a page. Returned errors will wrap a syscall.Errno where
 // possible.
 func (k *Connection) AllocPage(order int) (*Page, error) {
+	return k.AllocPageOnNode(order, -1)
+}
+
+// AllocPageOnNode allocates a page from a specific NUMA node, failing with
+// syscall.ENOMEM if that node has no suitable memory rather than falling back
+// to another node. nid -1 means any node, like AllocPage.
+func (k *Connection) AllocPageOnNode(order, nid int) (*Page, error) {
+	return k.AllocPageOnNodeGFP(order, nid, 0)
+}
+
+// AllocPageGFP allocates a page using the given GFP* flags. Picking flags that
+// make sense (e.g. GFPAtomic can dip into memory reserves) is up to the caller.
+func (k *Connection) AllocPageGFP(order int, gfp uint) (*Page, error) {
+	return k.AllocPageOnNodeGFP(order, -1, gfp)
+}
+
+// AllocPageOnNodeGFP combines AllocPageOnNode and AllocPageGFP.
+func (k *Connection) AllocPageOnNodeGFP(order, nid int, gfp uint) (*Page, error) {
 	var ioctl C.struct_pab_ioctl_alloc_page
 	ioctl.args.order = C.int(order)
-	err := linux.Ioctl(k.File, C.pab_ioctl_alloc_page, uintptr(unsafe.Pointer(&ioctl)))
+	ioctl.args.nid = C.int(nid)
+	ioctl.args.gfp = C.uint(gfp)
+	err := k.ioctl(C.pab_ioctl_alloc_page, uintptr(unsafe.Pointer(&ioctl)))
 	if err != nil {
 		return nil, err
 	}
+	return newPage(&ioctl.result, order), nil
+}
+
+func newPage(result *C.struct_pab_alloc_result, order int) *Page {
 	return &Page{
-		id:      ioctl.result.id,
-		Latency: time.Duration(ioctl.result.latency_ns) * time.Nanosecond,
-		NID:     int(ioctl.result.nid),
-	}, err
+		id:      result.id,
+		Latency: time.Duration(result.latency_ns) * time.Nanosecond,
+		NID:     int(result.nid),
+		Zone:    int(result.zone),
+		PFN:     uint64(result.pfn),
+		Order:   order,
+	}
+}
+
+// AllocPages allocates count pages of the same order, with one syscall per
+// batch of up to C.PAB_MAX_BATCH pages. If not all of them could be allocated
+// it returns the ones that were, along with the error that stopped it, as for
+// AllocPage.
+func (k *Connection) AllocPages(order, count int) ([]*Page, error) {
+	return k.AllocPagesOnNodeGFP(order, -1, count, 0)
+}
+
+// AllocPagesOnNodeGFP is AllocPages with the nid and gfp arguments of
+// AllocPageOnNodeGFP.
+func (k *Connection) AllocPagesOnNodeGFP(order, nid, count int, gfp uint) ([]*Page, error) {
+	pages := make([]*Page, 0, count)
+	results := make([]C.struct_pab_alloc_result, min(count, C.PAB_MAX_BATCH))
+	for len(pages) < count {
+		var ioctl C.struct_pab_ioctl_alloc_pages
+		ioctl.args.order = C.int(order)
+		ioctl.args.count = C.int(min(count-len(pages), len(results)))
+		ioctl.args.nid = C.int(nid)
+		ioctl.args.gfp = C.uint(gfp)
+		ioctl.args.results = C.ulong(uintptr(unsafe.Pointer(&results[0])))
+		err := k.ioctl(C.pab_ioctl_alloc_pages, uintptr(unsafe.Pointer(&ioctl)))
+		runtime.KeepAlive(results) // The kernel wrote to it via a plain integer.
+		if err != nil {
+			return pages, fmt.Errorf("allocated %d/%d order-%d pages: %w",
+				len(pages), count, order, err)
+		}
+		// If the batch came up short, the next one fails straight away
+		// with the error.
+		for i := 0; i < int(ioctl.result.allocated); i++ {
+			pages = append(pages, newPage(&results[i], order))
+		}
+	}
+	return pages, nil
 }
 
 // FreePage frees a page. Returns the latency, if the kmods supports it.
 // TODO: Make it not a pointer once the kmod always support it.
 func (k *Connection) FreePage(page *Page) (*time.Duration, error) {
 	if *legacyFreePageInterface {
-		return nil, linux.Ioctl(k.File, C.pab_ioctl_free_page_legacy, uintptr(page.id))
+		return nil, k.ioctl(C.pab_ioctl_free_page_legacy, uintptr(page.id))
 	}
 
 	var ioctl C.struct_pab_ioctl_free_page
 	ioctl.args.id = page.id
-	err := linux.Ioctl(k.File, C.pab_ioctl_free_page, uintptr(unsafe.Pointer(&ioctl)))
+	err := k.ioctl(C.pab_ioctl_free_page, uintptr(unsafe.Pointer(&ioctl)))
 	if err != nil {
 		return nil, err
 	}
 	d := time.Duration(ioctl.result.latency_ns) * time.Nanosecond
 	return &d, nil
 }
+
+// FreePages frees pages, with one syscall per batch of up to C.PAB_MAX_BATCH
+// pages. It returns a latency for each page that was freed, in order. If that's
+// not all of them, an error is returned too. With --kmod-legacy-free-page it
+// calls FreePage for each page and the latencies are all zero.
+func (k *Connection) FreePages(pages []*Page) ([]time.Duration, error) {
+	latencies := make([]time.Duration, 0, len(pages))
+	ids := make([]C.ulong, min(len(pages), C.PAB_MAX_BATCH))
+	results := make([]C.long, len(ids))
+	for len(latencies) < len(pages) {
+		if *legacyFreePageInterface {
+			latency, err := k.FreePage(pages[len(latencies)])
+			if err != nil {
+				return latencies, err
+			}
+			var d time.Duration
+			if latency != nil {
+				d = *latency
+			}
+			latencies = append(latencies, d)
+			continue
+		}
+
+		batch := pages[len(latencies):]
+		batch = batch[:min(len(batch), len(ids))]
+		for i, page := range batch {
+			ids[i] = page.id
+		}
+		var ioctl C.struct_pab_ioctl_free_pages
+		ioctl.args.count = C.int(len(batch))
+		ioctl.args.ids = C.ulong(uintptr(unsafe.Pointer(&ids[0])))
+		ioctl.args.latencies_ns = C.ulong(uintptr(unsafe.Pointer(&results[0])))
+		err := k.ioctl(C.pab_ioctl_free_pages, uintptr(unsafe.Pointer(&ioctl)))
+		runtime.KeepAlive(ids) // The kernel accessed these via plain integers.
+		runtime.KeepAlive(results)
+		if err != nil {
+			return latencies, err
+		}
+		for i := 0; i < int(ioctl.result.freed); i++ {
+			latencies = append(latencies, time.Duration(results[i])*time.Nanosecond)
+		}
+		if ioctl.result.freed < ioctl.args.count {
+			return latencies, fmt.Errorf("freeing page %d/%d: %w",
+				len(latencies)+1, len(pages), syscall.EINVAL)
+		}
+	}
+	return latencies, nil
+}
+
+// PageReservedBytes is how many bytes at the start of each page are used by
+// the kmod. WritePage and ChecksumPage skip these.
+const PageReservedBytes = C.PAB_PAGE_RESERVED_BYTES
+
+// WritePage fills the page's contents (except the first PageReservedBytes)
+// with pattern.
+func (k *Connection) WritePage(page *Page, pattern byte) error {
+	var ioctl C.struct_pab_ioctl_page_data
+	ioctl.args.id = page.id
+	ioctl.args.pattern = C.uchar(pattern)
+	return k.ioctl(C.pab_ioctl_write_page, uintptr(unsafe.Pointer(&ioctl)))
+}
+
+// ChecksumPage returns the CRC-32 (IEEE) of the page's contents, except the
+// first PageReservedBytes.
+func (k *Connection) ChecksumPage(page *Page) (uint32, error) {
+	var ioctl C.struct_pab_ioctl_page_data
+	ioctl.args.id = page.id
+	err := k.ioctl(C.pab_ioctl_checksum_page, uintptr(unsafe.Pointer(&ioctl)))
+	if err != nil {
+		return 0, err
+	}
+	return uint32(ioctl.result.crc32), nil
+}
+
+// PatternChecksum returns what ChecksumPage should return for a page of the
+// given order after WritePage with the given pattern.
+func PatternChecksum(order int, pattern byte) uint32 {
+	size := (os.Getpagesize() << order) - PageReservedBytes
+	chunk := bytes.Repeat([]byte{pattern}, os.Getpagesize())
+	crc := uint32(0)
+	for size > 0 {
+		n := min(size, len(chunk))
+		crc = crc32.Update(crc, crc32.IEEETable, chunk[:n])
+		size -= n
+	}
+	return crc
+}
+
+// NumOrders is an upper bound on the page orders the kmod allocates, plus one.
+const NumOrders = C.PAB_NR_ORDERS
+
+// KmodStats describes what the kmod is currently holding. This is across all
+// connections, not just one.
+type KmodStats struct {
+	AllocsByOrder [NumOrders]uint64 // Number of allocations of each order.
+	Bytes         pab.ByteSize      // Total size of those allocations.
+}
+
+// Stats returns what the kmod is currently holding.
+func (k *Connection) Stats() (KmodStats, error) {
+	var ioctl C.struct_pab_ioctl_stats
+	err := k.ioctl(C.pab_ioctl_stats, uintptr(unsafe.Pointer(&ioctl)))
+	if err != nil {
+		return KmodStats{}, err
+	}
+	stats := KmodStats{Bytes: pab.ByteSize(ioctl.result.bytes)}
+	for order := range stats.AllocsByOrder {
+		stats.AllocsByOrder[order] = uint64(ioctl.result.allocs_by_order[order])
+	}
+	return stats, nil
+}
@@ -0,0 +1,232 @@
+// Copyright 2024 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+
+package kmod
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/google/page_alloc_bench/pab"
+)
+
+// Connects to the kernel module, skipping the test if it isn't loaded.
+func openOrSkip(t *testing.T) *Connection {
+	t.Helper()
+	if _, err := os.Stat(DefaultDevicePath); err != nil {
+		t.Skipf("kernel module not loaded: %v", err)
+	}
+	k, err := Open(DefaultDevicePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { k.Close() })
+	return k
+}
+
+func TestAllocPages(t *testing.T) {
+	k := openOrSkip(t)
+	pages, err := k.AllocPages(0, 64)
+	for _, page := range pages {
+		if _, err := k.FreePage(page); err != nil {
+			t.Errorf("FreePage: %v", err)
+		}
+	}
+	if err != nil {
+		t.Fatalf("AllocPages: %v", err)
+	}
+	if len(pages) != 64 {
+		t.Fatalf("got %d pages, want 64", len(pages))
+	}
+	pfns := make(map[uint64]bool)
+	for _, page := range pages {
+		if page.Order != 0 {
+			t.Errorf("got order %d page, want 0", page.Order)
+		}
+		if pfns[page.PFN] {
+			t.Errorf("got PFN %#x twice", page.PFN)
+		}
+		pfns[page.PFN] = true
+	}
+}
+
+func TestFreePages(t *testing.T) {
+	k := openOrSkip(t)
+	pages, err := k.AllocPages(1, 100)
+	if err != nil {
+		k.FreePages(pages)
+		t.Fatalf("AllocPages: %v", err)
+	}
+	latencies, err := k.FreePages(pages)
+	if err != nil {
+		t.Fatalf("FreePages: %v", err)
+	}
+	if len(latencies) != len(pages) {
+		t.Errorf("got %d latencies, want %d", len(latencies), len(pages))
+	}
+}
+
+func TestStats(t *testing.T) {
+	k := openOrSkip(t)
+	const n = 10
+	before, err := k.Stats()
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	pages, err := k.AllocPages(2, n)
+	defer k.FreePages(pages)
+	if err != nil {
+		t.Fatalf("AllocPages: %v", err)
+	}
+	after, err := k.Stats()
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	// The stats are for the whole kmod, only count what this test added.
+	if got, want := after.Bytes-before.Bytes, pab.ByteSize(n*4*os.Getpagesize()); got != want {
+		t.Errorf("bytes held went up by %v, want %v", got, want)
+	}
+	if got := after.AllocsByOrder[2] - before.AllocsByOrder[2]; got != n {
+		t.Errorf("order-2 allocations went up by %d, want %d", got, n)
+	}
+}
+
+// Anything that isn't the kmod fails its ioctls with ENOTTY, like a kmod that
+// doesn't know them.
+func TestUnsupported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "page_alloc_bench")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	k, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	if _, err := k.Stats(); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Stats returned %v, want ErrUnsupported", err)
+	}
+}
+
+func TestWritePage(t *testing.T) {
+	k := openOrSkip(t)
+	page, err := k.AllocPage(0)
+	if err != nil {
+		t.Fatalf("AllocPage: %v", err)
+	}
+	if err := k.WritePage(page, 0xab); err != nil {
+		k.FreePage(page)
+		t.Fatalf("WritePage: %v", err)
+	}
+	got, err := k.ChecksumPage(page)
+	if err != nil {
+		t.Errorf("ChecksumPage: %v", err)
+	}
+	data := bytes.Repeat([]byte{0xab}, os.Getpagesize()-PageReservedBytes)
+	if want := crc32.ChecksumIEEE(data); got != want {
+		t.Errorf("got checksum %#x, want %#x", got, want)
+	}
+
+	// The kmod only touches pages it allocated and hasn't freed.
+	bogus := *page
+	bogus.id++
+	if err := k.WritePage(&bogus, 0xab); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("WritePage with a bogus ID returned %v, want EINVAL", err)
+	}
+	if _, err := k.FreePage(page); err != nil {
+		t.Fatalf("FreePage: %v", err)
+	}
+	if err := k.WritePage(page, 0xab); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("WritePage of a freed page returned %v, want EINVAL", err)
+	}
+	if _, err := k.FreePage(page); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("freeing a page twice returned %v, want EINVAL", err)
+	}
+}
+
+func TestAllocPageOnNode(t *testing.T) {
+	k := openOrSkip(t)
+	page, err := k.AllocPageOnNode(0, 0)
+	if err != nil {
+		t.Fatalf("AllocPageOnNode: %v", err)
+	}
+	defer k.FreePage(page)
+	if page.NID != 0 {
+		t.Errorf("got page on node %d, want 0", page.NID)
+	}
+}
+
+func TestAllocPageGFPZero(t *testing.T) {
+	k := openOrSkip(t)
+	// Dirty some pages first, so there's a chance of getting one back that
+	// isn't already zero.
+	dirty, err := k.AllocPages(0, 64)
+	for _, page := range dirty {
+		k.WritePage(page, 0xff)
+	}
+	k.FreePages(dirty)
+	if err != nil {
+		t.Fatalf("AllocPages: %v", err)
+	}
+
+	page, err := k.AllocPageGFP(0, GFPZero)
+	if err != nil {
+		t.Fatalf("AllocPageGFP: %v", err)
+	}
+	defer k.FreePage(page)
+	got, err := k.ChecksumPage(page)
+	if err != nil {
+		t.Fatalf("ChecksumPage: %v", err)
+	}
+	if want := crc32.ChecksumIEEE(make([]byte, os.Getpagesize()-PageReservedBytes)); got != want {
+		t.Errorf("got checksum %#x, want %#x for a zeroed page", got, want)
+	}
+}
+
+func TestPFNAligned(t *testing.T) {
+	k := openOrSkip(t)
+	for _, order := range []int{0, 1, 4, 9} {
+		pages, err := k.AllocPages(order, 8)
+		k.FreePages(pages)
+		if err != nil {
+			t.Fatalf("AllocPages(%d, 8): %v", order, err)
+		}
+		for _, page := range pages {
+			if page.PFN == 0 || page.PFN%(1<<order) != 0 {
+				t.Errorf("got order-%d page at PFN %#x, want non-zero and %d-page aligned",
+					order, page.PFN, 1<<order)
+			}
+		}
+	}
+}
+
+func TestOpenMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "page_alloc_bench")
+	_, err := Open(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Open(%q) returned %v, want ErrNotExist", path, err)
+	}
+	for _, want := range []string{path, "page_alloc_bench.ko loaded?"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %q, want it to mention %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+
+package kmod
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/page_alloc_bench/linux"
+)
+
+// Thread runs calls to the kmod on a dedicated OS thread, so that callers can
+// stop waiting for them when a context is cancelled. A syscall can't actually
+// be interrupted, so an abandoned call still completes in the kernel, and the
+// Thread is busy until it does. If an abandoned allocation succeeds the page
+// is freed again.
+type Thread struct {
+	k *Connection
+	// Usually k.FreePage, tests swap it out.
+	free func(page *Page) (*time.Duration, error)
+	reqs chan *threadRequest
+}
+
+// States of a threadRequest.
+const (
+	requestPending int32 = iota
+	requestAbandoned
+	requestDone
+)
+
+type threadRequest struct {
+	state atomic.Int32
+	call  func() (*Page, *time.Duration, error)
+	reply chan threadReply // Only sent to if the request isn't abandoned.
+}
+
+type threadReply struct {
+	page    *Page
+	latency *time.Duration
+	err     error
+}
+
+// NewThread starts a thread for making calls to the kmod, confined to the
+// given CPUs. Per-CPU behaviour in the kernel depends on which CPU makes the
+// call, so usually this should be the caller's CPU. Call Close when done.
+func (k *Connection) NewThread(cpus linux.CPUMask) (*Thread, error) {
+	return startThread(&Thread{k: k, free: k.FreePage, reqs: make(chan *threadRequest)}, cpus)
+}
+
+func startThread(t *Thread, cpus linux.CPUMask) (*Thread, error) {
+	started := make(chan error)
+	go func() {
+		// Never unlocked, so the thread (with its affinity) is thrown
+		// away when this goroutine exits.
+		runtime.LockOSThread()
+		if err := linux.SchedSetaffinity(linux.PIDCallingThread, cpus); err != nil {
+			started <- fmt.Errorf("SchedSetaffinity(%v): %w", cpus, err)
+			return
+		}
+		close(started)
+		for req := range t.reqs {
+			var r threadReply
+			r.page, r.latency, r.err = req.call()
+			if req.state.CompareAndSwap(requestPending, requestDone) {
+				req.reply <- r
+			} else if r.page != nil {
+				// Nobody's going to free this.
+				t.free(r.page)
+			}
+		}
+	}()
+	if err := <-started; err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Close stops the thread. Don't call it concurrently with other methods.
+func (t *Thread) Close() {
+	close(t.reqs)
+}
+
+// Runs call on the thread. The second result is false if ctx was done before
+// the thread picked the call up, so it never ran.
+func (t *Thread) do(ctx context.Context, call func() (*Page, *time.Duration, error)) (threadReply, bool) {
+	req := &threadRequest{call: call, reply: make(chan threadReply, 1)}
+	select {
+	case t.reqs <- req:
+	case <-ctx.Done():
+		return threadReply{err: ctx.Err()}, false
+	}
+	select {
+	case r := <-req.reply:
+		return r, true
+	case <-ctx.Done():
+		if req.state.CompareAndSwap(requestPending, requestAbandoned) {
+			return threadReply{err: ctx.Err()}, true
+		}
+		// Finished just in time.
+		return <-req.reply, true
+	}
+}
+
+// AllocPageContext is like Connection.AllocPage, but if ctx is done before the
+// allocation completes it returns ctx.Err().
+func (t *Thread) AllocPageContext(ctx context.Context, order int) (*Page, error) {
+	return t.AllocPageOnNodeGFPContext(ctx, order, -1, 0)
+}
+
+// AllocPageOnNodeGFPContext is like Connection.AllocPageOnNodeGFP, but if ctx
+// is done before the allocation completes it returns ctx.Err().
+func (t *Thread) AllocPageOnNodeGFPContext(ctx context.Context, order, nid int, gfp uint) (*Page, error) {
+	r, _ := t.do(ctx, func() (*Page, *time.Duration, error) {
+		page, err := t.k.AllocPageOnNodeGFP(order, nid, gfp)
+		return page, nil, err
+	})
+	return r.page, r.err
+}
+
+// FreePageContext is like Connection.FreePage, but if ctx is done before the
+// free completes it returns ctx.Err(). The page is freed either way: if the
+// thread had already started on it, the free completes in the background,
+// otherwise it's freed directly before returning (which blocks).
+func (t *Thread) FreePageContext(ctx context.Context, page *Page) (*time.Duration, error) {
+	r, started := t.do(ctx, func() (*Page, *time.Duration, error) {
+		latency, err := t.free(page)
+		return nil, latency, err
+	})
+	if !started {
+		// Not worth reporting errors from this, the caller has given up.
+		t.free(page)
+	}
+	return r.latency, r.err
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+
+package kmod
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/page_alloc_bench/linux"
+)
+
+// Starts a Thread that doesn't need the kernel module. Its frees send the page
+// to freeing, block until release is closed, then send the page to freed.
+func fakeThread(t *testing.T) (thread *Thread, freeing chan *Page, release chan struct{}, freed chan *Page) {
+	t.Helper()
+	freeing, release, freed = make(chan *Page, 10), make(chan struct{}), make(chan *Page, 10)
+	cpus, err := linux.SchedGetaffinity(linux.PIDCallingThread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread, err = startThread(&Thread{
+		free: func(page *Page) (*time.Duration, error) {
+			freeing <- page
+			<-release
+			freed <- page
+			return new(time.Duration), nil
+		},
+		reqs: make(chan *threadRequest),
+	}, cpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(thread.Close)
+	return thread, freeing, release, freed
+}
+
+// Waits for a page to be freed.
+func waitFreed(t *testing.T, freed chan *Page) *Page {
+	t.Helper()
+	select {
+	case page := <-freed:
+		return page
+	case <-time.After(10 * time.Second):
+		t.Fatalf("page never got freed")
+		return nil
+	}
+}
+
+func TestThreadAbandonedAlloc(t *testing.T) {
+	thread, _, release, freed := fakeThread(t)
+	close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	page := &Page{PFN: 1234}
+	started, unblock := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		r, _ := thread.do(ctx, func() (*Page, *time.Duration, error) {
+			close(started)
+			<-unblock
+			return page, nil, nil
+		})
+		done <- r.err
+	}()
+
+	// The caller gives up while the allocation is stuck.
+	<-started
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("got error %v from an abandoned allocation, want %v", err, context.Canceled)
+	}
+	// Once it completes, the thread frees the page itself.
+	close(unblock)
+	if got := waitFreed(t, freed); got != page {
+		t.Errorf("freed page %+v, want the abandoned allocation %+v", got, page)
+	}
+}
+
+func TestThreadFreePageContext(t *testing.T) {
+	thread, freeing, release, freed := fakeThread(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// A free that's stuck in the kernel.
+	stuck := &Page{PFN: 1}
+	done := make(chan error)
+	go func() {
+		_, err := thread.FreePageContext(ctx, stuck)
+		done <- err
+	}()
+	<-freeing
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("got error %v from an abandoned free, want %v", err, context.Canceled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("FreePageContext didn't return when cancelled")
+	}
+
+	// The thread's still busy, so this one never starts there, but it
+	// still gets freed.
+	late := &Page{PFN: 2}
+	go func() {
+		_, err := thread.FreePageContext(ctx, late)
+		done <- err
+	}()
+	close(release)
+	got := map[*Page]bool{waitFreed(t, freed): true, waitFreed(t, freed): true}
+	if !got[stuck] || !got[late] {
+		t.Errorf("got frees of %v, want both pages", got)
+	}
+	if err := <-done; err != context.Canceled {
+		t.Errorf("got error %v from a free with a cancelled context, want %v", err, context.Canceled)
+	}
+	select {
+	case page := <-freed:
+		t.Errorf("page %+v got freed twice", page)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
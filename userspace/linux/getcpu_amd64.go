@@ -0,0 +1,21 @@
+// Copyright 2024 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+
+package linux
+
+// The syscall package has SYS_GETCPU for every other architecture, but not
+// amd64, where its syscall table was frozen before getcpu was added. Hence
+// this and getcpu_other.go rather than using syscall.SYS_GETCPU everywhere.
+const sysGetcpu = 309
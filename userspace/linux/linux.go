@@ -17,15 +17,24 @@
 package linux
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
+	"math/bits"
 	"os"
+	"path"
 	"regexp"
+	"runtime"
 	"slices"
 	"strconv"
 	"strings"
 	"syscall"
 	"unsafe"
+
+	"github.com/google/page_alloc_bench/pab"
 )
 
 // Note that sched_setaffinity(2) is documenting the libc wrapper not
@@ -35,19 +44,107 @@ type CPUMask []uint64
 
 // NewCPUMask creates a CPUMask with the given CPU numbers set.
 func NewCPUMask(cpus ...int) CPUMask {
+	if len(cpus) == 0 {
+		return CPUMask{}
+	}
 	maxCPU := slices.Max(cpus)
 	mask := make([]uint64, (maxCPU/64)+1)
-	for cpu, _ := range cpus {
+	for _, cpu := range cpus {
 		mask[cpu/64] |= 1 << (cpu % 64)
 	}
 	return mask
 }
 
+// CPUs returns the CPU numbers set in the mask, in ascending order.
+func (m CPUMask) CPUs() []int {
+	var cpus []int
+	for i, word := range m {
+		for bit := 0; bit < 64; bit++ {
+			if word&(1<<bit) != 0 {
+				cpus = append(cpus, i*64+bit)
+			}
+		}
+	}
+	return cpus
+}
+
+// Word i of the mask, treating missing words as zero.
+func (m CPUMask) word(i int) uint64 {
+	if i < len(m) {
+		return m[i]
+	}
+	return 0
+}
+
+// Applies op to each pair of words in two masks, which can differ in length.
+func (m CPUMask) combine(other CPUMask, op func(a, b uint64) uint64) CPUMask {
+	ret := make(CPUMask, max(len(m), len(other)))
+	for i := range ret {
+		ret[i] = op(m.word(i), other.word(i))
+	}
+	return ret
+}
+
+// Union returns a mask with the CPUs that are in either mask.
+func (m CPUMask) Union(other CPUMask) CPUMask {
+	return m.combine(other, func(a, b uint64) uint64 { return a | b })
+}
+
+// Intersect returns a mask with the CPUs that are in both masks.
+func (m CPUMask) Intersect(other CPUMask) CPUMask {
+	return m.combine(other, func(a, b uint64) uint64 { return a & b })
+}
+
+// Difference returns a mask with the CPUs that are in m but not other.
+func (m CPUMask) Difference(other CPUMask) CPUMask {
+	return m.combine(other, func(a, b uint64) uint64 { return a &^ b })
+}
+
+// Count returns the number of CPUs in the mask.
+func (m CPUMask) Count() int {
+	n := 0
+	for _, word := range m {
+		n += bits.OnesCount64(word)
+	}
+	return n
+}
+
+// Contains returns whether the CPU is in the mask.
+func (m CPUMask) Contains(cpu int) bool {
+	return cpu >= 0 && m.word(cpu/64)&(1<<(cpu%64)) != 0
+}
+
+// String formats the mask in the same format that CPUMaskFromString parses,
+// e.g. "0-3,7,9-11".
+func (m CPUMask) String() string {
+	var parts []string
+	cpus := m.CPUs()
+	for i := 0; i < len(cpus); {
+		// Find the end of this contiguous range.
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(cpus[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
 // Parses a CPUMask from this format:
 // https://docs.kernel.org/core-api/printk-formats.html#bitmap-and-its-derivatives-such-as-cpumask-and-nodemask
 func CPUMaskFromString(s string) (CPUMask, error) {
-	parts := strings.Split(strings.TrimSpace(s), ",")
-	var mask []uint64
+	s = strings.TrimSpace(s)
+	if s == "" {
+		// E.g. the cpulist of a NUMA node with no CPUs.
+		return CPUMask{}, nil
+	}
+	parts := strings.Split(s, ",")
+	var cpus []int
 	for _, part := range parts {
 		from, to, didCut := strings.Cut(part, "-")
 		if didCut {
@@ -60,17 +157,22 @@ func CPUMaskFromString(s string) (CPUMask, error) {
 				return nil, fmt.Errorf("parsing %q (from %q) as int CPU ID: %v", to, part, err)
 			}
 			for i := fromInt; i <= toInt; i++ {
-				mask = append(mask, uint64(i))
+				cpus = append(cpus, i)
 			}
 		} else {
 			cpu, err := strconv.Atoi(part)
 			if err != nil {
-				return nil, fmt.Errorf("parsing %q (from %q) as int CPU ID: %v", cpu, part, err)
+				return nil, fmt.Errorf("parsing %q as int CPU ID: %v", part, err)
 			}
-			mask = append(mask, uint64(cpu))
+			cpus = append(cpus, cpu)
 		}
 	}
-	return CPUMask(mask), nil
+	for _, cpu := range cpus {
+		if cpu < 0 {
+			return nil, fmt.Errorf("negative CPU ID %d in %q", cpu, s)
+		}
+	}
+	return NewCPUMask(cpus...), nil
 }
 
 // PIDCallingThread is an argument for SchedSetaffinity.
@@ -81,11 +183,126 @@ const PIDCallingThread = 0
 func SchedSetaffinity(pid int, mask CPUMask) error {
 	size := uintptr(8 * len(mask))
 	maskData := uintptr(unsafe.Pointer(unsafe.SliceData(mask)))
-	_, _, err := syscall.Syscall(syscall.SYS_SCHED_SETAFFINITY, 0, size, maskData)
+	_, _, err := syscall.Syscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(pid), size, maskData)
+	if err != 0 {
+		return fmt.Errorf("sched_setaffinity(%d, %+v): %w", pid, mask, err)
+	}
+
+	return nil
+}
+
+// SchedGetaffinity wraps the sched_getaffinity syscall. Use PIDCallingThread
+// for the pid argument to get the affinity of the current thread.
+func SchedGetaffinity(pid int) (CPUMask, error) {
+	// The kernel rejects buffers smaller than its cpumask, which can be
+	// bigger than runtime.NumCPU suggests, so start generous and grow
+	// the buffer if it's not enough.
+	for words := max((runtime.NumCPU()+63)/64, 16); ; words *= 2 {
+		mask := make(CPUMask, words)
+		size := uintptr(8 * len(mask))
+		maskData := uintptr(unsafe.Pointer(unsafe.SliceData(mask)))
+		n, _, err := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, uintptr(pid), size, maskData)
+		if err == syscall.EINVAL && words < 1<<16 {
+			continue
+		}
+		if err != 0 {
+			return nil, fmt.Errorf("sched_getaffinity(%d): %w", pid, err)
+		}
+		// The syscall returns the number of bytes it wrote.
+		mask = mask[:n/8]
+		for len(mask) > 0 && mask[len(mask)-1] == 0 {
+			mask = mask[:len(mask)-1]
+		}
+		return mask, nil
+	}
+}
+
+// SetProcessAffinity sets the affinity of every thread in the current process.
+// Threads created later inherit the affinity of the thread that creates them,
+// so this only affects future threads to the extent that they're spawned from
+// existing ones.
+func SetProcessAffinity(mask CPUMask) error {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return fmt.Errorf("listing threads: %v", err)
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			return fmt.Errorf("parsing thread ID %q: %v", task.Name(), err)
+		}
+		if err := SchedSetaffinity(tid, mask); err != nil {
+			if errors.Is(err, syscall.ESRCH) {
+				continue // Thread exited in the meantime.
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Memory policy modes for SetMempolicy and Mbind, from
+// include/uapi/linux/mempolicy.h.
+const (
+	MPOL_DEFAULT    = 0
+	MPOL_PREFERRED  = 1
+	MPOL_BIND       = 2
+	MPOL_INTERLEAVE = 3
+)
+
+// Flags for Mbind.
+const (
+	MPOL_MF_STRICT = 1 << 0
+	MPOL_MF_MOVE   = 1 << 1
+)
+
+// Returns the nodemask and maxnode arguments for the mempolicy syscalls. The
+// CPUMask type is reused for node masks, they're the same format.
+func nodemaskArgs(nodes CPUMask) (uintptr, uintptr) {
+	if len(nodes) == 0 {
+		return 0, 0
+	}
+	// The kernel ignores the last bit of maxnode, this is what libnuma
+	// does too.
+	return uintptr(unsafe.Pointer(unsafe.SliceData(nodes))), uintptr(64*len(nodes) + 1)
+}
+
+// SetMempolicy wraps the set_mempolicy syscall, setting the NUMA memory policy
+// for the calling thread. nodes is a mask of NUMA node IDs.
+func SetMempolicy(mode int, nodes CPUMask) error {
+	mask, maxnode := nodemaskArgs(nodes)
+	_, _, err := syscall.Syscall(syscall.SYS_SET_MEMPOLICY, uintptr(mode), mask, maxnode)
+	if err != 0 {
+		return fmt.Errorf("set_mempolicy(%d, %v): %w", mode, nodes, err)
+	}
+	return nil
+}
+
+// Mbind wraps the mbind syscall, setting the NUMA memory policy for a range of
+// memory. nodes is a mask of NUMA node IDs.
+func Mbind(addr uintptr, length int, mode int, nodes CPUMask, flags int) error {
+	mask, maxnode := nodemaskArgs(nodes)
+	_, _, err := syscall.Syscall6(syscall.SYS_MBIND, addr, uintptr(length), uintptr(mode), mask, maxnode, uintptr(flags))
 	if err != 0 {
-		return fmt.Errorf("sched_setaffinity(%d, %+v): %v", pid, mask, err)
+		return fmt.Errorf("mbind(0x%x, %d, %d, %v, 0x%x): %w", addr, length, mode, nodes, flags, err)
 	}
+	return nil
+}
+
+// Advice values for Madvise.
+const (
+	MADV_NORMAL   = syscall.MADV_NORMAL
+	MADV_DONTNEED = syscall.MADV_DONTNEED
+	// Not in the syscall package, from include/uapi/asm-generic/mman-common.h.
+	MADV_FREE = 8
+)
 
+// Madvise wraps the madvise syscall for the memory backing b, which should be
+// page-aligned, e.g. from syscall.Mmap.
+func Madvise(b []byte, advice int) error {
+	if err := syscall.Madvise(b, advice); err != nil {
+		return fmt.Errorf("madvise(%d bytes, %d): %w", len(b), advice, err)
+	}
 	return nil
 }
 
@@ -98,26 +315,31 @@ func Ioctl(file *os.File, cmd, arg uintptr) error {
 	return nil
 }
 
-// For debugging. SYS_GETCPU not in the syscall package. So this only workds on amd64.
-func getcpu() (int, error) {
-	var cpu int
-	_, _, err := syscall.Syscall(309, uintptr(unsafe.Pointer(&cpu)), 0, 0)
-	if err != 0 {
-		return -1, fmt.Errorf("getcpu: %v", err)
+// GetCPU wraps the getcpu syscall, returning the CPU and NUMA node that the
+// calling thread is running on. Unless the thread is pinned to a single CPU,
+// this can be out of date by the time it returns.
+func GetCPU() (cpu int, node int, err error) {
+	var c, n uint32
+	_, _, errno := syscall.RawSyscall(sysGetcpu, uintptr(unsafe.Pointer(&c)), uintptr(unsafe.Pointer(&n)), 0)
+	if errno != 0 {
+		return -1, -1, fmt.Errorf("getcpu: %w", errno)
 	}
-	return cpu, nil
+	return int(c), int(n), nil
 }
 
-var nodeSubdirRegexp = regexp.MustCompile(`node([0-9+])`)
+var nodeSubdirRegexp = regexp.MustCompile(`^node([0-9]+)$`)
 
-// NUMANodes scans sysfs to find the map of NUMA node IDs to the set of CPUs they contain.
-func NUMANodes() (map[int]CPUMask, error) {
-	rootDir := "/sys/devices/system/node/"
-	nodeDirs, err := os.ReadDir(rootDir)
+// Where NUMA nodes are described in sysfs.
+const nodeSysfsDir = "/sys/devices/system/node"
+
+// Reads the file with the given name from each NUMA node's directory in fsys,
+// which is laid out like nodeSysfsDir. Returns a map of node IDs to contents.
+func readNodeFiles(fsys fs.FS, name string) (map[int][]byte, error) {
+	nodeDirs, err := fs.ReadDir(fsys, ".")
 	if err != nil {
-		return nil, fmt.Errorf("reading %s: %v", rootDir, err)
+		return nil, fmt.Errorf("reading NUMA node directory: %v", err)
 	}
-	ret := make(map[int]CPUMask)
+	ret := make(map[int][]byte)
 	for _, subdir := range nodeDirs {
 		m := nodeSubdirRegexp.FindStringSubmatch(subdir.Name())
 		if len(m) != 2 {
@@ -125,17 +347,455 @@ func NUMANodes() (map[int]CPUMask, error) {
 		}
 		nodeID, err := strconv.Atoi(m[1])
 		if err != nil {
-			// Impossible™
-			log.Fatal("Can't parse %q (from %q) as number: %v", m[1], subdir.Name())
+			// Only possible if it overflows an int.
+			return nil, fmt.Errorf("can't parse %q (from %q) as number: %v", m[1], subdir.Name(), err)
 		}
-		cpuMaskSpec, err := os.ReadFile(rootDir + subdir.Name() + "/cpulist")
+		ret[nodeID], err = fs.ReadFile(fsys, subdir.Name()+"/"+name)
 		if err != nil {
-			return nil, fmt.Errorf("reading cpulist for node %d: %v", nodeID, err)
+			return nil, fmt.Errorf("reading %s for node %d: %v", name, nodeID, err)
 		}
-		ret[nodeID], err = CPUMaskFromString(string(cpuMaskSpec))
+	}
+	return ret, nil
+}
+
+// NUMANodes scans sysfs to find the map of NUMA node IDs to the set of CPUs they contain.
+func NUMANodes() (map[int]CPUMask, error) {
+	return numaNodesFrom(os.DirFS(nodeSysfsDir))
+}
+
+// Like NUMANodes but fsys stands in for nodeSysfsDir.
+func numaNodesFrom(fsys fs.FS) (map[int]CPUMask, error) {
+	cpulists, err := readNodeFiles(fsys, "cpulist")
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[int]CPUMask)
+	for nodeID, cpulist := range cpulists {
+		ret[nodeID], err = CPUMaskFromString(string(cpulist))
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("parsing cpulist for node %d: %v", nodeID, err)
 		}
 	}
 	return ret, nil
 }
+
+// NUMANodeMemory scans sysfs to find the total memory of each NUMA node.
+func NUMANodeMemory() (map[int]pab.ByteSize, error) {
+	return numaNodeMemoryFrom(os.DirFS(nodeSysfsDir))
+}
+
+// Like NUMANodeMemory but fsys stands in for nodeSysfsDir.
+func numaNodeMemoryFrom(fsys fs.FS) (map[int]pab.ByteSize, error) {
+	meminfos, err := readNodeFiles(fsys, "meminfo")
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[int]pab.ByteSize)
+	for nodeID, meminfo := range meminfos {
+		found := false
+		for _, line := range strings.Split(string(meminfo), "\n") {
+			// Lines look like "Node 0 MemTotal:       32768 kB".
+			_, val, ok := strings.Cut(line, " MemTotal:")
+			if !ok {
+				continue
+			}
+			ret[nodeID], err = pab.ParseByteSize(val)
+			if err != nil {
+				return nil, fmt.Errorf("parsing MemTotal for node %d: %v", nodeID, err)
+			}
+			found = true
+			break
+		}
+		if !found {
+			return nil, fmt.Errorf("no MemTotal in meminfo for node %d", nodeID)
+		}
+	}
+	return ret, nil
+}
+
+// Meminfo is the content of /proc/meminfo.
+type Meminfo struct {
+	// Fields that are sizes (the ones with a "kB" suffix), by name.
+	Sizes map[string]pab.ByteSize
+	// Fields that are plain numbers (e.g. HugePages_Total), by name.
+	Counts map[string]int64
+}
+
+// The accessors for common fields return zero if the field is missing.
+
+func (m *Meminfo) MemTotal() pab.ByteSize     { return m.Sizes["MemTotal"] }
+func (m *Meminfo) MemFree() pab.ByteSize      { return m.Sizes["MemFree"] }
+func (m *Meminfo) MemAvailable() pab.ByteSize { return m.Sizes["MemAvailable"] }
+
+// ReadMeminfo parses /proc/meminfo.
+func ReadMeminfo() (*Meminfo, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMeminfo(f)
+}
+
+func parseMeminfo(r io.Reader) (*Meminfo, error) {
+	ret := &Meminfo{
+		Sizes:  make(map[string]pab.ByteSize),
+		Counts: make(map[string]int64),
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Lines look like "MemFree:        12345678 kB".
+		key, val, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			return nil, fmt.Errorf("parsing /proc/meminfo line %q: no colon", scanner.Text())
+		}
+		fields := strings.Fields(val)
+		if len(fields) == 0 || len(fields) > 2 || (len(fields) == 2 && fields[1] != "kB") {
+			return nil, fmt.Errorf("parsing /proc/meminfo line %q: unexpected format", scanner.Text())
+		}
+		n, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing /proc/meminfo line %q: %v", scanner.Text(), err)
+		}
+		if len(fields) == 2 {
+			ret.Sizes[key] = pab.ByteSize(n) * pab.Kilobyte
+		} else {
+			ret.Counts[key] = n
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading /proc/meminfo: %v", err)
+	}
+	return ret, nil
+}
+
+const thpEnabledPath = "/sys/kernel/mm/transparent_hugepage/enabled"
+
+// ErrNoTHP is returned by THPMode and SetTHPMode if the kernel doesn't support
+// transparent hugepages.
+var ErrNoTHP = errors.New("kernel doesn't support transparent hugepages")
+
+// THPMode returns the current transparent hugepage mode, e.g. "madvise".
+func THPMode() (string, error) {
+	return thpModeFrom(thpEnabledPath)
+}
+
+// Like THPMode but path stands in for thpEnabledPath.
+func thpModeFrom(path string) (string, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrNoTHP
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	mode, err := parseTHPMode(f)
+	if err != nil {
+		return "", fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return mode, nil
+}
+
+// Parses the contents of thpEnabledPath, which looks like "always [madvise]
+// never". The selected mode is the bracketed one.
+func parseTHPMode(r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	for _, field := range strings.Fields(string(data)) {
+		if mode, ok := strings.CutPrefix(field, "["); ok {
+			if mode, ok := strings.CutSuffix(mode, "]"); ok && mode != "" {
+				return mode, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no selected mode in %q", data)
+}
+
+// SetTHPMode sets the transparent hugepage mode, which must be "always",
+// "madvise" or "never".
+func SetTHPMode(mode string) error {
+	return setTHPModeAt(thpEnabledPath, mode)
+}
+
+// Like SetTHPMode but path stands in for thpEnabledPath.
+func setTHPModeAt(path, mode string) error {
+	switch mode {
+	case "always", "madvise", "never":
+	default:
+		return fmt.Errorf("invalid THP mode %q, want always, madvise or never", mode)
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return ErrNoTHP
+	}
+	if err := os.WriteFile(path, []byte(mode), 0); err != nil {
+		return fmt.Errorf("setting THP mode: %w", err)
+	}
+	return nil
+}
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// ErrNoCgroupV2 is returned by CgroupMemoryMax if the process isn't in a
+// cgroup v2 hierarchy.
+var ErrNoCgroupV2 = errors.New("not using cgroup v2")
+
+// Parses the contents of a cgroup v2 memory.max file. Returns -1 for "max",
+// meaning no limit.
+func parseMemoryMax(s string) (pab.ByteSize, error) {
+	s = strings.TrimSpace(s)
+	if s == "max" {
+		return -1, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing memory.max %q: %v", s, err)
+	}
+	return pab.ByteSize(n), nil
+}
+
+// CgroupMemoryMax returns the tightest cgroup v2 memory.max limit applying to
+// the calling process, from its cgroup or any ancestor. Returns -1 if there's
+// no limit.
+func CgroupMemoryMax() (pab.ByteSize, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return 0, err
+	}
+	// The cgroup v2 line looks like "0::/some/path".
+	var cgroup string
+	for _, line := range strings.Split(string(data), "\n") {
+		if p, ok := strings.CutPrefix(line, "0::"); ok {
+			cgroup = p
+			break
+		}
+	}
+	if cgroup == "" {
+		return 0, ErrNoCgroupV2
+	}
+	limit := pab.ByteSize(-1)
+	for dir := cgroup; ; dir = path.Dir(dir) {
+		data, err := os.ReadFile(path.Join(cgroupRoot, dir, "memory.max"))
+		// The root cgroup doesn't have the file, neither do ones without
+		// the memory controller enabled.
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+		if err == nil {
+			n, err := parseMemoryMax(string(data))
+			if err != nil {
+				return 0, fmt.Errorf("%s: %v", dir, err)
+			}
+			if n >= 0 && (limit < 0 || n < limit) {
+				limit = n
+			}
+		}
+		if dir == "/" || dir == "." {
+			break
+		}
+	}
+	return limit, nil
+}
+
+// Writes "1" to a file that triggers compaction.
+func writeCompactTrigger(path string) error {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s doesn't exist, is CONFIG_COMPACTION disabled?", path)
+	}
+	if err := os.WriteFile(path, []byte("1"), 0); err != nil {
+		return fmt.Errorf("triggering compaction: %w", err)
+	}
+	return nil
+}
+
+// CompactMemory compacts all zones in the system. It returns once compaction
+// is done.
+func CompactMemory() error {
+	return writeCompactTrigger("/proc/sys/vm/compact_memory")
+}
+
+// CompactNode is like CompactMemory but only for one NUMA node.
+func CompactNode(nid int) error {
+	return compactNodeIn(nodeSysfsDir, nid)
+}
+
+// Like CompactNode but dir stands in for nodeSysfsDir.
+func compactNodeIn(dir string, nid int) error {
+	return writeCompactTrigger(fmt.Sprintf("%s/node%d/compact", dir, nid))
+}
+
+// Modes for DropCaches.
+const (
+	DropPageCache = 1
+	DropSlab      = 2
+	DropAll       = DropPageCache | DropSlab
+)
+
+// DropCaches writes to /proc/sys/vm/drop_caches. This needs root, if the error
+// is due to permissions errors.Is(err, os.ErrPermission) is true.
+func DropCaches(mode int) error {
+	return dropCachesAt("/proc/sys/vm/drop_caches", mode)
+}
+
+// Like DropCaches but path stands in for /proc/sys/vm/drop_caches.
+func dropCachesAt(path string, mode int) error {
+	if mode < DropPageCache || mode > DropAll {
+		return fmt.Errorf("invalid drop_caches mode %d", mode)
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(mode)), 0); err != nil {
+		return fmt.Errorf("dropping caches: %w", err)
+	}
+	return nil
+}
+
+// ReadVmstat parses /proc/vmstat into a map from counter names (e.g.
+// "compact_stall") to values.
+func ReadVmstat() (map[string]int64, error) {
+	f, err := os.Open("/proc/vmstat")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseVmstat(f)
+}
+
+func parseVmstat(r io.Reader) (map[string]int64, error) {
+	ret := make(map[string]int64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Lines look like "pgalloc_normal 123456".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("parsing /proc/vmstat line %q: want 2 fields", scanner.Text())
+		}
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing /proc/vmstat line %q: %v", scanner.Text(), err)
+		}
+		ret[fields[0]] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading /proc/vmstat: %v", err)
+	}
+	return ret, nil
+}
+
+// BuddyinfoOrders is the number of orders in /proc/buddyinfo on typical
+// configs (NR_PAGE_ORDERS, i.e. orders 0 to 10).
+const BuddyinfoOrders = 11
+
+// BuddyinfoZone is a line of /proc/buddyinfo.
+type BuddyinfoZone struct {
+	Node int
+	Zone string // E.g. "Normal".
+	// Number of free blocks of each order in the buddy allocator. Orders
+	// that the kernel doesn't report are zero.
+	FreeByOrder [BuddyinfoOrders]int64
+}
+
+// ReadBuddyinfo parses /proc/buddyinfo, which describes the free lists of the
+// buddy allocator.
+func ReadBuddyinfo() ([]BuddyinfoZone, error) {
+	f, err := os.Open("/proc/buddyinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseBuddyinfo(f)
+}
+
+func parseBuddyinfo(r io.Reader) ([]BuddyinfoZone, error) {
+	var ret []BuddyinfoZone
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Lines look like "Node 0, zone   Normal   1   2   3 ...".
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 4 || fields[0] != "Node" || fields[2] != "zone" {
+			return nil, fmt.Errorf("parsing /proc/buddyinfo line %q: unexpected format", line)
+		}
+		node, err := strconv.Atoi(strings.TrimSuffix(fields[1], ","))
+		if err != nil {
+			return nil, fmt.Errorf("parsing /proc/buddyinfo line %q: bad node: %v", line, err)
+		}
+		counts := fields[4:]
+		if len(counts) > BuddyinfoOrders {
+			return nil, fmt.Errorf("parsing /proc/buddyinfo line %q: %d orders, only %d supported",
+				line, len(counts), BuddyinfoOrders)
+		}
+		zone := BuddyinfoZone{Node: node, Zone: fields[3]}
+		for order, str := range counts {
+			zone.FreeByOrder[order], err = strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parsing /proc/buddyinfo line %q: bad count for order %d: %v", line, order, err)
+			}
+		}
+		ret = append(ret, zone)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading /proc/buddyinfo: %v", err)
+	}
+	return ret, nil
+}
+
+// CPUToNode returns a map from CPU number to the ID of the NUMA node it belongs
+// to, based on NUMANodes.
+func CPUToNode() (map[int]int, error) {
+	nodes, err := NUMANodes()
+	if err != nil {
+		return nil, err
+	}
+	return cpuToNodeFromNodes(nodes)
+}
+
+// Inverts the result of NUMANodes. Fails if a CPU appears in more than one node,
+// instead of arbitrarily picking one.
+func cpuToNodeFromNodes(nodes map[int]CPUMask) (map[int]int, error) {
+	// Iterate in a stable order so the error is stable.
+	var nids []int
+	for nid := range nodes {
+		nids = append(nids, nid)
+	}
+	slices.Sort(nids)
+	cpuToNode := make(map[int]int)
+	for _, nid := range nids {
+		for _, cpu := range nodes[nid].CPUs() {
+			if otherNID, ok := cpuToNode[cpu]; ok {
+				return nil, fmt.Errorf("CPU %d appears in both NUMA node %d and node %d", cpu, otherNID, nid)
+			}
+			cpuToNode[cpu] = nid
+		}
+	}
+	return cpuToNode, nil
+}
+
+// WriteCPUToNode saves a mapping as returned by CPUToNode to a JSON file, so
+// that the topology of one machine can be used elsewhere via ReadCPUToNode.
+func WriteCPUToNode(path string, cpuToNode map[int]int) error {
+	data, err := json.Marshal(cpuToNode)
+	if err != nil {
+		return fmt.Errorf("marshalling CPU-to-node mapping: %v", err)
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// ReadCPUToNode loads a mapping saved by WriteCPUToNode.
+func ReadCPUToNode(path string) (map[int]int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cpuToNode map[int]int
+	if err := json.Unmarshal(data, &cpuToNode); err != nil {
+		return nil, fmt.Errorf("parsing CPU-to-node mapping from %s: %v", path, err)
+	}
+	return cpuToNode, nil
+}
@@ -0,0 +1,679 @@
+// Copyright 2024 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+
+package linux
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"unsafe"
+
+	"github.com/google/page_alloc_bench/pab"
+)
+
+// Laid out like nodeSysfsDir on a machine with sparse node IDs, including some
+// files and directories that aren't nodes.
+var nodeFS = fstest.MapFS{
+	"node0/cpulist":   {Data: []byte("0-3,8\n")},
+	"node0/meminfo":   {Data: []byte("Node 0 MemTotal:       32768 kB\nNode 0 MemFree:        1024 kB\n")},
+	"node10/cpulist":  {Data: []byte("4-7\n")},
+	"node10/meminfo":  {Data: []byte("Node 10 MemTotal:       16384 kB\n")},
+	"node127/cpulist": {Data: []byte("\n")}, // Memory-only node.
+	"node127/meminfo": {Data: []byte("Node 127 MemTotal:       4 kB\n")},
+	"has_cpu":         {Data: []byte("0-8\n")},
+	"power/async":     {Data: []byte("disabled\n")},
+}
+
+func TestNUMANodesFrom(t *testing.T) {
+	got, err := numaNodesFrom(nodeFS)
+	if err != nil {
+		t.Fatalf("numaNodesFrom: %v", err)
+	}
+	want := map[int]CPUMask{
+		0:   NewCPUMask(0, 1, 2, 3, 8),
+		10:  NewCPUMask(4, 5, 6, 7),
+		127: NewCPUMask(),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got nodes %v, want %v", got, want)
+	}
+	for nid, mask := range want {
+		if got[nid].String() != mask.String() {
+			t.Errorf("node %d: got CPUs %q, want %q", nid, got[nid], mask)
+		}
+	}
+}
+
+func TestNUMANodeMemoryFrom(t *testing.T) {
+	got, err := numaNodeMemoryFrom(nodeFS)
+	if err != nil {
+		t.Fatalf("numaNodeMemoryFrom: %v", err)
+	}
+	want := map[int]pab.ByteSize{
+		0:   32 * pab.Megabyte,
+		10:  16 * pab.Megabyte,
+		127: 4 * pab.Kilobyte,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestNUMANodeMemoryFromMissingMemTotal(t *testing.T) {
+	fsys := fstest.MapFS{
+		"node0/meminfo": {Data: []byte("Node 0 MemFree:        1024 kB\n")},
+	}
+	if _, err := numaNodeMemoryFrom(fsys); err == nil {
+		t.Errorf("numaNodeMemoryFrom succeeded without MemTotal")
+	}
+}
+
+func TestCPUToNodeFromNodes(t *testing.T) {
+	nodes, err := numaNodesFrom(nodeFS)
+	if err != nil {
+		t.Fatalf("numaNodesFrom: %v", err)
+	}
+	got, err := cpuToNodeFromNodes(nodes)
+	if err != nil {
+		t.Fatalf("cpuToNodeFromNodes: %v", err)
+	}
+	want := map[int]int{0: 0, 1: 0, 2: 0, 3: 0, 8: 0, 4: 10, 5: 10, 6: 10, 7: 10}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCPUToNodeFromNodesDuplicateCPU(t *testing.T) {
+	nodes := map[int]CPUMask{
+		0:  NewCPUMask(0, 1),
+		10: NewCPUMask(1, 2),
+	}
+	_, err := cpuToNodeFromNodes(nodes)
+	if err == nil {
+		t.Fatalf("cpuToNodeFromNodes succeeded with CPU 1 in two nodes")
+	}
+	if want := "CPU 1 appears in both NUMA node 0 and node 10"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q, want it to contain %q", err, want)
+	}
+}
+
+func TestCPUMaskFromString(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "0-3,7,9-11", want: "0-3,7,9-11"},
+		{in: "5,0,1\n", want: "0-1,5"},
+		{in: "", want: ""},
+		{in: "64-65", want: "64-65"},
+		{in: "x", wantErr: true},
+		{in: "1-x", wantErr: true},
+		{in: "-1", wantErr: true},
+	} {
+		got, err := CPUMaskFromString(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("CPUMaskFromString(%q) = %q, want error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got.String() != tc.want {
+			t.Errorf("CPUMaskFromString(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+
+	// It's a bitmask now, not a list: check the bits themselves.
+	mask, err := CPUMaskFromString("2,4-6")
+	if err != nil {
+		t.Fatalf("CPUMaskFromString: %v", err)
+	}
+	for cpu := 0; cpu < 128; cpu++ {
+		want := cpu == 2 || (cpu >= 4 && cpu <= 6)
+		if got := mask.Contains(cpu); got != want {
+			t.Errorf("Contains(%d) = %v, want %v", cpu, got, want)
+		}
+	}
+	if got := mask.Count(); got != 4 {
+		t.Errorf("Count() = %d, want 4", got)
+	}
+}
+
+func TestParseMeminfo(t *testing.T) {
+	m, err := parseMeminfo(strings.NewReader(
+		"MemTotal:       32768 kB\nMemFree:         2048 kB\nHugePages_Total:       3\n"))
+	if err != nil {
+		t.Fatalf("parseMeminfo: %v", err)
+	}
+	if got, want := m.MemTotal(), 32*pab.Megabyte; got != want {
+		t.Errorf("MemTotal() = %v, want %v", got, want)
+	}
+	if got, want := m.MemFree(), 2*pab.Megabyte; got != want {
+		t.Errorf("MemFree() = %v, want %v", got, want)
+	}
+	if got := m.MemAvailable(); got != 0 {
+		t.Errorf("MemAvailable() = %v, want 0 when missing", got)
+	}
+	if got := m.Counts["HugePages_Total"]; got != 3 {
+		t.Errorf("HugePages_Total = %d, want 3", got)
+	}
+}
+
+func TestParseBuddyinfo(t *testing.T) {
+	got, err := parseBuddyinfo(strings.NewReader(
+		"Node 0, zone      DMA      1      2\nNode 1, zone   Normal    5    4    3    2    1    0    0    0    0    0    7\n"))
+	if err != nil {
+		t.Fatalf("parseBuddyinfo: %v", err)
+	}
+	want := []BuddyinfoZone{
+		{Node: 0, Zone: "DMA", FreeByOrder: [BuddyinfoOrders]int64{1, 2}},
+		{Node: 1, Zone: "Normal", FreeByOrder: [BuddyinfoOrders]int64{5, 4, 3, 2, 1, 0, 0, 0, 0, 0, 7}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseMemoryMax(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want pab.ByteSize
+	}{
+		{in: "max\n", want: -1},
+		{in: "1073741824\n", want: pab.Gigabyte},
+	} {
+		got, err := parseMemoryMax(tc.in)
+		if err != nil || got != tc.want {
+			t.Errorf("parseMemoryMax(%q) = %v, %v; want %v", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+// Returns the affinity of every thread in the process.
+func threadAffinities(t *testing.T) map[int]CPUMask {
+	t.Helper()
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	masks := make(map[int]CPUMask)
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		mask, err := SchedGetaffinity(tid)
+		if errors.Is(err, syscall.ESRCH) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		masks[tid] = mask
+	}
+	return masks
+}
+
+func TestSetProcessAffinity(t *testing.T) {
+	orig, err := SchedGetaffinity(PIDCallingThread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Threads started during the test inherit the new affinity, so restore
+	// it everywhere rather than just for the threads that exist now.
+	t.Cleanup(func() { SetProcessAffinity(orig) })
+	mask := NewCPUMask(orig.CPUs()[0])
+
+	if err := SetProcessAffinity(mask); err != nil {
+		t.Fatalf("SetProcessAffinity: %v", err)
+	}
+	for tid, got := range threadAffinities(t) {
+		if got.String() != mask.String() {
+			t.Errorf("thread %d has affinity %q, want %q", tid, got, mask)
+		}
+	}
+}
+
+func TestCPUToNodeRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "topology.json")
+	want := map[int]int{0: 0, 1: 0, 4: 10, 130: 127}
+	if err := WriteCPUToNode(path, want); err != nil {
+		t.Fatalf("WriteCPUToNode: %v", err)
+	}
+	got, err := ReadCPUToNode(path)
+	if err != nil {
+		t.Fatalf("ReadCPUToNode: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if err := os.WriteFile(path, []byte("0-3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadCPUToNode(path); err == nil {
+		t.Errorf("ReadCPUToNode of garbage = %v, want error", got)
+	}
+	if _, err := ReadCPUToNode(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadCPUToNode of missing file returned %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestNewCPUMask(t *testing.T) {
+	for _, tc := range []struct {
+		cpus     []int
+		want     CPUMask
+		wantCPUs []int
+	}{
+		{cpus: nil, want: CPUMask{}},
+		{cpus: []int{0}, want: CPUMask{1}, wantCPUs: []int{0}},
+		{cpus: []int{5, 1}, want: CPUMask{1<<1 | 1<<5}, wantCPUs: []int{1, 5}},
+		{cpus: []int{63}, want: CPUMask{1 << 63}, wantCPUs: []int{63}},
+		{cpus: []int{64}, want: CPUMask{0, 1}, wantCPUs: []int{64}},
+		{cpus: []int{3, 130, 3}, want: CPUMask{1 << 3, 0, 1 << 2}, wantCPUs: []int{3, 130}},
+	} {
+		got := NewCPUMask(tc.cpus...)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("NewCPUMask(%v) = %#x, want %#x", tc.cpus, got, tc.want)
+		}
+		if !reflect.DeepEqual(got.CPUs(), tc.wantCPUs) {
+			t.Errorf("NewCPUMask(%v).CPUs() = %v, want %v", tc.cpus, got.CPUs(), tc.wantCPUs)
+		}
+	}
+}
+
+func TestCPUMaskStringRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		cpus []int
+		want string
+	}{
+		{cpus: nil, want: ""},
+		{cpus: []int{4}, want: "4"},
+		{cpus: []int{0, 1}, want: "0-1"},
+		{cpus: []int{0, 1, 2, 3, 7, 9, 10, 11}, want: "0-3,7,9-11"},
+		{cpus: []int{62, 63, 64, 65, 200}, want: "62-65,200"},
+	} {
+		mask := NewCPUMask(tc.cpus...)
+		got := mask.String()
+		if got != tc.want {
+			t.Errorf("NewCPUMask(%v).String() = %q, want %q", tc.cpus, got, tc.want)
+		}
+		parsed, err := CPUMaskFromString(got)
+		if err != nil {
+			t.Errorf("CPUMaskFromString(%q): %v", got, err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed.CPUs(), mask.CPUs()) {
+			t.Errorf("%q parsed back as CPUs %v, want %v", got, parsed.CPUs(), mask.CPUs())
+		}
+	}
+}
+
+func TestCPUMaskSetOps(t *testing.T) {
+	// Different lengths, to check missing words count as empty.
+	a := NewCPUMask(0, 1, 2, 70)
+	b := NewCPUMask(2, 3)
+	for _, tc := range []struct {
+		name string
+		got  CPUMask
+		want string
+	}{
+		{name: "a.Union(b)", got: a.Union(b), want: "0-3,70"},
+		{name: "b.Union(a)", got: b.Union(a), want: "0-3,70"},
+		{name: "a.Intersect(b)", got: a.Intersect(b), want: "2"},
+		{name: "b.Intersect(a)", got: b.Intersect(a), want: "2"},
+		{name: "a.Difference(b)", got: a.Difference(b), want: "0-1,70"},
+		{name: "b.Difference(a)", got: b.Difference(a), want: "3"},
+		{name: "a.Difference(a)", got: a.Difference(a), want: ""},
+	} {
+		if tc.got.String() != tc.want {
+			t.Errorf("%s = %q, want %q", tc.name, tc.got, tc.want)
+		}
+	}
+	// The operands are left alone.
+	if a.String() != "0-2,70" || b.String() != "2-3" {
+		t.Errorf("operands changed to %q and %q", a, b)
+	}
+
+	for _, tc := range []struct {
+		cpu  int
+		want bool
+	}{{cpu: 0, want: true}, {cpu: 3, want: false}, {cpu: 70, want: true}, {cpu: 1000, want: false}, {cpu: -1, want: false}} {
+		if got := a.Contains(tc.cpu); got != tc.want {
+			t.Errorf("Contains(%d) = %v, want %v", tc.cpu, got, tc.want)
+		}
+	}
+	if got := a.Count(); got != 4 {
+		t.Errorf("Count() = %d, want 4", got)
+	}
+}
+
+func TestSchedGetaffinity(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := SchedGetaffinity(PIDCallingThread)
+	if err != nil {
+		t.Fatalf("SchedGetaffinity: %v", err)
+	}
+	if orig.Count() == 0 {
+		t.Fatalf("SchedGetaffinity returned an empty mask")
+	}
+	// Trailing empty words are trimmed.
+	if orig[len(orig)-1] == 0 {
+		t.Errorf("SchedGetaffinity returned %#x, want no trailing zero words", orig)
+	}
+	defer SchedSetaffinity(PIDCallingThread, orig)
+
+	cpus := orig.CPUs()
+	want := NewCPUMask(cpus[len(cpus)-1])
+	if err := SchedSetaffinity(PIDCallingThread, want); err != nil {
+		t.Fatalf("SchedSetaffinity: %v", err)
+	}
+	got, err := SchedGetaffinity(PIDCallingThread)
+	if err != nil {
+		t.Fatalf("SchedGetaffinity: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after setting affinity to %q, got %q", want, got)
+	}
+	if _, err := SchedGetaffinity(-1); !errors.Is(err, syscall.ESRCH) && !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("SchedGetaffinity(-1) returned %v, want an error", err)
+	}
+}
+
+func TestGetCPU(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := SchedGetaffinity(PIDCallingThread)
+	if err != nil {
+		t.Fatalf("SchedGetaffinity: %v", err)
+	}
+	defer SchedSetaffinity(PIDCallingThread, orig)
+	cpuToNode, err := CPUToNode()
+	if err != nil {
+		t.Logf("Not checking NUMA nodes: %v", err)
+	}
+
+	// Try the first and last CPU, so that on a big machine it's not just
+	// CPU 0 that's checked.
+	cpus := orig.CPUs()
+	for _, want := range []int{cpus[0], cpus[len(cpus)-1]} {
+		if err := SchedSetaffinity(PIDCallingThread, NewCPUMask(want)); err != nil {
+			t.Fatalf("SchedSetaffinity: %v", err)
+		}
+		cpu, node, err := GetCPU()
+		if err != nil {
+			t.Fatalf("GetCPU: %v", err)
+		}
+		if cpu != want {
+			t.Errorf("GetCPU while pinned to CPU %d returned CPU %d", want, cpu)
+		}
+		if wantNode, ok := cpuToNode[want]; ok && node != wantNode {
+			t.Errorf("GetCPU on CPU %d returned node %d, want %d", want, node, wantNode)
+		}
+	}
+}
+
+func TestNodeSubdirRegexp(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want string // Node ID, empty for no match.
+	}{
+		{name: "node0", want: "0"},
+		{name: "node9", want: "9"},
+		{name: "node10", want: "10"},
+		{name: "node1023", want: "1023"},
+		{name: "node", want: ""},
+		{name: "node1a", want: ""},
+		{name: "xnode1", want: ""},
+		{name: "has_cpu", want: ""},
+	} {
+		got := ""
+		if m := nodeSubdirRegexp.FindStringSubmatch(tc.name); m != nil {
+			got = m[1]
+		}
+		if got != tc.want {
+			t.Errorf("%q matched node %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// Skips the test if the mempolicy syscalls aren't available, e.g. in a
+// sandbox or on a kernel without CONFIG_NUMA.
+func skipIfNoMempolicy(t *testing.T, err error) {
+	t.Helper()
+	if errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EPERM) {
+		t.Skipf("mempolicy syscalls unavailable: %v", err)
+	}
+}
+
+func TestMempolicy(t *testing.T) {
+	nodes, err := NUMANodes()
+	if err != nil || len(nodes) == 0 {
+		t.Skipf("no NUMA nodes in sysfs: %v", err)
+	}
+	nid := -1
+	for n := range nodes {
+		if nid < 0 || n < nid {
+			nid = n
+		}
+	}
+	mask := NewCPUMask(nid)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	err = SetMempolicy(MPOL_BIND, mask)
+	skipIfNoMempolicy(t, err)
+	if err != nil {
+		t.Fatalf("SetMempolicy(MPOL_BIND, %v): %v", mask, err)
+	}
+	if err := SetMempolicy(MPOL_DEFAULT, nil); err != nil {
+		t.Fatalf("SetMempolicy(MPOL_DEFAULT): %v", err)
+	}
+	if err := SetMempolicy(MPOL_BIND, nil); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("SetMempolicy(MPOL_BIND) with no nodes returned %v, want EINVAL", err)
+	}
+
+	size := os.Getpagesize()
+	data, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Munmap(data)
+	addr := uintptr(unsafe.Pointer(unsafe.SliceData(data)))
+	if err := Mbind(addr, size, MPOL_BIND, mask, MPOL_MF_STRICT); err != nil {
+		t.Fatalf("Mbind(MPOL_BIND, %v): %v", mask, err)
+	}
+	data[0] = 1 // Fault it in on the node.
+	if err := Mbind(addr+1, size, MPOL_BIND, mask, 0); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Mbind of an unaligned address returned %v, want EINVAL", err)
+	}
+}
+
+func TestMadvise(t *testing.T) {
+	size := 4 * os.Getpagesize()
+	data, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Munmap(data)
+	for i := range data {
+		data[i] = 0xa5
+	}
+
+	// Dropping the middle pages zeroes them, and only them.
+	pageSize := os.Getpagesize()
+	if err := Madvise(data[pageSize:3*pageSize], MADV_DONTNEED); err != nil {
+		t.Fatalf("Madvise(MADV_DONTNEED): %v", err)
+	}
+	for i, b := range data {
+		want := byte(0xa5)
+		if i >= pageSize && i < 3*pageSize {
+			want = 0
+		}
+		if b != want {
+			t.Fatalf("byte %d is %#x after MADV_DONTNEED, want %#x", i, b, want)
+		}
+	}
+
+	if err := Madvise(data[1:], MADV_DONTNEED); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Madvise of an unaligned range returned %v, want EINVAL", err)
+	}
+}
+
+func TestParseVmstat(t *testing.T) {
+	got, err := parseVmstat(strings.NewReader("nr_free_pages 123456\ncompact_stall 7\n\npgalloc_normal 0\n"))
+	if err != nil {
+		t.Fatalf("parseVmstat: %v", err)
+	}
+	want := map[string]int64{"nr_free_pages": 123456, "compact_stall": 7, "pgalloc_normal": 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, in := range []string{"compact_stall\n", "compact_stall 7 8\n", "compact_stall seven\n"} {
+		if got, err := parseVmstat(strings.NewReader(in)); err == nil {
+			t.Errorf("parseVmstat(%q) = %v, want error", in, got)
+		}
+	}
+}
+
+func TestParseTHPMode(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "always [madvise] never\n", want: "madvise"},
+		{in: "[always] madvise never\n", want: "always"},
+		{in: "always madvise [never]", want: "never"},
+		{in: "always madvise never\n", wantErr: true},
+		{in: "always [] never\n", wantErr: true},
+		{in: "always [madvise never\n", wantErr: true},
+		{in: "", wantErr: true},
+	} {
+		got, err := parseTHPMode(strings.NewReader(tc.in))
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseTHPMode(%q) = %q, want error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("parseTHPMode(%q) = %q, %v, want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestTHPModeFiles(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	if got, err := thpModeFrom(missing); !errors.Is(err, ErrNoTHP) {
+		t.Errorf("thpModeFrom(missing file) = %q, %v, want ErrNoTHP", got, err)
+	}
+	if err := setTHPModeAt(missing, "never"); !errors.Is(err, ErrNoTHP) {
+		t.Errorf("setTHPModeAt(missing file) = %v, want ErrNoTHP", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "enabled")
+	if err := os.WriteFile(path, []byte("always [madvise] never\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := thpModeFrom(path); err != nil || got != "madvise" {
+		t.Errorf("thpModeFrom = %q, %v, want madvise", got, err)
+	}
+	for _, mode := range []string{"", "Never", "[never]", "defer"} {
+		if err := setTHPModeAt(path, mode); err == nil {
+			t.Errorf("setTHPModeAt(%q) succeeded, want error", mode)
+		}
+	}
+	// The kernel takes just the mode.
+	if err := setTHPModeAt(path, "never"); err != nil {
+		t.Fatalf("setTHPModeAt(never): %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "never" {
+		t.Errorf("after setTHPModeAt(never) the file has %q, %v, want \"never\"", data, err)
+	}
+}
+
+func TestCompactNode(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "node1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	trigger := filepath.Join(dir, "node1", "compact")
+	if err := os.WriteFile(trigger, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := compactNodeIn(dir, 1); err != nil {
+		t.Fatalf("compactNodeIn(1): %v", err)
+	}
+	if data, err := os.ReadFile(trigger); err != nil || string(data) != "1" {
+		t.Errorf("after compacting the trigger file has %q, %v, want \"1\"", data, err)
+	}
+
+	// Without CONFIG_COMPACTION the file isn't there.
+	err := compactNodeIn(dir, 0)
+	if err == nil || !strings.Contains(err.Error(), "CONFIG_COMPACTION") {
+		t.Errorf("compactNodeIn(missing node) = %v, want error about CONFIG_COMPACTION", err)
+	}
+	err = writeCompactTrigger(filepath.Join(dir, "compact_memory"))
+	if err == nil || !strings.Contains(err.Error(), "is CONFIG_COMPACTION disabled?") {
+		t.Errorf("writeCompactTrigger(missing file) = %v, want error about CONFIG_COMPACTION", err)
+	}
+}
+
+func TestDropCaches(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "drop_caches")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []int{-1, 0, 4} {
+		if err := dropCachesAt(path, mode); err == nil {
+			t.Errorf("dropCachesAt(mode=%d) succeeded, want error", mode)
+		}
+	}
+	if data, err := os.ReadFile(path); err != nil || len(data) != 0 {
+		t.Errorf("invalid modes wrote %q, %v, want nothing written", data, err)
+	}
+	if err := dropCachesAt(path, DropAll); err != nil {
+		t.Fatalf("dropCachesAt(DropAll): %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "3" {
+		t.Errorf("after dropping caches the file has %q, %v, want \"3\"", data, err)
+	}
+
+	// Underlying errors are wrapped.
+	if err := dropCachesAt(dir, DropAll); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("dropCachesAt(directory) = %v, want EISDIR", err)
+	}
+	t.Run("read-only", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("root can write to read-only files")
+		}
+		if err := os.Chmod(path, 0444); err != nil {
+			t.Fatal(err)
+		}
+		if err := dropCachesAt(path, DropAll); !errors.Is(err, os.ErrPermission) {
+			t.Errorf("dropCachesAt(read-only file) = %v, want os.ErrPermission", err)
+		}
+	})
+}
@@ -0,0 +1,412 @@
+// Copyright 2024 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+
+// This file has the alternative output formats. The main one is JSON, see
+// writeOutput.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/page_alloc_bench/pab"
+	"github.com/google/page_alloc_bench/workload/kallocfree"
+)
+
+var orderSuffixRegexp = regexp.MustCompile(`^(.+)_order([0-9]+)$`)
+
+// Splits a result key like "kernel_page_allocs_order4" into the metric name and
+// the order. If the key has no order suffix, returns the whole key and ok=false.
+func splitMetricKey(key string) (metric string, order int, ok bool) {
+	m := orderSuffixRegexp.FindStringSubmatch(key)
+	if m == nil {
+		return key, 0, false
+	}
+	order, err := strconv.Atoi(m[2])
+	if err != nil { // Too big for an int, can't really be an order.
+		return key, 0, false
+	}
+	return m[1], order, true
+}
+
+var nodeSuffixRegexp = regexp.MustCompile(`^(.+)_node([0-9]+)$`)
+
+// Like splitMetricKey but for the "_node<N>" suffix of per-NUMA-node metrics.
+// This comes before the order suffix so split that off first.
+func splitNodeSuffix(metric string) (string, int, bool) {
+	m := nodeSuffixRegexp.FindStringSubmatch(metric)
+	if m == nil {
+		return metric, 0, false
+	}
+	node, err := strconv.Atoi(m[2])
+	if err != nil {
+		return metric, 0, false
+	}
+	return m[1], node, true
+}
+
+var instanceSuffixRegexp = regexp.MustCompile(`^(.+)_instance([0-9]+)$`)
+
+// Like splitNodeSuffix but for the "_instance<N>" suffix of results from one of
+// several kernel module instances (see --kmod-devices). This comes before the
+// order or profile suffix, and after the node suffix.
+func splitInstanceSuffix(metric string) (string, int, bool) {
+	m := instanceSuffixRegexp.FindStringSubmatch(metric)
+	if m == nil {
+		return metric, 0, false
+	}
+	instance, err := strconv.Atoi(m[2])
+	if err != nil {
+		return metric, 0, false
+	}
+	return m[1], instance, true
+}
+
+// Splits off the "_<profile>" suffix of results from a --profile run, which
+// takes the place of the order suffix.
+func splitProfileSuffix(metric string) (string, string, bool) {
+	for profile := range kallocfree.Profiles {
+		if base, ok := strings.CutSuffix(metric, "_"+profile); ok && base != "" {
+			return base, profile, true
+		}
+	}
+	return metric, "", false
+}
+
+// Prometheus metric names have a prefix so they're identifiable when scraped
+// alongside other stuff.
+const prometheusPrefix = "pab_"
+
+// Writes the result in the Prometheus text exposition format. Instead of
+// baking the order into the metric name, it's an "order" label. Same for the
+// NUMA node of per-node metrics, which gets a "node" label, the kernel module
+// instance with several devices ("instance") and the --profile ("profile").
+// Multi-valued metrics are exported as summaries.
+func writePrometheus(path string, result map[string][]int64) error {
+	type series struct {
+		order       int
+		hasOrder    bool
+		node        int
+		hasNode     bool
+		instance    int
+		hasInstance bool
+		profile     string // Empty if none.
+		vals        []int64
+	}
+	byMetric := make(map[string][]series)
+	for key, vals := range result {
+		metric, order, hasOrder := splitMetricKey(key)
+		profile := ""
+		if !hasOrder {
+			metric, profile, _ = splitProfileSuffix(metric)
+		}
+		metric, instance, hasInstance := splitInstanceSuffix(metric)
+		metric, node, hasNode := splitNodeSuffix(metric)
+		byMetric[metric] = append(byMetric[metric], series{
+			order: order, hasOrder: hasOrder, node: node, hasNode: hasNode,
+			instance: instance, hasInstance: hasInstance, profile: profile, vals: vals,
+		})
+	}
+	var metrics []string
+	for metric := range byMetric {
+		metrics = append(metrics, metric)
+	}
+	slices.Sort(metrics)
+
+	var buf bytes.Buffer
+	for _, metric := range metrics {
+		name := prometheusPrefix + metric
+		ss := byMetric[metric]
+		slices.SortFunc(ss, func(s1, s2 series) int {
+			if s1.hasInstance != s2.hasInstance {
+				if s2.hasInstance {
+					return -1
+				}
+				return 1
+			}
+			if s1.instance != s2.instance {
+				return s1.instance - s2.instance
+			}
+			if c := strings.Compare(s1.profile, s2.profile); c != 0 {
+				return c
+			}
+			if s1.order != s2.order {
+				return s1.order - s2.order
+			}
+			return s1.node - s2.node
+		})
+		typ := "gauge"
+		for _, s := range ss {
+			if len(s.vals) > 1 {
+				typ = "summary"
+			}
+		}
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, typ)
+		for _, s := range ss {
+			var labelList []string
+			if s.hasInstance {
+				labelList = append(labelList, fmt.Sprintf(`instance="%d"`, s.instance))
+			}
+			if s.profile != "" {
+				labelList = append(labelList, fmt.Sprintf(`profile="%s"`, s.profile))
+			}
+			if s.hasOrder {
+				labelList = append(labelList, fmt.Sprintf(`order="%d"`, s.order))
+			}
+			if s.hasNode {
+				labelList = append(labelList, fmt.Sprintf(`node="%d"`, s.node))
+			}
+			labels := strings.Join(labelList, ",")
+			withLabels := func(extra string) string {
+				if labels == "" && extra == "" {
+					return ""
+				}
+				if labels == "" || extra == "" {
+					return "{" + labels + extra + "}"
+				}
+				return "{" + labels + "," + extra + "}"
+			}
+			if len(s.vals) == 0 {
+				continue
+			}
+			if typ == "gauge" {
+				fmt.Fprintf(&buf, "%s%s %d\n", name, withLabels(""), s.vals[0])
+				continue
+			}
+			sum := summarize(s.vals)
+			fmt.Fprintf(&buf, "%s%s %d\n", name, withLabels(`quantile="0.5"`), sum.median)
+			fmt.Fprintf(&buf, "%s%s %d\n", name, withLabels(`quantile="0.95"`), sum.p95)
+			fmt.Fprintf(&buf, "%s_sum%s %d\n", name, withLabels(""), sum.sum)
+			fmt.Fprintf(&buf, "%s_count%s %d\n", name, withLabels(""), sum.samples)
+		}
+	}
+	fmt.Printf("Writing %d metrics in Prometheus format to %s\n", len(metrics), path)
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// Writes the result as CSV with a metric,order,value header, for
+// --output-format=csv. There's one row per value, so multi-valued metrics get
+// several rows. The order column is empty for metrics without an order suffix.
+func writeCSV(path string, result map[string][]int64) error {
+	type row struct {
+		metric   string
+		order    int
+		hasOrder bool
+		vals     []int64
+	}
+	var rows []row
+	for key, vals := range result {
+		metric, order, hasOrder := splitMetricKey(key)
+		rows = append(rows, row{metric: metric, order: order, hasOrder: hasOrder, vals: vals})
+	}
+	slices.SortFunc(rows, func(r1, r2 row) int {
+		if c := strings.Compare(r1.metric, r2.metric); c != 0 {
+			return c
+		}
+		return r1.order - r2.order
+	})
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"metric", "order", "value"})
+	for _, r := range rows {
+		order := ""
+		if r.hasOrder {
+			order = strconv.Itoa(r.order)
+		}
+		for _, val := range r.vals {
+			w.Write([]string{r.metric, order, strconv.FormatInt(val, 10)})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("writing CSV: %v", err)
+	}
+	fmt.Printf("Writing %v CSV result to %s\n", pab.ByteSize(buf.Len()), path)
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// Returns the unit for a metric in Go benchmark format.
+func goBenchUnit(metric string) string {
+	switch {
+	// Not just latencies, also totals like kernel_alloc_backoff_ns.
+	case isLatencyMetric(metric), strings.HasSuffix(metric, "_ns"):
+		return "ns/op"
+	case strings.HasSuffix(metric, "_bytes"):
+		return "bytes"
+	}
+	return "count"
+}
+
+// Returns the benchmark name for a metric in --output-format=gobench. The
+// kernel allocation latencies are the headline result, so they're
+// "BenchmarkKallocFree/order<n>". Other metrics keep their name, e.g.
+// "Benchmarkidle_available_bytes", which benchstat shows without the
+// "Benchmark" prefix. Either way the order, if any, is a sub-benchmark.
+func goBenchName(metric string, order int, hasOrder bool) string {
+	name := "Benchmark" + metric
+	if metric == kernelPageAllocLatenciesNSPrefix {
+		name = "BenchmarkKallocFree"
+	}
+	if hasOrder {
+		name += fmt.Sprintf("/order%d", order)
+	}
+	return name
+}
+
+// Writes the result in the Go benchmark format, for --output-format=gobench,
+// so that runs can be compared with benchstat. See goBenchName for the names,
+// e.g. "BenchmarkKallocFree/order4 1 2345 ns/op". Multi-valued metrics get one
+// line per value, so benchstat sees the distribution.
+func writeGoBench(path string, result map[string][]int64) error {
+	var keys []string
+	for key := range result {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	slices.SortStableFunc(keys, func(k1, k2 string) int {
+		m1, o1, _ := splitMetricKey(k1)
+		m2, o2, _ := splitMetricKey(k2)
+		if c := strings.Compare(m1, m2); c != 0 {
+			return c
+		}
+		return o1 - o2
+	})
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "pab-version: %s\n", version())
+	for _, key := range keys {
+		metric, order, hasOrder := splitMetricKey(key)
+		name := goBenchName(metric, order, hasOrder)
+		unit := goBenchUnit(metric)
+		for _, val := range result[key] {
+			fmt.Fprintf(&buf, "%s 1 %d %s\n", name, val, unit)
+		}
+	}
+	fmt.Printf("Writing %v Go benchmark format result to %s\n", pab.ByteSize(buf.Len()), path)
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// Appends results to the --stream-output file as newline-delimited JSON, as
+// they come in. A nil *resultStream discards them.
+type resultStream struct {
+	file *os.File
+}
+
+// One line of the --stream-output file.
+type streamedMetric struct {
+	Metric string  `json:"metric"`
+	Order  *int    `json:"order,omitempty"`
+	Values []int64 `json:"values"`
+}
+
+func openResultStream(path string) (*resultStream, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &resultStream{file: f}, nil
+}
+
+// Writes a line for each metric in the result. The keys should be full metric
+// names except for the order suffix, order is nil if there isn't one. Each
+// line goes straight to the file so nothing's lost if the process dies.
+func (s *resultStream) write(result map[string][]int64, order *int) error {
+	if s == nil {
+		return nil
+	}
+	var keys []string
+	for key := range result {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		line, err := json.Marshal(&streamedMetric{Metric: key, Order: order, Values: result[key]})
+		if err != nil {
+			return fmt.Errorf("marshalling %s for --stream-output: %v", key, err)
+		}
+		if _, err := s.file.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("writing --stream-output: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *resultStream) close() error {
+	if s == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// Stack counts for --folded-latency-output, accumulated across runs.
+var foldedLatencies = make(map[string]int64)
+
+// Returns a frame name for the power-of-two latency bucket d falls into,
+// identified by its (inclusive) upper bound.
+func latencyBucket(d time.Duration) string {
+	bound := time.Duration(1)
+	for bound < d {
+		bound *= 2
+	}
+	return "<=" + bound.String()
+}
+
+// Bucket bounds for --latency-histogram: powers of two from 64ns to about 0.5s,
+// the same buckets as latencyBucket but with the tails lumped together.
+func latencyHistogramBounds() []time.Duration {
+	var bounds []time.Duration
+	for bound := 64 * time.Nanosecond; bound <= time.Second; bound *= 2 {
+		bounds = append(bounds, bound)
+	}
+	return bounds
+}
+
+// Adds allocation samples to foldedLatencies, with stacks like
+// "node0;cpu3;order2;<=1.024µs". If prefix is non-empty it's the root frame.
+func addFoldedLatencies(prefix string, samples []kallocfree.AllocSample) {
+	for _, s := range samples {
+		stack := fmt.Sprintf("node%d;cpu%d;order%d;%s", s.Node, s.CPU, s.Order, latencyBucket(s.Latency))
+		if prefix != "" {
+			stack = prefix + ";" + stack
+		}
+		foldedLatencies[stack]++
+	}
+}
+
+// Writes foldedLatencies in the "folded" format used by flamegraph tools, one
+// stack per line followed by its sample count.
+func writeFoldedLatencies(path string) error {
+	var stacks []string
+	for stack := range foldedLatencies {
+		stacks = append(stacks, stack)
+	}
+	slices.Sort(stacks)
+	var buf bytes.Buffer
+	for _, stack := range stacks {
+		fmt.Fprintf(&buf, "%s %d\n", stack, foldedLatencies[stack])
+	}
+	fmt.Printf("Writing %d folded latency stacks to %s\n", len(stacks), path)
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
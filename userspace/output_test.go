@@ -0,0 +1,590 @@
+// Copyright 2024 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"golang.org/x/perf/benchfmt"
+
+	"github.com/google/page_alloc_bench/workload/kallocfree"
+)
+
+var updateGolden = flag.Bool("update", false, "Rewrite the golden files in testdata")
+
+// Covers metrics with and without orders, per-node metrics, and multi-valued
+// metrics. The orders include 10 so that sorting numerically and sorting as
+// strings differ.
+var testResult = map[string][]int64{
+	"idle_available_bytes":                  {300, 100, 200},
+	"kernel_page_allocs_order10":            {7},
+	"kernel_page_allocs_order2":             {5},
+	"kernel_page_allocs_node1_order0":       {3},
+	"kernel_page_alloc_latencies_ns_order0": {1500, 1000, 2000},
+	"teardown_mem_available_delta_bytes":    {-4096},
+}
+
+// Compares got with the golden file testdata/name, or rewrites it with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s (rerun with -update if that's intended), got:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func parsePrometheus(t *testing.T, data []byte) map[string]*dto.MetricFamily {
+	t.Helper()
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("parsing Prometheus output: %v\n%s", err, data)
+	}
+	return families
+}
+
+func labelsOf(m *dto.Metric) map[string]string {
+	labels := make(map[string]string)
+	for _, l := range m.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	return labels
+}
+
+func TestWritePrometheus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "result.prom")
+	if err := writePrometheus(path, testResult); err != nil {
+		t.Fatalf("writePrometheus: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "result.prom", data)
+	families := parsePrometheus(t, data)
+
+	allocs := families["pab_kernel_page_allocs"]
+	if allocs.GetType() != dto.MetricType_GAUGE {
+		t.Fatalf("pab_kernel_page_allocs has type %v, want gauge", allocs.GetType())
+	}
+	type gauge struct {
+		order, node string
+		value       float64
+	}
+	var gotAllocs []gauge
+	for _, m := range allocs.GetMetric() {
+		l := labelsOf(m)
+		gotAllocs = append(gotAllocs, gauge{l["order"], l["node"], m.GetGauge().GetValue()})
+	}
+	wantAllocs := []gauge{{"0", "1", 3}, {"2", "", 5}, {"10", "", 7}}
+	if !slices.Equal(gotAllocs, wantAllocs) {
+		t.Errorf("pab_kernel_page_allocs: got %+v, want %+v", gotAllocs, wantAllocs)
+	}
+
+	latencies := families["pab_kernel_page_alloc_latencies_ns"]
+	if latencies.GetType() != dto.MetricType_SUMMARY || len(latencies.GetMetric()) != 1 {
+		t.Fatalf("got pab_kernel_page_alloc_latencies_ns %v, want one summary", latencies)
+	}
+	m := latencies.GetMetric()[0]
+	if got := labelsOf(m)["order"]; got != "0" {
+		t.Errorf("latency summary has order %q, want 0", got)
+	}
+	s := m.GetSummary()
+	if s.GetSampleCount() != 3 || s.GetSampleSum() != 4500 {
+		t.Errorf("latency summary has count %d and sum %v, want 3 and 4500", s.GetSampleCount(), s.GetSampleSum())
+	}
+	wantQuantiles := map[float64]float64{0.5: 1500, 0.95: 2000}
+	if len(s.GetQuantile()) != len(wantQuantiles) {
+		t.Errorf("got quantiles %v, want %v", s.GetQuantile(), wantQuantiles)
+	}
+	for _, q := range s.GetQuantile() {
+		if want, ok := wantQuantiles[q.GetQuantile()]; !ok || q.GetValue() != want {
+			t.Errorf("quantile %v is %v, want %v", q.GetQuantile(), q.GetValue(), want)
+		}
+	}
+
+	delta := families["pab_teardown_mem_available_delta_bytes"]
+	if delta.GetType() != dto.MetricType_GAUGE || len(delta.GetMetric()) != 1 ||
+		len(delta.GetMetric()[0].GetLabel()) != 0 || delta.GetMetric()[0].GetGauge().GetValue() != -4096 {
+		t.Errorf("got pab_teardown_mem_available_delta_bytes %v, want one unlabelled gauge of -4096", delta)
+	}
+}
+
+func TestWritePrometheusInstancesAndProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "result.prom")
+	result := map[string][]int64{
+		"kernel_page_allocs_instance0_order2":             {5},
+		"kernel_page_allocs_instance1_order2":             {6},
+		"kernel_page_allocs_node1_instance1_networking":   {7},
+		"kernel_page_allocs_filesystem":                   {8},
+		"kernel_page_alloc_latencies_ns_instance0_order0": {1000, 2000},
+	}
+	if err := writePrometheus(path, result); err != nil {
+		t.Fatalf("writePrometheus: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := parsePrometheus(t, data)
+	if len(families) != 2 {
+		t.Errorf("got %d metrics, want just allocs and latencies:\n%s", len(families), data)
+	}
+
+	type gauge struct {
+		instance, profile, order, node string
+		value                          float64
+	}
+	var got []gauge
+	for _, m := range families["pab_kernel_page_allocs"].GetMetric() {
+		l := labelsOf(m)
+		got = append(got, gauge{l["instance"], l["profile"], l["order"], l["node"], m.GetGauge().GetValue()})
+	}
+	want := []gauge{
+		{"", "filesystem", "", "", 8},
+		{"0", "", "2", "", 5},
+		{"1", "", "2", "", 6},
+		{"1", "networking", "", "1", 7},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("pab_kernel_page_allocs: got %+v, want %+v", got, want)
+	}
+	for _, m := range families["pab_kernel_page_alloc_latencies_ns"].GetMetric() {
+		if l := labelsOf(m); l["instance"] != "0" || l["order"] != "0" {
+			t.Errorf("got latency summary labels %v, want instance 0 and order 0", l)
+		}
+	}
+}
+
+// Stands in for a running kallocfree.Workload.
+type fakeLiveWorkload struct {
+	counters kallocfree.Counters
+	bounds   []time.Duration
+	buckets  []uint64
+	sum      time.Duration
+}
+
+func (f *fakeLiveWorkload) Counters() kallocfree.Counters { return f.counters }
+
+func (f *fakeLiveWorkload) AllocLatencyHistogram() ([]time.Duration, []uint64, time.Duration) {
+	return f.bounds, f.buckets, f.sum
+}
+
+func TestSplitMetricKey(t *testing.T) {
+	for _, tc := range []struct {
+		key, metric, node string
+		order             int
+		hasOrder          bool
+	}{
+		{key: "kernel_page_allocs_order4", metric: "kernel_page_allocs", order: 4, hasOrder: true},
+		{key: "kernel_page_allocs_node1_order10", metric: "kernel_page_allocs", node: "1", order: 10, hasOrder: true},
+		{key: "idle_available_bytes", metric: "idle_available_bytes"},
+		{key: "kernel_page_allocs_of_order2_order0", metric: "kernel_page_allocs_of_order2", hasOrder: true},
+		{key: "_order1", metric: "_order1"},
+		{key: "kernel_page_allocs_order99999999999999999999", metric: "kernel_page_allocs_order99999999999999999999"},
+	} {
+		metric, order, hasOrder := splitMetricKey(tc.key)
+		metric, node, hasNode := splitNodeSuffix(metric)
+		gotNode := ""
+		if hasNode {
+			gotNode = fmt.Sprint(node)
+		}
+		if metric != tc.metric || gotNode != tc.node || order != tc.order || hasOrder != tc.hasOrder {
+			t.Errorf("splitting %q got metric %q node %q order %d (%v), want %q node %q order %d (%v)",
+				tc.key, metric, gotNode, order, hasOrder, tc.metric, tc.node, tc.order, tc.hasOrder)
+		}
+	}
+}
+
+func TestLiveMetrics(t *testing.T) {
+	t.Cleanup(func() {
+		live.setWorkload(nil)
+		live.setFindlimitPhase("")
+	})
+	live.setWorkload(&fakeLiveWorkload{
+		counters: kallocfree.Counters{PagesAllocated: 10, PagesFreed: 4, AllocFailures: 2, RemoteAllocs: 1},
+		bounds:   []time.Duration{time.Microsecond, 10 * time.Microsecond},
+		buckets:  []uint64{3, 2, 1},
+		sum:      50 * time.Microsecond,
+	})
+	live.setFindlimitPhase("antagonized")
+	live.findlimitAllocated.Store(8192)
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	families := parsePrometheus(t, rec.Body.Bytes())
+
+	for _, tc := range []struct {
+		name string
+		typ  dto.MetricType
+		want float64
+	}{
+		{name: "pab_pages_allocated_total", typ: dto.MetricType_COUNTER, want: 10},
+		{name: "pab_pages_freed_total", typ: dto.MetricType_COUNTER, want: 4},
+		{name: "pab_alloc_failures_total", typ: dto.MetricType_COUNTER, want: 2},
+		{name: "pab_numa_remote_allocations_total", typ: dto.MetricType_COUNTER, want: 1},
+		{name: "pab_pages_in_flight", typ: dto.MetricType_GAUGE, want: 6},
+	} {
+		f := families[tc.name]
+		if f.GetType() != tc.typ || len(f.GetMetric()) != 1 {
+			t.Errorf("got %s %v, want a single %v", tc.name, f, tc.typ)
+			continue
+		}
+		m := f.GetMetric()[0]
+		got := m.GetGauge().GetValue()
+		if tc.typ == dto.MetricType_COUNTER {
+			got = m.GetCounter().GetValue()
+		}
+		if got != tc.want {
+			t.Errorf("%s is %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	hist := families["pab_alloc_latency_seconds"]
+	if hist.GetType() != dto.MetricType_HISTOGRAM || len(hist.GetMetric()) != 1 {
+		t.Fatalf("got pab_alloc_latency_seconds %v, want one histogram", hist)
+	}
+	h := hist.GetMetric()[0].GetHistogram()
+	if h.GetSampleCount() != 6 || math.Abs(h.GetSampleSum()-50e-6) > 1e-12 {
+		t.Errorf("histogram has count %d and sum %v, want 6 and 50e-6", h.GetSampleCount(), h.GetSampleSum())
+	}
+	type bucket struct {
+		le    float64
+		count uint64
+	}
+	var gotBuckets []bucket
+	for _, b := range h.GetBucket() {
+		gotBuckets = append(gotBuckets, bucket{b.GetUpperBound(), b.GetCumulativeCount()})
+	}
+	wantBuckets := []bucket{{1e-6, 3}, {10e-6, 5}, {math.Inf(1), 6}}
+	if !slices.Equal(gotBuckets, wantBuckets) {
+		t.Errorf("got histogram buckets %v, want %v", gotBuckets, wantBuckets)
+	}
+
+	fl := families["pab_findlimit_allocated_bytes"]
+	if fl.GetType() != dto.MetricType_GAUGE || len(fl.GetMetric()) != 1 {
+		t.Fatalf("got pab_findlimit_allocated_bytes %v, want one gauge", fl)
+	}
+	if m := fl.GetMetric()[0]; labelsOf(m)["phase"] != "antagonized" || m.GetGauge().GetValue() != 8192 {
+		t.Errorf("got pab_findlimit_allocated_bytes %v, want 8192 in phase antagonized", m)
+	}
+
+	// Between runs there's nothing to report.
+	live.setWorkload(nil)
+	live.setFindlimitPhase("")
+	var buf bytes.Buffer
+	live.writePrometheus(&buf)
+	if buf.Len() != 0 {
+		t.Errorf("got metrics between runs:\n%s", buf.String())
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "result.csv")
+	if err := writeCSV(path, testResult); err != nil {
+		t.Fatalf("writeCSV: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "result.csv", data)
+}
+
+func TestWriteGoBench(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "result.txt")
+	if err := writeGoBench(path, testResult); err != nil {
+		t.Fatalf("writeGoBench: %v", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var got []string
+	r := benchfmt.NewReader(f, path)
+	for r.Scan() {
+		res, ok := r.Result().(*benchfmt.Result)
+		if !ok {
+			t.Errorf("unexpected record %v", r.Result())
+			continue
+		}
+		if got, want := string(res.GetConfig("pab-version")), version(); got != want {
+			t.Errorf("got pab-version %q, want %q", got, want)
+		}
+		for _, v := range res.Values {
+			// The reader normalizes ns/op to sec/op, compare what was written.
+			val, unit := v.Value, v.Unit
+			if v.OrigUnit != "" {
+				val, unit = v.OrigValue, v.OrigUnit
+			}
+			got = append(got, fmt.Sprintf("%s %v %s", res.Name.Full(), val, unit))
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("reading back: %v", err)
+	}
+	want := []string{
+		"idle_available_bytes 300 bytes",
+		"idle_available_bytes 100 bytes",
+		"idle_available_bytes 200 bytes",
+		"KallocFree/order0 1500 ns/op",
+		"KallocFree/order0 1000 ns/op",
+		"KallocFree/order0 2000 ns/op",
+		"kernel_page_allocs/order2 5 count",
+		"kernel_page_allocs/order10 7 count",
+		"kernel_page_allocs_node1/order0 3 count",
+		"teardown_mem_available_delta_bytes -4096 bytes",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("read back:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestGoBenchUnit(t *testing.T) {
+	for _, tc := range []struct {
+		metric, want string
+	}{
+		{metric: kernelPageAllocLatenciesNSPrefix, want: "ns/op"},
+		{metric: idleTimeToOOMNSPrefix, want: "ns/op"},
+		{metric: kernelAllocBackoffNSPrefix, want: "ns/op"},
+		{metric: "idle_available_bytes", want: "bytes"},
+		{metric: "kernel_page_allocs", want: "count"},
+	} {
+		if got := goBenchUnit(tc.metric); got != tc.want {
+			t.Errorf("goBenchUnit(%q) = %q, want %q", tc.metric, got, tc.want)
+		}
+	}
+}
+
+func TestSortedResultKeys(t *testing.T) {
+	got := sortedResultKeys(testResult)
+	want := []string{
+		"idle_available_bytes",
+		"teardown_mem_available_delta_bytes",
+		"kernel_page_alloc_latencies_ns_order0",
+		"kernel_page_allocs_node1_order0",
+		"kernel_page_allocs_order2",
+		"kernel_page_allocs_order10",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	s := summarize([]int64{9, 4, 2, 5, 4, 7, 4, 5})
+	if s.samples != 8 || s.sum != 40 || s.mean != 5 {
+		t.Errorf("got samples=%d sum=%d mean=%v, want 8, 40, 5", s.samples, s.sum, s.mean)
+	}
+	if s.min != 2 || s.median != 5 || s.p95 != 9 || s.max != 9 {
+		t.Errorf("got min=%d median=%d p95=%d max=%d, want 2, 5, 9, 9", s.min, s.median, s.p95, s.max)
+	}
+	// The squared deviations from the mean add up to 32.
+	wantStddev := math.Sqrt(32.0 / 7)
+	if math.Abs(s.stddev-wantStddev) > 1e-9 {
+		t.Errorf("got stddev %v, want %v", s.stddev, wantStddev)
+	}
+	// 7 degrees of freedom.
+	if want := 2.365 * wantStddev / math.Sqrt(8); math.Abs(s.ci95-want) > 1e-9 {
+		t.Errorf("got ci95 %v, want %v", s.ci95, want)
+	}
+
+	one := summarize([]int64{42})
+	if one.stddev != 0 || one.ci95 != 0 || one.median != 42 || one.p95 != 42 {
+		t.Errorf("summarize of one value got %+v, want no dispersion", one)
+	}
+	// Beyond the t table it's the normal approximation.
+	if got, want := confidenceInterval95(1, 100), 1.960/10; math.Abs(got-want) > 1e-9 {
+		t.Errorf("confidenceInterval95(1, 100) = %v, want %v", got, want)
+	}
+}
+
+// On Ctrl-C, doMain still writes the results file, marked as partial.
+func TestPartialResultFile(t *testing.T) {
+	// The first two iterations finish, the third interrupts the benchmark
+	// and hangs until it's killed.
+	stubFindlimitChild(t, `echo x >> runs
+if [ $(wc -l < runs) -ge 3 ]; then kill -INT $PPID; exec sleep 1000; fi
+`+oomingChild)
+	outputPath := filepath.Join(t.TempDir(), "result.json")
+	for name, value := range map[string]string{
+		"idle-only":     "true",
+		"iterations":    "3",
+		"output-path":   outputPath,
+		"output-format": "json",
+	} {
+		old := flag.Lookup(name).Value.String()
+		t.Cleanup(func() { flag.Set(name, old) })
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := doMain()
+	if err == nil || !strings.Contains(err.Error(), "partial") {
+		t.Fatalf("doMain returned %v, want error about partial results", err)
+	}
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("reading results: %v", err)
+	}
+	var output struct {
+		Config struct {
+			Partial bool `json:"partial"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(data, &output); err != nil {
+		t.Fatalf("parsing results: %v\n%s", err, data)
+	}
+	if !output.Config.Partial {
+		t.Errorf("results not marked partial:\n%s", data)
+	}
+}
+
+func TestWriteFoldedLatencies(t *testing.T) {
+	old := foldedLatencies
+	t.Cleanup(func() { foldedLatencies = old })
+	foldedLatencies = make(map[string]int64)
+
+	// Accumulates across runs.
+	addFoldedLatencies("", []kallocfree.AllocSample{
+		{CPU: 3, Node: 0, Order: 2, Latency: 1000},
+		{CPU: 3, Node: 0, Order: 2, Latency: 1024},
+		{CPU: 1, Node: 1, Order: 0, Latency: 1},
+	})
+	addFoldedLatencies("", []kallocfree.AllocSample{{CPU: 3, Node: 0, Order: 2, Latency: 1025}})
+	addFoldedLatencies("/dev/pab1", []kallocfree.AllocSample{{CPU: 3, Node: 0, Order: 2, Latency: 600}})
+	path := filepath.Join(t.TempDir(), "latencies.folded")
+	if err := writeFoldedLatencies(path); err != nil {
+		t.Fatalf("writeFoldedLatencies: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `/dev/pab1;node0;cpu3;order2;<=1.024µs 1
+node0;cpu3;order2;<=1.024µs 2
+node0;cpu3;order2;<=2.048µs 1
+node1;cpu1;order0;<=1ns 1
+`
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestResultStream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.ndjson")
+	// Appends to what's already there.
+	if err := os.WriteFile(path, []byte(`{"metric":"old","values":[1]}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := openResultStream(path)
+	if err != nil {
+		t.Fatalf("openResultStream: %v", err)
+	}
+	order := 4
+	if err := stream.write(map[string][]int64{"kernel_page_allocs": {7}, "idle_available_bytes": {300, 100}}, &order); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := stream.write(map[string][]int64{"teardown_mem_free_delta_bytes": {-4096}}, nil); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := stream.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"metric":"old","values":[1]}
+{"metric":"idle_available_bytes","order":4,"values":[300,100]}
+{"metric":"kernel_page_allocs","order":4,"values":[7]}
+{"metric":"teardown_mem_free_delta_bytes","values":[-4096]}
+`
+	if string(data) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", data, want)
+	}
+
+	// A nil stream discards everything.
+	var discard *resultStream
+	if err := discard.write(map[string][]int64{"x": {1}}, nil); err != nil {
+		t.Errorf("write to nil stream: %v", err)
+	}
+	if err := discard.close(); err != nil {
+		t.Errorf("close of nil stream: %v", err)
+	}
+}
+
+func TestLiveStats(t *testing.T) {
+	t.Cleanup(func() {
+		live.setWorkload(nil)
+		live.setFindlimitPhase("")
+	})
+	get := func() string {
+		rec := httptest.NewRecorder()
+		handleStats(rec, httptest.NewRequest("GET", "/stats", nil))
+		if got := rec.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("got Content-Type %q, want application/json", got)
+		}
+		return strings.TrimSpace(rec.Body.String())
+	}
+
+	if got, want := get(), `{"kallocfree":null,"findlimit":null}`; got != want {
+		t.Errorf("between runs got %s, want %s", got, want)
+	}
+
+	live.setWorkload(&fakeLiveWorkload{
+		counters: kallocfree.Counters{PagesAllocated: 10, PagesFreed: 4, AllocFailures: 2, RemoteAllocs: 1},
+	})
+	live.setFindlimitPhase("initial")
+	live.findlimitAllocated.Store(8192)
+	want := `{"kallocfree":{"pages_allocated":10,"pages_freed":4,"alloc_failures":2,"numa_remote_allocations":1},` +
+		`"findlimit":{"phase":"initial","allocated_bytes":8192}}`
+	if got := get(); got != want {
+		t.Errorf("during a run got %s, want %s", got, want)
+	}
+
+	// A new phase starts from zero.
+	live.setFindlimitPhase("antagonized")
+	if got := get(); !strings.Contains(got, `"findlimit":{"phase":"antagonized","allocated_bytes":0}`) {
+		t.Errorf("after starting a new phase got %s", got)
+	}
+}
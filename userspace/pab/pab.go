@@ -17,8 +17,15 @@
 package pab
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -34,7 +41,83 @@ func (s ByteSize) Bytes() int64 {
 }
 
 func (s ByteSize) Pages() int64 {
-	return s.Bytes() / int64(os.Getpagesize())
+	return s.Bytes() / PageSize().Bytes()
+}
+
+// RoundUpToPage rounds up to a multiple of the base page size.
+func (s ByteSize) RoundUpToPage() ByteSize {
+	return (s + PageSize() - 1).RoundDownToPage()
+}
+
+// RoundDownToPage rounds down to a multiple of the base page size.
+func (s ByteSize) RoundDownToPage() ByteSize {
+	return s - s%PageSize()
+}
+
+// AlignedToPage returns whether the size is a multiple of the base page size.
+func (s ByteSize) AlignedToPage() bool {
+	return s%PageSize() == 0
+}
+
+// HugePages returns how many huge pages of the given size would fit in s.
+func (s ByteSize) HugePages(hugePageSize ByteSize) int64 {
+	return s.Bytes() / hugePageSize.Bytes()
+}
+
+// DefaultHugePageSize returns the kernel's default huge page size, from
+// /proc/meminfo. Returns an error if the kernel doesn't support huge pages.
+// This can't use linux.ReadMeminfo as that package depends on this one.
+func DefaultHugePageSize() (ByteSize, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseHugePageSize(f)
+}
+
+func parseHugePageSize(r io.Reader) (ByteSize, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Looks like "Hugepagesize:       2048 kB".
+		val, ok := strings.CutPrefix(scanner.Text(), "Hugepagesize:")
+		if !ok {
+			continue
+		}
+		size, err := ParseByteSize(val)
+		if err != nil {
+			return 0, fmt.Errorf("parsing Hugepagesize from /proc/meminfo: %v", err)
+		}
+		if size <= 0 {
+			return 0, fmt.Errorf("Hugepagesize in /proc/meminfo is %v, are huge pages disabled?", size)
+		}
+		return size, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("reading /proc/meminfo: %v", err)
+	}
+	return 0, fmt.Errorf("no Hugepagesize in /proc/meminfo, does the kernel support huge pages (CONFIG_HUGETLBFS)?")
+}
+
+// PageSize is the size of a base page on this system.
+func PageSize() ByteSize {
+	return ByteSize(os.Getpagesize())
+}
+
+// SizeForOrder returns the size of an allocation of the given page order, i.e.
+// 2^order base pages.
+func SizeForOrder(order int) ByteSize {
+	return PageSize() << order
+}
+
+// OrderForSize returns the smallest page order whose allocations are at least
+// size bytes, i.e. it rounds up. Sizes of a page or less are order 0.
+func OrderForSize(size ByteSize) int {
+	order := 0
+	for SizeForOrder(order) < size {
+		order++
+	}
+	return order
 }
 
 func (s ByteSize) String() string {
@@ -53,3 +136,135 @@ func (s ByteSize) String() string {
 		return fmt.Sprintf("%.2fGiB", float64(s)/float64(Gigabyte))
 	}
 }
+
+// Suffixes accepted by ParseByteSize. "kB" is what /proc/meminfo uses, where it
+// means KiB.
+var byteSizeUnits = map[string]ByteSize{
+	"":    1,
+	"B":   1,
+	"kB":  Kilobyte,
+	"KiB": Kilobyte,
+	"MiB": Megabyte,
+	"GiB": Gigabyte,
+}
+
+// ParseByteSize parses a size like "256MiB", "1.5GiB" or "1024" (bytes). It
+// accepts everything that String produces, although since String rounds, that
+// might not give back exactly the same value. Surrounding whitespace is ignored.
+func ParseByteSize(s string) (ByteSize, error) {
+	trimmed := strings.TrimSpace(s)
+	numEnd := strings.IndexFunc(trimmed, func(r rune) bool {
+		return !(r >= '0' && r <= '9' || r == '.' || r == '-' || r == '+')
+	})
+	if numEnd < 0 {
+		numEnd = len(trimmed)
+	}
+	num, unitStr := trimmed[:numEnd], strings.TrimSpace(trimmed[numEnd:])
+	unit, ok := byteSizeUnits[unitStr]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q, want B, KiB, MiB or GiB", s, unitStr)
+	}
+	// Avoid float imprecision for the common case of an integer.
+	if n, err := strconv.ParseInt(num, 10, 64); err == nil {
+		return ByteSize(n) * unit, nil
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %q isn't a number", s, num)
+	}
+	return ByteSize(math.Round(f * float64(unit))), nil
+}
+
+// Set implements flag.Value, via ParseByteSize.
+func (s *ByteSize) Set(str string) error {
+	size, err := ParseByteSize(str)
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
+// MarshalJSON encodes the size as a string with units, like "256.00MiB". Since
+// String rounds, if that wouldn't parse back to exactly the same size it's
+// encoded in bytes instead, like "123456789B".
+func (s ByteSize) MarshalJSON() ([]byte, error) {
+	str := s.String()
+	if parsed, err := ParseByteSize(str); err != nil || parsed != s {
+		str = fmt.Sprintf("%dB", s.Bytes())
+	}
+	return json.Marshal(str)
+}
+
+// UnmarshalJSON decodes the output of MarshalJSON. It also accepts a bare
+// number of bytes, as older results used.
+func (s *ByteSize) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*s = ByteSize(n)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("ByteSize should be a string or a number, got %s", data)
+	}
+	return s.Set(str)
+}
+
+// TimeUnit is a unit for displaying durations to humans.
+type TimeUnit int
+
+const (
+	// AutoTimeUnit means pick a unit based on the magnitude of the value.
+	AutoTimeUnit TimeUnit = iota
+	Nanoseconds
+	Microseconds
+	Milliseconds
+)
+
+// ParseTimeUnit parses one of "ns", "us", "ms" or "auto".
+func ParseTimeUnit(s string) (TimeUnit, error) {
+	switch s {
+	case "auto":
+		return AutoTimeUnit, nil
+	case "ns":
+		return Nanoseconds, nil
+	case "us":
+		return Microseconds, nil
+	case "ms":
+		return Milliseconds, nil
+	}
+	return 0, fmt.Errorf("invalid time unit %q, want one of ns, us, ms, auto", s)
+}
+
+// UnitFor returns the unit that the AutoTimeUnit would pick for the given
+// duration. If you're formatting several related values, pick the unit once
+// (e.g. from the median) so they're comparable.
+func UnitFor(d time.Duration) TimeUnit {
+	if d < 0 {
+		d = -d
+	}
+	switch {
+	case d < time.Microsecond:
+		return Nanoseconds
+	case d < time.Millisecond:
+		return Microseconds
+	default:
+		return Milliseconds
+	}
+}
+
+// FormatDuration formats d in the given unit.
+func FormatDuration(d time.Duration, unit TimeUnit) string {
+	if unit == AutoTimeUnit {
+		unit = UnitFor(d)
+	}
+	switch unit {
+	case Microseconds:
+		return fmt.Sprintf("%.2fus", float64(d)/float64(time.Microsecond))
+	case Milliseconds:
+		return fmt.Sprintf("%.2fms", float64(d)/float64(time.Millisecond))
+	default:
+		return fmt.Sprintf("%dns", d.Nanoseconds())
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2024 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+
+package pab
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// String, ParseByteSize and JSON should all agree, including for sizes that
+// String has to round.
+func TestByteSizeRoundTrip(t *testing.T) {
+	for _, size := range []ByteSize{
+		0,
+		1,
+		512,
+		-512,
+		Kilobyte,
+		256 * Megabyte,
+		-3 * Gigabyte / 2,
+		123456789,
+		-123456789,
+		5*Gigabyte + 1,
+	} {
+		// String rounds to 2 decimal places, which is within 0.5% of
+		// anything that's shown with a unit.
+		parsed, err := ParseByteSize(size.String())
+		if err != nil {
+			t.Errorf("ParseByteSize(%q): %v", size.String(), err)
+		} else if diff := math.Abs(float64(parsed - size)); diff > math.Abs(float64(size))*0.005 {
+			t.Errorf("ParseByteSize(%q) = %d, want about %d", size.String(), parsed.Bytes(), size.Bytes())
+		}
+
+		// JSON doesn't round.
+		data, err := json.Marshal(size)
+		if err != nil {
+			t.Fatalf("Marshal(%d): %v", size.Bytes(), err)
+		}
+		var got ByteSize
+		if err := json.Unmarshal(data, &got); err != nil || got != size {
+			t.Errorf("Unmarshal(%s) = %d, %v; want %d", data, got.Bytes(), err, size.Bytes())
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    ByteSize
+		wantErr bool
+	}{
+		{in: "1024", want: Kilobyte},
+		{in: "0", want: 0},
+		{in: "-4096", want: -4096},
+		{in: "100B", want: 100},
+		{in: "4 kB", want: 4 * Kilobyte},
+		{in: "  256MiB\n", want: 256 * Megabyte},
+		{in: "1.5GiB", want: 3 * Gigabyte / 2},
+		{in: "0.50KiB", want: 512},
+		{in: "1.2345KiB", want: 1264}, // Rounded to the nearest byte.
+		{in: "-1.50MiB", want: -3 * Megabyte / 2},
+		{in: "", wantErr: true},
+		{in: "MiB", wantErr: true},
+		{in: "1.2.3", wantErr: true},
+		{in: "12 furlongs", wantErr: true},
+		{in: "1mib", wantErr: true},
+	} {
+		got, err := ParseByteSize(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseByteSize(%q) = %d, want error", tc.in, got.Bytes())
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("ParseByteSize(%q) = %d, %v; want %d", tc.in, got.Bytes(), err, tc.want.Bytes())
+		}
+	}
+}
+
+func TestByteSizeFlag(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	size := 128 * Megabyte
+	fs.Var(&size, "size", "")
+	if err := fs.Parse([]string{"--size=1.5GiB"}); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if size != 3*Gigabyte/2 {
+		t.Errorf("got %v, want 1.50GiB", size)
+	}
+	if err := fs.Parse([]string{"--size=lots"}); err == nil {
+		t.Errorf("--size=lots was accepted")
+	}
+	if size != 3*Gigabyte/2 {
+		t.Errorf("failed Set changed the value to %v", size)
+	}
+}
+
+func TestByteSizeJSON(t *testing.T) {
+	for _, tc := range []struct {
+		size ByteSize
+		want string
+	}{
+		{size: 256 * Megabyte, want: `"256.00MiB"`},
+		{size: 512, want: `"512B"`},
+		{size: -2 * Kilobyte, want: `"-2.00KiB"`},
+		// These don't survive String's rounding, so they're in bytes.
+		{size: 123456789, want: `"123456789B"`},
+		{size: Gigabyte + 1, want: `"1073741825B"`},
+	} {
+		data, err := json.Marshal(tc.size)
+		if err != nil || string(data) != tc.want {
+			t.Errorf("Marshal(%d) = %s, %v; want %s", tc.size.Bytes(), data, err, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		in   string
+		want ByteSize
+	}{
+		{in: `"256.00MiB"`, want: 256 * Megabyte},
+		{in: `"123456789B"`, want: 123456789},
+		{in: `4096`, want: 4096}, // Older results.
+	} {
+		var got ByteSize
+		if err := json.Unmarshal([]byte(tc.in), &got); err != nil || got != tc.want {
+			t.Errorf("Unmarshal(%s) = %d, %v; want %d", tc.in, got.Bytes(), err, tc.want.Bytes())
+		}
+	}
+	for _, bad := range []string{`"lots"`, `true`, `{}`} {
+		var got ByteSize
+		if err := json.Unmarshal([]byte(bad), &got); err == nil {
+			t.Errorf("Unmarshal(%s) = %v, want error", bad, got)
+		}
+	}
+}
+
+func TestPageAlignment(t *testing.T) {
+	page := PageSize()
+	for _, tc := range []struct {
+		size            ByteSize
+		up, down        ByteSize
+		wantAlignedPage bool
+	}{
+		{size: 0, up: 0, down: 0, wantAlignedPage: true},
+		{size: 1, up: page, down: 0},
+		{size: page - 1, up: page, down: 0},
+		{size: page, up: page, down: page, wantAlignedPage: true},
+		{size: page + 1, up: 2 * page, down: page},
+		{size: 10 * page, up: 10 * page, down: 10 * page, wantAlignedPage: true},
+	} {
+		if got := tc.size.RoundUpToPage(); got != tc.up {
+			t.Errorf("%d.RoundUpToPage() = %d, want %d", tc.size, got, tc.up)
+		}
+		if got := tc.size.RoundDownToPage(); got != tc.down {
+			t.Errorf("%d.RoundDownToPage() = %d, want %d", tc.size, got, tc.down)
+		}
+		if got := tc.size.AlignedToPage(); got != tc.wantAlignedPage {
+			t.Errorf("%d.AlignedToPage() = %v, want %v", tc.size, got, tc.wantAlignedPage)
+		}
+	}
+}
+
+func TestOrderForSize(t *testing.T) {
+	page := PageSize()
+	for order := 0; order <= 10; order++ {
+		if got, want := SizeForOrder(order), page*(1<<order); got != want {
+			t.Errorf("SizeForOrder(%d) = %v, want %v", order, got, want)
+		}
+		// Round trips, and anything just bigger needs the next order.
+		if got := OrderForSize(SizeForOrder(order)); got != order {
+			t.Errorf("OrderForSize(SizeForOrder(%d)) = %d", order, got)
+		}
+		if got := OrderForSize(SizeForOrder(order) + 1); got != order+1 {
+			t.Errorf("OrderForSize(SizeForOrder(%d) + 1) = %d, want %d", order, got, order+1)
+		}
+	}
+	for _, size := range []ByteSize{-1, 0, 1} {
+		if got := OrderForSize(size); got != 0 {
+			t.Errorf("OrderForSize(%d) = %d, want 0", size, got)
+		}
+	}
+}
+
+func TestParseHugePageSize(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		meminfo string
+		want    ByteSize
+		wantErr bool
+	}{
+		{
+			name:    "2MiB",
+			meminfo: "MemTotal:       32768 kB\nHugePages_Total:       0\nHugepagesize:       2048 kB\nHugetlb:               0 kB\n",
+			want:    2 * Megabyte,
+		},
+		{name: "1GiB", meminfo: "Hugepagesize:    1048576 kB\n", want: Gigabyte},
+		{name: "missing", meminfo: "MemTotal:       32768 kB\n", wantErr: true},
+		{name: "zero", meminfo: "Hugepagesize:       0 kB\n", wantErr: true},
+		{name: "garbage", meminfo: "Hugepagesize:       big\n", wantErr: true},
+	} {
+		got, err := parseHugePageSize(strings.NewReader(tc.meminfo))
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %v, want error", tc.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %v, %v; want %v", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestHugePages(t *testing.T) {
+	for _, tc := range []struct {
+		size, hugePageSize ByteSize
+		want               int64
+	}{
+		{size: Gigabyte, hugePageSize: 2 * Megabyte, want: 512},
+		{size: Gigabyte - 1, hugePageSize: 2 * Megabyte, want: 511},
+		{size: Megabyte, hugePageSize: 2 * Megabyte, want: 0},
+		{size: 3 * Gigabyte, hugePageSize: Gigabyte, want: 3},
+	} {
+		if got := tc.size.HugePages(tc.hugePageSize); got != tc.want {
+			t.Errorf("%v.HugePages(%v) = %d, want %d", tc.size, tc.hugePageSize, got, tc.want)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		unit string
+		want string
+	}{
+		{d: 999, unit: "auto", want: "999ns"},
+		{d: 1500, unit: "auto", want: "1.50us"},
+		{d: -1500, unit: "auto", want: "-1.50us"},
+		{d: 2500 * time.Microsecond, unit: "auto", want: "2.50ms"},
+		{d: 2500 * time.Microsecond, unit: "ns", want: "2500000ns"},
+		{d: 1500, unit: "us", want: "1.50us"},
+		{d: 1500, unit: "ms", want: "0.00ms"},
+	} {
+		unit, err := ParseTimeUnit(tc.unit)
+		if err != nil {
+			t.Fatalf("ParseTimeUnit(%q): %v", tc.unit, err)
+		}
+		if got := FormatDuration(tc.d, unit); got != tc.want {
+			t.Errorf("FormatDuration(%d, %s) = %q, want %q", tc.d, tc.unit, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"", "s", "NS", "micros"} {
+		if _, err := ParseTimeUnit(bad); err == nil {
+			t.Errorf("ParseTimeUnit(%q) succeeded, want error", bad)
+		}
+	}
+}
@@ -17,127 +17,655 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"math"
 	"os"
+	"os/signal"
+	"runtime"
 	"runtime/debug"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/page_alloc_bench/kmod"
+	"github.com/google/page_alloc_bench/linux"
 	"github.com/google/page_alloc_bench/pab"
 	"github.com/google/page_alloc_bench/workload/findlimit"
 	"github.com/google/page_alloc_bench/workload/kallocfree"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
 var (
-	timeoutSFlag    = flag.Int("timeout-s", 0, "Timeout in seconds. Set 0 for no timeout (default)")
-	outputPathFlag  = flag.String("output-path", "", "File to write JSON results to. See README for specification.")
-	iterationsFlag  = flag.Int("iterations", 5, "Iterations")
-	allocOrdersFlag = flag.String("alloc-orders", "0,4", "Comma-separate list of page alloc orders to test")
-	latenciesFlag   = flag.Bool("latencies", true, "Gather allocation/free latency data. Can be large.")
+	timeoutSFlag             = flag.Int("timeout-s", 0, "Timeout in seconds. Set 0 for no timeout (default)")
+	outputPathFlag           = flag.String("output-path", "", "File to write JSON results to. See README for specification.")
+	prometheusPathFlag       = flag.String("prometheus-output-path", "", "File to write results to in Prometheus text format, with the order as a label.")
+	iterationsFlag           = flag.Int("iterations", 5, "Iterations")
+	allocOrdersFlag          = flag.String("alloc-orders", "0,4", "Comma-separate list of page alloc orders to test")
+	latenciesFlag            = flag.Bool("latencies", true, "Gather allocation/free latency data. Can be large.")
+	profileFlag              = flag.String("profile", "", "Use a preset mix of allocation orders for the kernel antagonist. Overrides --alloc-orders. See README for options.")
+	idleOnlyFlag             = flag.Bool("idle-only", false, "Only assess idle memory availability, skip the kernel antagonist. Ignores --alloc-orders.")
+	findlimitConcurrencyFlag = flag.Int("findlimit-concurrency", 1, "Max number of findlimit child processes to run at once")
+	antagonizedBudgetSFlag   = flag.Int("antagonized-budget-s", 0, "Don't start new antagonized findlimit iterations after this many seconds. 0 for no limit (default).")
+	warmColdFlag             = flag.Bool("warm-cold", false, "Separately measure allocations made immediately after a free. Requires --latencies.")
+	kmodDevicesFlag          = flag.String("kmod-devices", kmod.DefaultDevicePath, "Comma-separated list of kernel module device files. The benchmark is repeated for each one.")
+	housekeepingCPUsFlag     = flag.String("housekeeping-cpus", "", "If set, CPUs (in cpulist format, e.g. 0-1) to confine the process to before starting workers, so Go runtime threads stay off the other CPUs.")
+	saveNUMATopologyFlag     = flag.String("save-numa-topology", "", "If set, write the CPU to NUMA node mapping to this file as JSON.")
+	loadNUMATopologyFlag     = flag.String("load-numa-topology", "", "If set, read the CPU to NUMA node mapping from this file instead of sysfs. See --save-numa-topology.")
+	crossCPUFreeFlag         = flag.Bool("cross-cpu-free", false, "Have kernel workers hand pages off to be freed on a different CPU than allocated them.")
+	fallbackOrdersFlag       = flag.Bool("fallback-orders", false, "When a kernel allocation fails, retry at each lower order before backing off.")
+	probeMaxOrderMSFlag      = flag.Int("probe-max-order-ms", 0, "If nonzero, while the kernel antagonist runs, probe the largest allocatable order at this interval in milliseconds.")
+	verifyFreesFlag          = flag.Bool("verify-frees", false, "Before each run, check that pages freed by the kernel module can be allocated again.")
+	statsLogFlag             = flag.String("stats-log", "", "If set, append the kernel antagonist's raw counters to this file periodically. See --stats-log-interval-ms.")
+	statsLogIntervalMSFlag   = flag.Int("stats-log-interval-ms", 1000, "Interval for --stats-log.")
+	touchPatternFlag         = flag.String("touch-pattern", "first-byte", "How findlimit dirties the pages it allocates: first-byte, whole-page or random-byte.")
+	foldedLatencyPathFlag    = flag.String("folded-latency-output", "", "If set, write kernel allocation latency samples to this file in the folded format used by flamegraph tools. Requires --latencies.")
+	thpModeFlag              = flag.String("thp-mode", "", "If set, set the transparent hugepage mode (always, madvise or never) for the duration of the benchmark.")
+	dropCachesFlag           = flag.Bool("drop-caches-between-iterations", false, "Drop the page cache and slab caches before each findlimit iteration. Needs root. With --findlimit-concurrency above 1, each drop waits for the running iterations to finish, so they don't overlap.")
+	touchGoroutinesFlag      = flag.Int("findlimit-touch-goroutines", 0, "Number of goroutines the findlimit workload faults pages in with. By default it's the biggest power of two up to the number of CPUs.")
+	kernelAllocNodeFlag      = flag.Int("kernel-alloc-node", -1, "If set, the kernel antagonist allocates all its pages from this NUMA node, regardless of which CPU is allocating.")
+	kernelGFPFlag            = flag.String("kernel-gfp", "", "Comma-separated GFP flags for the kernel antagonist's allocations, from: atomic, movable, zero, noretry, nowarn. By default it uses GFP_KERNEL.")
+	verifyPageContentsFlag   = flag.Bool("verify-page-contents", false, "Have the kernel antagonist fill its pages with a pattern and check it when freeing them, output as kernel_page_corruptions. Incompatible with --cross-cpu-free.")
+	latencyHistogramFlag     = flag.Bool("latency-histogram", false, "Also count every kernel allocation latency into a histogram with power-of-two buckets, output as kernel_page_alloc_latency_histogram. Requires --latencies.")
+	samplingSeedFlag         = flag.Int64("sampling-seed", 0, "If nonzero, seed the sampling of kernel latencies with this, for reproducible output. By default it's seeded from the current time.")
+	percentilesFlag          = flag.String("percentiles", "95", "Comma-separated list of percentiles to print for multi-valued metrics, each in (0, 100]")
+	latencyUnitFlag          = flag.String("latency-unit", "auto", "Unit for printing latencies: ns, us, ms or auto. JSON output is always ns.")
+	outputFormatFlag         = flag.String("output-format", "json", "Format for --output-path: json, csv or gobench (for benchstat).")
+	kernelTargetPagesFlag    = flag.Int("kernel-target-pages", kallocfree.DefaultTargetPages, "Number of allocations each kernel antagonist worker holds on average.")
+	kernelSwingPagesFlag     = flag.Int("kernel-swing-pages", kallocfree.DefaultSwingPages, "How far either side of --kernel-target-pages each kernel antagonist worker's allocation count swings. 1 for a fixed working set.")
+	kernelNoFreeFlag         = flag.Bool("kernel-no-free", false, "The kernel antagonist only allocates, until it holds --total-memory, then holds it. Incompatible with --fill-to-mem-free.")
+	httpAddrFlag             = flag.String("http-addr", "", "If set, serve live stats on this address (e.g. :8080) while the benchmark runs, as JSON at /stats and for Prometheus at /metrics.")
+	streamOutputFlag         = flag.String("stream-output", "", "If set, append results to this file as newline-delimited JSON as each run completes, so they can be watched and aren't lost if the benchmark dies.")
+	iterationTimeoutSFlag    = flag.Int("iteration-timeout-s", 0, "If nonzero, give up on a findlimit iteration, or on waiting for the kernel antagonist to reach steady state, after this many seconds and carry on. Counted in the _timeouts metrics.")
+	findlimitHugePagesFlag   = flag.Bool("findlimit-huge-pages", false, "Have the findlimit workload allocate hugetlb pages of the default size instead of base pages. Needs huge pages reserved via /proc/sys/vm.")
+	findlimitReportMSFlag    = flag.Int("findlimit-report-interval-ms", 0, "How often the findlimit workload's subprocess reports how much it's allocated. Its last report before getting OOM-killed is the result, so this bounds how stale that is, but reporting takes CPU time from faulting pages in. 0 means the default, 50ms.")
 )
 
 var (
-	kernelAllocFailuresPrefix        = "kernel_alloc_failures"
-	idleAvailableBytesPrefix         = "idle_available_bytes"
-	antagonizedAvailableBytesPrefix  = "antagonized_available_bytes"
-	kernelPageAllocsPrefix           = "kernel_page_allocs"
-	kernelPageAllocsRemotePrefix     = "kernel_page_allocs_remote"
-	kernelPageAllocLatenciesNSPrefix = "kernel_page_alloc_latencies_ns"
-	kernelPageFreeLatenciesNSPrefix  = "kernel_page_free_latencies_ns"
+	kernelAllocFailuresPrefix             = "kernel_alloc_failures"
+	kernelFreeFailuresPrefix              = "kernel_free_failures"
+	kernelAllocBackoffNSPrefix            = "kernel_alloc_backoff_ns"
+	kernelCrossCPUFreesPrefix             = "kernel_cross_cpu_frees"
+	kernelAllocFallbacksPrefix            = "kernel_alloc_fallbacks"
+	kernelImplausibleLatenciesPrefix      = "kernel_implausible_latencies"
+	kernelPageCorruptionsPrefix           = "kernel_page_corruptions"
+	kernelKmodBytesHeldPrefix             = "kernel_kmod_bytes_held"
+	kernelPageFreesRemotePrefix           = "kernel_page_frees_remote"
+	kernelMaxOrderPrefix                  = "kernel_max_order"
+	kernelMaxOrderTimeMSPrefix            = "kernel_max_order_time_ms"
+	idleAvailableBytesPrefix              = "idle_available_bytes"
+	idleUnusableFreePPMPrefix             = "idle_unusable_free_ppm"
+	antagonizedUnusableFreePPMPrefix      = "antagonized_unusable_free_ppm"
+	antagonizedAvailableBytesPrefix       = "antagonized_available_bytes"
+	idleTimeToOOMNSPrefix                 = "idle_time_to_oom_ns"
+	antagonizedTimeToOOMNSPrefix          = "antagonized_time_to_oom_ns"
+	idlePeakRSSBytesPrefix                = "idle_peak_rss_bytes"
+	antagonizedPeakRSSBytesPrefix         = "antagonized_peak_rss_bytes"
+	idleFaultRatePrefix                   = "idle_fault_rate_pages_per_s"
+	antagonizedFaultRatePrefix            = "antagonized_fault_rate_pages_per_s"
+	antagonizedIterationsPrefix           = "antagonized_iterations"
+	stolenBytesPrefix                     = "stolen_bytes"
+	kernelPageFreesPrefix                 = "kernel_page_frees"
+	idleTimeoutsPrefix                    = "idle_timeouts"
+	antagonizedTimeoutsPrefix             = "antagonized_timeouts"
+	kernelSteadyStateTimeoutsPrefix       = "kernel_steady_state_timeouts"
+	stolenPPMPrefix                       = "stolen_ppm"
+	teardownMemAvailableDeltaPrefix       = "teardown_mem_available_delta_bytes"
+	teardownMemFreeDeltaPrefix            = "teardown_mem_free_delta_bytes"
+	kernelPageAllocsPrefix                = "kernel_page_allocs"
+	kernelPageAllocsRemotePrefix          = "kernel_page_allocs_remote"
+	kernelPageAllocLatenciesNSPrefix      = "kernel_page_alloc_latencies_ns"
+	kernelPageFreeLatenciesNSPrefix       = "kernel_page_free_latencies_ns"
+	kernelPageAllocWarmLatenciesNSPrefix  = "kernel_page_alloc_warm_latencies_ns"
+	kernelPageAllocColdLatenciesNSPrefix  = "kernel_page_alloc_cold_latencies_ns"
+	kernelPageAllocLatencyMinNSPrefix     = "kernel_page_alloc_latency_min_ns"
+	kernelPageAllocLatencyMaxNSPrefix     = "kernel_page_alloc_latency_max_ns"
+	kernelPageFreeLatencyMinNSPrefix      = "kernel_page_free_latency_min_ns"
+	kernelPageFreeLatencyMaxNSPrefix      = "kernel_page_free_latency_max_ns"
+	kernelPageAllocLatencyHistogramPrefix = "kernel_page_alloc_latency_histogram"
 )
 
-// Runs findlimit workload @iterations times, returns available byte counts.
-func repeatFindlimit(ctx context.Context, iterations int, desc string) ([]int64, error) {
-	var result []int64
+// Metrics whose values are nanosecond latencies.
+var latencyPrefixes = []string{
+	kernelPageAllocLatenciesNSPrefix,
+	kernelPageFreeLatenciesNSPrefix,
+	kernelPageAllocWarmLatenciesNSPrefix,
+	kernelPageAllocColdLatenciesNSPrefix,
+	kernelPageAllocLatencyMinNSPrefix,
+	kernelPageAllocLatencyMaxNSPrefix,
+	kernelPageFreeLatencyMinNSPrefix,
+	kernelPageFreeLatencyMaxNSPrefix,
+	idleTimeToOOMNSPrefix,
+	antagonizedTimeToOOMNSPrefix,
+}
+
+func isLatencyMetric(name string) bool {
+	for _, prefix := range latencyPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Bounds the findlimit children across the whole process, see
+// --findlimit-concurrency. Set with setFindlimitConcurrency.
+var (
+	findlimitSem         *semaphore.Weighted
+	findlimitConcurrency int64
+)
+
+func setFindlimitConcurrency(n int64) {
+	findlimitSem, findlimitConcurrency = semaphore.NewWeighted(n), n
+}
+
+// Points to linux.DropCaches, except in tests.
+var dropCaches = linux.DropCaches
+
+// Parsed from --touch-pattern.
+var touchPattern findlimit.TouchPattern
+
+// Parsed from --stats-log-interval-ms.
+var statsLogInterval time.Duration
+
+// If set, overrides the findlimit child binary. For tests.
+var findlimitChildPath string
+
+// With --housekeeping-cpus, the affinity the process started with, which the
+// findlimit child goes back to.
+var findlimitCPUs linux.CPUMask
+
+// Runs findlimit workload @iterations times, returns available byte counts in
+// iteration order. Up to --findlimit-concurrency iterations run at once. If
+// budget is nonzero, stops starting new iterations once that much time has
+// passed, so fewer results may be returned. An iteration that's already running
+// when the budget expires is allowed to finish. Also returns the number of
+// iterations that hit --iteration-timeout-s, which aren't in the results.
+func repeatFindlimit(ctx context.Context, iterations int, desc string, budget time.Duration) ([]*findlimit.Result, int, error) {
+	start := time.Now()
+	live.setFindlimitPhase(desc)
+	defer live.setFindlimitPhase("")
+	eg, egCtx := errgroup.WithContext(ctx)
+	var mu sync.Mutex
+	results := make([]*findlimit.Result, iterations) // Nil for timeouts.
+	timeouts := 0
 	for i := 1; i <= iterations; i++ {
-		if ctx.Err() != nil {
-			return nil, nil
+		// Wait for a slot before checking the budget, so it's checked
+		// when the iteration would actually start.
+		if err := findlimitSem.Acquire(egCtx, 1); err != nil {
+			break // Another iteration failed or ctx is done, see below.
 		}
-		findlimitResult, err := findlimit.Run(ctx, &findlimit.Options{})
-		if err != nil {
-			return nil, fmt.Errorf("%s findlimit run %d: %v", desc, i, err)
+		if budget != 0 && time.Since(start) >= budget {
+			findlimitSem.Release(1)
+			fmt.Printf("\tTime budget of %v for %s findlimit used up after starting %d/%d iterations\n",
+				budget, desc, i-1, iterations)
+			break
+		}
+		if *dropCachesFlag {
+			// Dropping caches under a running iteration would hand it
+			// memory the others didn't get, so wait for the rest of
+			// the slots, i.e. for every other iteration to finish.
+			if err := findlimitSem.Acquire(egCtx, findlimitConcurrency-1); err != nil {
+				findlimitSem.Release(1)
+				break
+			}
+			err := dropCaches(linux.DropAll)
+			findlimitSem.Release(findlimitConcurrency - 1)
+			if errors.Is(err, os.ErrPermission) {
+				fmt.Fprintf(os.Stderr, "Couldn't drop caches, continuing anyway: %v\n", err)
+			} else if err != nil {
+				findlimitSem.Release(1)
+				eg.Wait()
+				return nil, 0, err
+			}
+		}
+		eg.Go(func() error {
+			defer findlimitSem.Release(1)
+			iterCtx, cancel := egCtx, context.CancelFunc(func() {})
+			if *iterationTimeoutSFlag != 0 {
+				iterCtx, cancel = context.WithTimeout(egCtx, time.Duration(*iterationTimeoutSFlag)*time.Second)
+			}
+			findlimitResult, err := findlimit.Run(iterCtx, &findlimit.Options{
+				TouchPattern:    touchPattern,
+				StopAt:          findlimitStopAt,
+				TouchGoroutines: *touchGoroutinesFlag,
+				HugePages:       *findlimitHugePagesFlag,
+				ReportInterval:  time.Duration(*findlimitReportMSFlag) * time.Millisecond,
+				ChurnWindow:     findlimitChurnWindow,
+				Progress:        &live.findlimitAllocated,
+				ChildPath:       findlimitChildPath,
+				CPUs:            findlimitCPUs,
+			})
+			cancel()
+			if err != nil && iterCtx.Err() != nil && egCtx.Err() == nil {
+				fmt.Printf("\tIteration %d/%d: timed out on %s system after %ds\n",
+					i, iterations, desc, *iterationTimeoutSFlag)
+				mu.Lock()
+				timeouts++
+				mu.Unlock()
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%s findlimit run %d: %v", desc, i, err)
+			}
+			fmt.Printf("\tIteration %d/%d: %s available on %s system (OOM after %v)\n",
+				i, iterations, findlimitResult.Allocated, desc, findlimitResult.Duration)
+			results[i-1] = findlimitResult
+			return nil
+		})
+	}
+	err := eg.Wait()
+	if ctx.Err() != nil {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var ret []*findlimit.Result
+	for _, r := range results {
+		if r != nil {
+			ret = append(ret, r)
 		}
-		fmt.Printf("\tIteration %d/%d: %s available on %s system\n",
-			i, *iterationsFlag, findlimitResult.Allocated, desc)
-		result = append(result, findlimitResult.Allocated.Bytes())
 	}
+	return ret, timeouts, nil
+}
+
+// Metric names for the results of a findlimit phase.
+type findlimitPrefixes struct {
+	availableBytes, timeToOOMNS, peakRSSBytes, faultRate, timeouts string
+}
+
+var (
+	idleFindlimitPrefixes = findlimitPrefixes{
+		availableBytes: idleAvailableBytesPrefix,
+		timeToOOMNS:    idleTimeToOOMNSPrefix,
+		peakRSSBytes:   idlePeakRSSBytesPrefix,
+		faultRate:      idleFaultRatePrefix,
+		timeouts:       idleTimeoutsPrefix,
+	}
+	antagonizedFindlimitPrefixes = findlimitPrefixes{
+		availableBytes: antagonizedAvailableBytesPrefix,
+		timeToOOMNS:    antagonizedTimeToOOMNSPrefix,
+		peakRSSBytes:   antagonizedPeakRSSBytesPrefix,
+		faultRate:      antagonizedFaultRatePrefix,
+		timeouts:       antagonizedTimeoutsPrefix,
+	}
+)
+
+// Adds metrics for the findlimit results.
+func addFindlimitMetrics(metrics map[string][]int64, results []*findlimit.Result, timeouts int, prefixes findlimitPrefixes) {
+	var availableBytes, timesToOOM, peakRSS, faultRates []int64
+	for _, r := range results {
+		availableBytes = append(availableBytes, r.Allocated.Bytes())
+		timesToOOM = append(timesToOOM, r.Duration.Nanoseconds())
+		peakRSS = append(peakRSS, r.PeakRSS.Bytes())
+		faultRates = append(faultRates, int64(r.FaultRate))
+	}
+	metrics[prefixes.availableBytes] = availableBytes
+	metrics[prefixes.timeToOOMNS] = timesToOOM
+	metrics[prefixes.peakRSSBytes] = peakRSS
+	metrics[prefixes.faultRate] = faultRates
+	if *iterationTimeoutSFlag != 0 {
+		metrics[prefixes.timeouts] = []int64{int64(timeouts)}
+	}
+}
+
+// Returns metrics for how much less memory was available to userspace with the
+// kernel antagonist running than without, by comparing the means of the
+// findlimit results. These can be negative if the antagonized runs happened to
+// get more.
+func stolenMetrics(idle, antagonized []*findlimit.Result) map[string][]int64 {
+	if len(idle) == 0 || len(antagonized) == 0 {
+		return nil
+	}
+	mean := func(results []*findlimit.Result) float64 {
+		total := 0.0
+		for _, r := range results {
+			total += float64(r.Allocated.Bytes())
+		}
+		return total / float64(len(results))
+	}
+	idleMean := mean(idle)
+	stolen := idleMean - mean(antagonized)
+	metrics := map[string][]int64{stolenBytesPrefix: {int64(stolen)}}
+	if idleMean > 0 {
+		metrics[stolenPPMPrefix] = []int64{int64(stolen / idleMean * 1000000)}
+	}
+	return metrics
+}
+
+func nanoseconds(ds []time.Duration) []int64 {
+	ns := []int64{}
+	for _, d := range ds {
+		ns = append(ns, d.Nanoseconds())
+	}
+	return ns
+}
+
+// Like run, but only figures out how much memory the system appears to have
+// when idle. This is a fast smoke test of the findlimit workload.
+func runIdleOnly(ctx context.Context) (map[string][]int64, error) {
+	fmt.Printf("Assessing system memory availability...\n")
+	idleResults, idleTimeouts, err := repeatFindlimit(ctx, *iterationsFlag, "initial", 0)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]int64)
+	addFindlimitMetrics(result, idleResults, idleTimeouts, idleFindlimitPrefixes)
 	return result, nil
 }
 
+// Returns the "unusable free space index" for allocations of the given order,
+// as computed by the kernel for debugfs extfrag/unusable_index, but combining
+// all zones. This is the fraction of free memory that's in blocks too small
+// to satisfy the allocation, from 0 (all usable) to 1 (no free memory usable).
+func unusableFreeIndex(zones []linux.BuddyinfoZone, order int) float64 {
+	var totalFree, usableFree int64 // In pages.
+	for _, zone := range zones {
+		for o, n := range zone.FreeByOrder {
+			pages := n << o
+			totalFree += pages
+			if o >= order {
+				usableFree += pages
+			}
+		}
+	}
+	if totalFree == 0 {
+		return 1
+	}
+	return float64(totalFree-usableFree) / float64(totalFree)
+}
+
+// Reads buddyinfo and returns unusableFreeIndex in parts per million, as a
+// metric value.
+func unusableFreePPM(order int) ([]int64, error) {
+	zones, err := linux.ReadBuddyinfo()
+	if err != nil {
+		return nil, fmt.Errorf("reading buddyinfo: %v", err)
+	}
+	return []int64{int64(math.Round(unusableFreeIndex(zones, order) * 1e6))}, nil
+}
+
 // Returns map of metric names to values. Metrics with a single value are just a
 // slice with only one item.
-func run(ctx context.Context, allocOrder int) (map[string][]int64, error) {
+// kallocfreeOpts configures the antagonist (its OrderWeights, if set, override
+// its Order), run fills in the memory usage.
+func run(ctx context.Context, kallocfreeOpts kallocfree.Options) (map[string][]int64, error) {
 	result := make(map[string][]int64)
 
 	// We're not running this just yet, btu set it upt now to fail fast.
-	kernelUsage := 128 * pab.Megabyte
-	kallocFree, err := kallocfree.New(ctx, &kallocfree.Options{
-		TotalMemory:      kernelUsage,
-		Order:            allocOrder,
-		MeasureLatencies: *latenciesFlag,
-	})
+	kallocfreeOpts.TotalMemory = kallocfreeTotalMemory
+	kallocFree, err := kallocfree.New(ctx, &kallocfreeOpts)
 	if err != nil {
 		return nil, fmt.Errorf("setting up kallocfree workload: %v\n", err)
 	}
+	live.setWorkload(kallocFree)
+	defer live.setWorkload(nil)
+	if *verifyFreesFlag {
+		fmt.Printf("Verifying that kernel frees are effective...\n")
+		if err := kallocFree.VerifyFrees(ctx); err != nil {
+			return nil, fmt.Errorf("verifying frees: %v", err)
+		}
+	}
+
+	// For the fragmentation metric, look at the biggest order the
+	// antagonist allocates.
+	fragOrder := kallocfreeOpts.Order
+	for order := range kallocfreeOpts.OrderWeights {
+		fragOrder = max(fragOrder, order)
+	}
+	result[idleUnusableFreePPMPrefix], err = unusableFreePPM(fragOrder)
+	if err != nil {
+		return nil, err
+	}
 
 	// Figure out how much memory the system appears to have when idle.
 	fmt.Printf("Assessing system memory availability...\n")
-	idleAvailableBytes, err := repeatFindlimit(ctx, *iterationsFlag, "initial")
+	idleResults, idleTimeouts, err := repeatFindlimit(ctx, *iterationsFlag, "initial", 0)
 	if err != nil {
 		return nil, err
 	}
-	result[idleAvailableBytesPrefix] = idleAvailableBytes
+	addFindlimitMetrics(result, idleResults, idleTimeouts, idleFindlimitPrefixes)
 
 	// Make the system busy with lots of background kernel allocations and frees.
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	eg, ctx := errgroup.WithContext(ctx)
+	if *statsLogFlag != "" {
+		eg.Go(func() error {
+			return logStats(ctx, *statsLogFlag, statsLogInterval, kallocFree)
+		})
+	}
+	// The goroutines below only stash their results, which get turned into
+	// metrics after they've all finished, so that nothing writes to result
+	// concurrently.
+	var kallocfreeResult *kallocfree.Result
 	eg.Go(func() error {
-		kallocfreeResult, err := kallocFree.Run(ctx)
+		res, err := kallocFree.Run(ctx)
 		if err != nil {
 			return fmt.Errorf("kallocfree sub-workload: %v", err)
 		}
-		result[kernelAllocFailuresPrefix] = []int64{int64(kallocfreeResult.AllocFailures)}
-		result[kernelPageAllocsPrefix] = []int64{int64(kallocfreeResult.PagesAllocated)}
-		result[kernelPageAllocsRemotePrefix] = []int64{int64(kallocfreeResult.NUMARemoteAllocations)}
-		ls := []int64{}
-		for _, l := range kallocfreeResult.AllocLatencies {
-			ls = append(ls, l.Nanoseconds())
-		}
-		result[kernelPageAllocLatenciesNSPrefix] = ls
-		ls = []int64{}
-		for _, l := range kallocfreeResult.FreeLatencies {
-			ls = append(ls, l.Nanoseconds())
-		}
-		result[kernelPageFreeLatenciesNSPrefix] = ls
+		kallocfreeResult = res
 		return nil
 	})
 	fmt.Printf("Waiting for kallocfree to reach steady state...\n")
-	kallocFree.AwaitSteadyState(ctx)
-	fmt.Printf("...Steady state reached.\n")
+	steadyCtx, cancelSteady := ctx, context.CancelFunc(func() {})
+	if *iterationTimeoutSFlag != 0 {
+		steadyCtx, cancelSteady = context.WithTimeout(ctx, time.Duration(*iterationTimeoutSFlag)*time.Second)
+	}
+	kallocFree.AwaitSteadyState(steadyCtx)
+	cancelSteady()
+	// Only recorded once the goroutines are done, see below.
+	var steadyStateTimeouts []int64
+	if steadyCtx.Err() != nil && ctx.Err() == nil {
+		fmt.Printf("...Timed out, measuring anyway.\n")
+		steadyStateTimeouts = []int64{1}
+	} else {
+		fmt.Printf("...Steady state reached.\n")
+		if *iterationTimeoutSFlag != 0 {
+			steadyStateTimeouts = []int64{0}
+		}
+	}
+	result[antagonizedUnusableFreePPMPrefix], err = unusableFreePPM(fragOrder)
+	if err != nil {
+		cancel()
+		eg.Wait()
+		return nil, err
+	}
+	var antagonizedResults []*findlimit.Result
+	antagonizedTimeouts := 0
+	antagonizedDone := false
 	eg.Go(func() error {
 		// See how much memory seems to be in the system now.
-		antagonizedAvailableBytes, err := repeatFindlimit(ctx, *iterationsFlag, "antagonized")
+		budget := time.Duration(*antagonizedBudgetSFlag) * time.Second
+		results, timeouts, err := repeatFindlimit(ctx, *iterationsFlag, "antagonized", budget)
 		if err != nil {
 			return err
 		}
-		result[antagonizedAvailableBytesPrefix] = antagonizedAvailableBytes
+		antagonizedResults, antagonizedTimeouts, antagonizedDone = results, timeouts, true
 		cancel() // Done.
 		return nil
 	})
-	return result, eg.Wait()
+	err = eg.Wait()
+	if steadyStateTimeouts != nil {
+		result[kernelSteadyStateTimeoutsPrefix] = steadyStateTimeouts
+	}
+	if kallocfreeResult != nil {
+		addKallocfreeMetrics(result, kallocfreeResult, &kallocfreeOpts)
+	}
+	if antagonizedDone {
+		addFindlimitMetrics(result, antagonizedResults, antagonizedTimeouts, antagonizedFindlimitPrefixes)
+		result[antagonizedIterationsPrefix] = []int64{int64(len(antagonizedResults))}
+		for key, val := range stolenMetrics(idleResults, antagonizedResults) {
+			result[key] = val
+		}
+	}
+	return result, err
 }
 
-func printAverages(name string, vals []int64) {
-	if len(vals) == 0 {
-		fmt.Printf("No values for metric %q\n", name)
-		return
+// Adds the metrics from the kallocfree workload to result.
+func addKallocfreeMetrics(result map[string][]int64, kallocfreeResult *kallocfree.Result, kallocfreeOpts *kallocfree.Options) {
+	result[kernelAllocFailuresPrefix] = []int64{int64(kallocfreeResult.AllocFailures)}
+	result[kernelFreeFailuresPrefix] = []int64{int64(kallocfreeResult.FreeFailures)}
+	result[kernelAllocBackoffNSPrefix] = []int64{kallocfreeResult.TotalBackoff.Nanoseconds()}
+	if *latenciesFlag {
+		result[kernelImplausibleLatenciesPrefix] = []int64{int64(kallocfreeResult.ImplausibleLatencies)}
+	}
+	if kallocfreeResult.KmodBytesHeld >= 0 {
+		result[kernelKmodBytesHeldPrefix] = []int64{kallocfreeResult.KmodBytesHeld.Bytes()}
+	}
+	if *verifyPageContentsFlag {
+		result[kernelPageCorruptionsPrefix] = []int64{int64(kallocfreeResult.Corruptions)}
+	}
+	if probes := kallocfreeResult.MaxOrderProbes; len(probes) != 0 {
+		var orders, times []int64
+		for _, probe := range probes {
+			orders = append(orders, int64(probe.Order))
+			times = append(times, probe.Time.Milliseconds())
+		}
+		result[kernelMaxOrderPrefix] = orders
+		result[kernelMaxOrderTimeMSPrefix] = times
 	}
+	if *fallbackOrdersFlag {
+		total := uint64(0)
+		for order, n := range kallocfreeResult.Fallbacks {
+			result[fmt.Sprintf("%s_to%d", kernelAllocFallbacksPrefix, order)] = []int64{int64(n)}
+			total += n
+		}
+		result[kernelAllocFallbacksPrefix] = []int64{int64(total)}
+	}
+	if *crossCPUFreeFlag {
+		result[kernelCrossCPUFreesPrefix] = []int64{int64(kallocfreeResult.CrossCPUFrees)}
+	}
+	result[kernelPageAllocsPrefix] = []int64{int64(kallocfreeResult.PagesAllocated)}
+	result[kernelPageAllocsRemotePrefix] = []int64{int64(kallocfreeResult.NUMARemoteAllocations)}
+	result[kernelPageFreesRemotePrefix] = []int64{int64(kallocfreeResult.NUMARemoteFrees)}
+	for node, n := range kallocfreeResult.AllocationsByNode {
+		result[fmt.Sprintf("%s_node%d", kernelPageAllocsPrefix, node)] = []int64{int64(n)}
+	}
+	for zone, n := range kallocfreeResult.AllocationsByZone {
+		result[fmt.Sprintf("%s_zone%d", kernelPageAllocsPrefix, zone)] = []int64{int64(n)}
+	}
+	if kallocfreeOpts.OrderWeights != nil {
+		for order, n := range kallocfreeResult.AllocationsByOrder {
+			result[fmt.Sprintf("%s_of_order%d", kernelPageAllocsPrefix, order)] = []int64{int64(n)}
+		}
+		for order, n := range kallocfreeResult.FreesByOrder {
+			result[fmt.Sprintf("%s_of_order%d", kernelPageFreesPrefix, order)] = []int64{int64(n)}
+		}
+	}
+	result[kernelPageAllocLatenciesNSPrefix] = nanoseconds(kallocfreeResult.AllocLatencies)
+	if *foldedLatencyPathFlag != "" {
+		// Only distinguish the instances if there are several,
+		// like the metric names.
+		prefix := ""
+		if strings.Contains(*kmodDevicesFlag, ",") {
+			prefix = kallocfreeOpts.DevicePath
+		}
+		addFoldedLatencies(prefix, kallocfreeResult.AllocSamples)
+	}
+	if len(kallocfreeResult.LocalFreeLatencies) != 0 {
+		result[kernelPageFreeLatenciesNSPrefix+"_local"] = nanoseconds(kallocfreeResult.LocalFreeLatencies)
+	}
+	if len(kallocfreeResult.RemoteFreeLatencies) != 0 {
+		result[kernelPageFreeLatenciesNSPrefix+"_remote"] = nanoseconds(kallocfreeResult.RemoteFreeLatencies)
+	}
+	for node, latencies := range kallocfreeResult.AllocLatenciesByNode {
+		result[fmt.Sprintf("%s_node%d", kernelPageAllocLatenciesNSPrefix, node)] = nanoseconds(latencies)
+	}
+	result[kernelPageFreeLatenciesNSPrefix] = nanoseconds(kallocfreeResult.FreeLatencies)
+	if len(kallocfreeResult.AllocLatencies) != 0 {
+		result[kernelPageAllocLatencyMinNSPrefix] = []int64{kallocfreeResult.MinAllocLatency.Nanoseconds()}
+		result[kernelPageAllocLatencyMaxNSPrefix] = []int64{kallocfreeResult.MaxAllocLatency.Nanoseconds()}
+	}
+	if kallocfreeResult.AllocLatencyHistogram != nil {
+		var counts []int64
+		for _, n := range kallocfreeResult.AllocLatencyHistogram {
+			counts = append(counts, int64(n))
+		}
+		result[kernelPageAllocLatencyHistogramPrefix] = counts
+	}
+	if len(kallocfreeResult.FreeLatencies) != 0 {
+		result[kernelPageFreeLatencyMinNSPrefix] = []int64{kallocfreeResult.MinFreeLatency.Nanoseconds()}
+		result[kernelPageFreeLatencyMaxNSPrefix] = []int64{kallocfreeResult.MaxFreeLatency.Nanoseconds()}
+	}
+	if *warmColdFlag {
+		result[kernelPageAllocWarmLatenciesNSPrefix] = nanoseconds(kallocfreeResult.WarmAllocLatencies)
+		result[kernelPageAllocColdLatenciesNSPrefix] = nanoseconds(kallocfreeResult.ColdAllocLatencies)
+	}
+}
+
+// Summary statistics for a multi-valued metric.
+type summary struct {
+	samples  int
+	sum      int64
+	mean     float64
+	median   int64
+	p95      int64
+	max, min int64
+	sorted   []int64
+	// Sample standard deviation, zero if there's only one sample.
+	stddev float64
+	// Half-width of the 95% confidence interval for the mean.
+	ci95 float64
+}
+
+// Two-tailed 95% critical values of Student's t-distribution, indexed by
+// degrees of freedom minus one. Beyond the end the normal approximation is
+// close enough.
+var tCritical95 = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// Returns the half-width of the 95% confidence interval for the mean of n
+// samples with the given sample standard deviation. The samples are few
+// (--iterations defaults to 5) so this uses the t-distribution.
+func confidenceInterval95(stddev float64, n int) float64 {
+	if n < 2 {
+		return 0
+	}
+	t := 1.960
+	if n-2 < len(tCritical95) {
+		t = tCritical95[n-2]
+	}
+	return t * stddev / math.Sqrt(float64(n))
+}
+
+// Percentiles to print, parsed from --percentiles.
+var percentiles []float64
+
+// Parses a comma-separated list of percentiles. The result is sorted and
+// deduplicated.
+func parsePercentiles(s string) ([]float64, error) {
+	var ps []float64
+	for _, str := range strings.Split(s, ",") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad percentile %q, want a number: %v", str, err)
+		}
+		if !(p > 0 && p <= 100) { // Careful to reject NaN.
+			return nil, fmt.Errorf("bad percentile %q, must be in (0, 100]", str)
+		}
+		ps = append(ps, p)
+	}
+	slices.Sort(ps)
+	return slices.Compact(ps), nil
+}
+
+// Returns the value at the given percentile. p100 is the max.
+func (s *summary) percentile(p float64) int64 {
+	idx := int(float64(len(s.sorted)) * p / 100)
+	return s.sorted[min(max(idx, 0), len(s.sorted)-1)]
+}
+
+// vals must not be empty.
+func summarize(vals []int64) summary {
 	sum := int64(0)
 	max := int64(math.MinInt64)
 	min := int64(math.MaxInt64)
@@ -154,32 +682,187 @@ func printAverages(name string, vals []int64) {
 		sum += val
 	}
 
+	mean := float64(sum) / float64(len(vals))
+	var stddev float64
+	if len(vals) > 1 {
+		sumSquares := 0.0
+		for _, val := range vals {
+			sumSquares += (float64(val) - mean) * (float64(val) - mean)
+		}
+		stddev = math.Sqrt(sumSquares / float64(len(vals)-1))
+	}
+
 	sorted := slices.Clone(vals)
 	slices.Sort(sorted)
-	mean := float64(sum) / float64(len(vals))
-	median := sorted[len(sorted)/2]
-	p95 := sorted[(len(sorted)*95)/100]
-	fmt.Printf("%q:\n\tsamples: %d\n\tmean: %12.02f\n\tmed: %12d\n\tp95: %12d\n\tmax: %12d\n\tmin: %12d\n",
-		name, len(vals), mean, median, p95, max, min)
+	return summary{
+		samples: len(vals),
+		sum:     sum,
+		mean:    mean,
+		median:  sorted[len(sorted)/2],
+		p95:     sorted[(len(sorted)*95)/100],
+		max:     max,
+		min:     min,
+		sorted:  sorted,
+		stddev:  stddev,
+		ci95:    confidenceInterval95(stddev, len(vals)),
+	}
+}
+
+// If MemAvailable is this fraction of MemTotal lower after the run than before,
+// the system is considered not to have recovered.
+const teardownTolerance = 0.01
+
+// Compares /proc/meminfo snapshots from before and after the run, returns
+// metrics for how much memory availability changed. Prints a warning if it
+// looks like the system didn't return to its baseline, which suggests that the
+// benchmark leaked memory or left it badly fragmented.
+func verifyTeardown(before, after *linux.Meminfo) map[string][]int64 {
+	availableDelta := after.MemAvailable() - before.MemAvailable()
+	freeDelta := after.MemFree() - before.MemFree()
+	if float64(-availableDelta) > float64(before.MemTotal())*teardownTolerance {
+		fmt.Fprintf(os.Stderr, "WARNING: MemAvailable is %v lower than before the benchmark (%v -> %v). "+
+			"Memory leaked? Consider rebooting before running again.\n",
+			-availableDelta, before.MemAvailable(), after.MemAvailable())
+	}
+	return map[string][]int64{
+		teardownMemAvailableDeltaPrefix: {availableDelta.Bytes()},
+		teardownMemFreeDeltaPrefix:      {freeDelta.Bytes()},
+	}
 }
 
-func printResult(result map[string][]int64) {
-	// Print in order sorted by last character, so that all _orderN
-	// metrics for same N get printed together.
+func printAverages(name string, vals []int64, latencyUnit pab.TimeUnit) {
+	if len(vals) == 0 {
+		fmt.Printf("No values for metric %q\n", name)
+		return
+	}
+	s := summarize(vals)
+	if isLatencyMetric(name) {
+		unit := latencyUnit
+		if unit == pab.AutoTimeUnit {
+			unit = pab.UnitFor(time.Duration(s.median))
+		}
+		f := func(ns int64) string { return pab.FormatDuration(time.Duration(ns), unit) }
+		fmt.Printf("%q:\n\tsamples: %d\n\tmean: %12s\n\tmed: %12s\n", name, s.samples, f(int64(s.mean)), f(s.median))
+		for _, p := range percentiles {
+			fmt.Printf("\tp%v: %12s\n", p, f(s.percentile(p)))
+		}
+		fmt.Printf("\tmax: %12s\n\tmin: %12s\n", f(s.max), f(s.min))
+		fmt.Printf("\tstddev: %12s\n\tmean 95%% CI: %s - %s\n",
+			f(int64(s.stddev)), f(int64(s.mean-s.ci95)), f(int64(s.mean+s.ci95)))
+		return
+	}
+	fmt.Printf("%q:\n\tsamples: %d\n\tmean: %12.02f\n\tmed: %12d\n", name, s.samples, s.mean, s.median)
+	for _, p := range percentiles {
+		fmt.Printf("\tp%v: %12d\n", p, s.percentile(p))
+	}
+	fmt.Printf("\tmax: %12d\n\tmin: %12d\n", s.max, s.min)
+	fmt.Printf("\tstddev: %12.02f\n\tmean 95%% CI: %.02f - %.02f\n", s.stddev, s.mean-s.ci95, s.mean+s.ci95)
+}
+
+// If latency or failure rate grows by more than this factor from one order to
+// the next, that's flagged as a jump in the order comparison.
+const orderJumpFactor = 2.0
+
+// One row of the order comparison table.
+type orderComparison struct {
+	order       int
+	medianNS    int64
+	p95NS       int64
+	failureRate float64 // Fraction of allocation attempts that failed.
+	jump        bool    // Sharply more expensive than the previous order.
+}
+
+func grewSharply(prev, cur float64) bool {
+	if prev <= 0 {
+		return false
+	}
+	return cur > prev*orderJumpFactor
+}
+
+// Builds the order comparison table from per-order results, in increasing order
+// of order. Orders without latency data are skipped.
+func compareOrders(results map[int]map[string][]int64) []orderComparison {
+	var orders []int
+	for order := range results {
+		orders = append(orders, order)
+	}
+	slices.Sort(orders)
+
+	var rows []orderComparison
+	for _, order := range orders {
+		result := results[order]
+		latencies := result[kernelPageAllocLatenciesNSPrefix]
+		if len(latencies) == 0 {
+			continue
+		}
+		s := summarize(latencies)
+		row := orderComparison{order: order, medianNS: s.median, p95NS: s.p95}
+		if allocs, failures := result[kernelPageAllocsPrefix], result[kernelAllocFailuresPrefix]; len(allocs) > 0 && len(failures) > 0 {
+			if attempts := allocs[0] + failures[0]; attempts > 0 {
+				row.failureRate = float64(failures[0]) / float64(attempts)
+			}
+		}
+		if len(rows) > 0 {
+			prev := rows[len(rows)-1]
+			row.jump = grewSharply(float64(prev.medianNS), float64(row.medianNS)) ||
+				grewSharply(float64(prev.p95NS), float64(row.p95NS)) ||
+				grewSharply(prev.failureRate, row.failureRate) ||
+				(prev.failureRate == 0 && row.failureRate > 0)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func printOrderComparison(results map[int]map[string][]int64, latencyUnit pab.TimeUnit) {
+	rows := compareOrders(results)
+	if len(rows) < 2 {
+		return
+	}
+	fmt.Printf("Order comparison (alloc latency and failure rate):\n")
+	fmt.Printf("\t%5s %12s %12s %10s\n", "order", "med", "p95", "failures")
+	for _, row := range rows {
+		jump := ""
+		if row.jump {
+			jump = "  <-- jump"
+		}
+		fmt.Printf("\t%5d %12s %12s %9.3f%%%s\n", row.order,
+			pab.FormatDuration(time.Duration(row.medianNS), latencyUnit),
+			pab.FormatDuration(time.Duration(row.p95NS), latencyUnit),
+			row.failureRate*100, jump)
+	}
+}
+
+// Returns the keys of result in the order printResult prints them: by order, so
+// that all _orderN metrics for same N are together, then by name. Metrics
+// without an order come first.
+func sortedResultKeys(result map[string][]int64) []string {
 	keys := []string{}
-	for key, _ := range result {
+	for key := range result {
 		keys = append(keys, key)
 	}
 	slices.SortFunc(keys, func(k1, k2 string) int {
-		// Careful - indexing a string gives you a byte which is
-		// unsigned. Need to convert to int _before_ subtracting.
-		return int(k1[len(k1)-1]) - int(k2[len(k2)-1])
+		m1, o1, ok1 := splitMetricKey(k1)
+		m2, o2, ok2 := splitMetricKey(k2)
+		if ok1 != ok2 {
+			if ok1 {
+				return 1
+			}
+			return -1
+		}
+		if o1 != o2 {
+			return o1 - o2
+		}
+		return strings.Compare(m1, m2)
 	})
+	return keys
+}
 
-	for _, key := range keys {
+func printResult(result map[string][]int64, latencyUnit pab.TimeUnit) {
+	for _, key := range sortedResultKeys(result) {
 		val := result[key]
 		if len(val) > 1 {
-			printAverages(key, val)
+			printAverages(key, val, latencyUnit)
 		} else if len(val) > 0 {
 			fmt.Printf("%q: %v\n", key, val[0])
 		} else {
@@ -188,8 +871,124 @@ func printResult(result map[string][]int64) {
 	}
 }
 
-func writeOutput(path string, result map[string][]int64) error {
-	output, err := json.Marshal(result)
+// Memory for the kallocfree workload, split between the CPUs. Set by
+// --total-memory, or its alias --kernel-memory.
+var kallocfreeTotalMemory = 128 * pab.Megabyte
+
+// See kallocfree.Options.FillToMemFree. Set by --fill-to-mem-free.
+var kallocfreeFillToMemFree pab.ByteSize
+
+// See findlimit.Options.StopAt. Set by --findlimit-stop-at.
+var findlimitStopAt pab.ByteSize
+
+// See findlimit.Options.ChurnWindow. Set by --findlimit-churn-window.
+var findlimitChurnWindow pab.ByteSize
+
+func init() {
+	flag.Var(&kallocfreeTotalMemory, "total-memory", "Memory for the kernel antagonist, split between the CPUs. Accepts units, e.g. 256MiB.")
+	flag.Var(&kallocfreeTotalMemory, "kernel-memory", "Alias for --total-memory.")
+	flag.Var(&kallocfreeFillToMemFree, "fill-to-mem-free", "If set, the kernel antagonist allocates and holds pages until MemFree is below this (e.g. 2GiB), instead of allocating and freeing continuously.")
+	flag.Var(&findlimitStopAt, "findlimit-stop-at", "If set, the findlimit workload stops once it has allocated this much (e.g. 16GiB), instead of running until it gets OOM-killed.")
+	flag.Var(&findlimitChurnWindow, "findlimit-churn-window", "If set, the findlimit workload only keeps this much memory mapped, repeatedly dropping and refaulting it until it has faulted in --findlimit-stop-at in total, which is required.")
+}
+
+// Describes how a result was produced, so the JSON output is self-describing.
+type outputConfig struct {
+	Version string `json:"version"`
+	// Every flag's value, including defaults.
+	Flags                      map[string]string `json:"flags"`
+	NumCPUs                    int               `json:"num_cpus"`
+	PageSizeBytes              int64             `json:"page_size_bytes"`
+	KallocfreeTotalMemoryBytes int64             `json:"kallocfree_total_memory_bytes"`
+	// Orders that the benchmark was run for. Empty for --profile and
+	// --idle-only.
+	Orders []int `json:"orders,omitempty"`
+	// The order weights for --profile.
+	OrderWeights map[int]float64 `json:"order_weights,omitempty"`
+	// Transparent hugepage mode. Omitted if the kernel doesn't have THP.
+	THPMode string `json:"thp_mode,omitempty"`
+	// Upper bounds of the kernel_page_alloc_latency_histogram buckets,
+	// excluding the final +Inf one. Only for --latency-histogram.
+	LatencyHistogramBoundsNS []int64 `json:"latency_histogram_bounds_ns,omitempty"`
+	// The cgroup v2 memory.max limit on the process, if there is one. The
+	// findlimit workload will probably hit this before the system runs out
+	// of memory.
+	CgroupMemoryMaxBytes int64 `json:"cgroup_memory_max_bytes,omitempty"`
+	// Set if the run was interrupted with Ctrl-C, so the metrics only cover
+	// the orders that completed.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// Returns the config for the current process. The args are the parsed forms of
+// some flags.
+func currentConfig(orders []int, orderWeights map[int]float64) *outputConfig {
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	thpMode, err := linux.THPMode()
+	if err != nil && !errors.Is(err, linux.ErrNoTHP) {
+		fmt.Fprintf(os.Stderr, "Couldn't read THP mode for output: %v\n", err)
+	}
+	cgroupMemoryMax, err := linux.CgroupMemoryMax()
+	if err != nil && !errors.Is(err, linux.ErrNoCgroupV2) {
+		fmt.Fprintf(os.Stderr, "Couldn't read cgroup memory limit for output: %v\n", err)
+	}
+	config := &outputConfig{
+		CgroupMemoryMaxBytes:       max(cgroupMemoryMax.Bytes(), 0),
+		THPMode:                    thpMode,
+		Version:                    version(),
+		Flags:                      flags,
+		NumCPUs:                    runtime.NumCPU(),
+		PageSizeBytes:              pab.PageSize().Bytes(),
+		KallocfreeTotalMemoryBytes: kallocfreeTotalMemory.Bytes(),
+		Orders:                     orders,
+		OrderWeights:               orderWeights,
+	}
+	if *latencyHistogramFlag {
+		for _, bound := range latencyHistogramBounds() {
+			config.LatencyHistogramBoundsNS = append(config.LatencyHistogramBoundsNS, bound.Nanoseconds())
+		}
+	}
+	return config
+}
+
+// Top level of the JSON output.
+type jsonOutput struct {
+	Config  *outputConfig      `json:"config"`
+	Metrics map[string][]int64 `json:"metrics"`
+	// Summary statistics for each metric with more than one value.
+	Summaries map[string]*jsonSummary `json:"summaries,omitempty"`
+}
+
+// Dispersion of a multi-valued metric in the JSON output.
+type jsonSummary struct {
+	Mean   float64 `json:"mean"`
+	Stddev float64 `json:"stddev"`
+	// Bounds of the 95% confidence interval for the mean.
+	CI95Low  float64 `json:"ci95_low"`
+	CI95High float64 `json:"ci95_high"`
+}
+
+func summariesForJSON(result map[string][]int64) map[string]*jsonSummary {
+	summaries := make(map[string]*jsonSummary)
+	for key, vals := range result {
+		if len(vals) < 2 {
+			continue
+		}
+		s := summarize(vals)
+		summaries[key] = &jsonSummary{
+			Mean:     s.mean,
+			Stddev:   s.stddev,
+			CI95Low:  s.mean - s.ci95,
+			CI95High: s.mean + s.ci95,
+		}
+	}
+	return summaries
+}
+
+func writeOutput(path string, config *outputConfig, result map[string][]int64) error {
+	output, err := json.Marshal(&jsonOutput{Config: config, Metrics: result, Summaries: summariesForJSON(result)})
 	if err != nil {
 		return fmt.Errorf("marshalling JSON output: %v", err)
 	}
@@ -209,10 +1008,45 @@ func version() string {
 	return "<no vcs.revision in Go build info>"
 }
 
+// Parses --housekeeping-cpus. Returns the housekeeping CPUs, and the rest of
+// the allowed CPUs, which the kallocfree workers run on.
+func splitHousekeepingCPUs(allowed linux.CPUMask, spec string) (linux.CPUMask, linux.CPUMask, error) {
+	housekeeping, err := linux.CPUMaskFromString(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if housekeeping.Intersect(allowed).Count() == 0 {
+		return nil, nil, fmt.Errorf("none of %s are allowed (%s)", housekeeping, allowed)
+	}
+	workers := allowed.Difference(housekeeping)
+	if workers.Count() == 0 {
+		return nil, nil, fmt.Errorf("no CPUs left for the workers after taking out %s (allowed: %s)", housekeeping, allowed)
+	}
+	return housekeeping, workers, nil
+}
+
 func doMain() error {
 	fmt.Printf("page_alloc_bench built from version: %v\n", version())
+	if limit, err := linux.CgroupMemoryMax(); err == nil && limit >= 0 {
+		fmt.Printf("Note: running in a cgroup with a memory limit of %v, findlimit will measure that rather than the system's memory\n", limit)
+	}
 
-	ctx := context.Background()
+	// On Ctrl-C, cancel the run but still output what we've got. A second
+	// Ctrl-C kills the process as usual.
+	sigCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stopSignals()
+	// Returns whether a run was cut short by Ctrl-C. Some workloads just
+	// return early without an error when cancelled, so this doesn't rely
+	// on err.
+	interrupted := func(err error) bool {
+		if sigCtx.Err() == nil {
+			return false
+		}
+		stopSignals()
+		fmt.Fprintf(os.Stderr, "Interrupted, outputting partial results (%v)\n", err)
+		return true
+	}
+	ctx := sigCtx
 	if *timeoutSFlag != 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, time.Duration(*timeoutSFlag)*time.Second)
@@ -232,26 +1066,288 @@ func doMain() error {
 		orders = append(orders, o)
 	}
 
-	result := make(map[string][]int64)
-	for _, order := range orders {
-		orderResult, err := run(ctx, order)
+	if *findlimitConcurrencyFlag < 1 {
+		return fmt.Errorf("--findlimit-concurrency must be at least 1")
+	}
+	setFindlimitConcurrency(int64(*findlimitConcurrencyFlag))
+
+	if *statsLogFlag != "" {
+		var err error
+		statsLogInterval, err = parseStatsLogInterval(*statsLogIntervalMSFlag)
 		if err != nil {
+			return fmt.Errorf("--stats-log-interval-ms: %v", err)
+		}
+	}
+
+	switch *outputFormatFlag {
+	case "json", "csv", "gobench":
+	default:
+		return fmt.Errorf("--output-format must be json, csv or gobench, got %q", *outputFormatFlag)
+	}
+
+	var err error
+	percentiles, err = parsePercentiles(*percentilesFlag)
+	if err != nil {
+		return fmt.Errorf("--percentiles: %v", err)
+	}
+
+	if *thpModeFlag != "" {
+		oldMode, err := linux.THPMode()
+		if err != nil {
+			return fmt.Errorf("--thp-mode: %v", err)
+		}
+		if err := linux.SetTHPMode(*thpModeFlag); err != nil {
+			return fmt.Errorf("--thp-mode: %v", err)
+		}
+		defer func() {
+			if err := linux.SetTHPMode(oldMode); err != nil {
+				fmt.Fprintf(os.Stderr, "Couldn't restore THP mode to %q: %v\n", oldMode, err)
+			}
+		}()
+	}
+
+	touchPattern, err = findlimit.ParseTouchPattern(*touchPatternFlag)
+	if err != nil {
+		return fmt.Errorf("--touch-pattern: %v", err)
+	}
+
+	latencyUnit, err := pab.ParseTimeUnit(*latencyUnitFlag)
+	if err != nil {
+		return fmt.Errorf("--latency-unit: %v", err)
+	}
+
+	var profileWeights map[int]float64
+	if *profileFlag != "" {
+		var ok bool
+		profileWeights, ok = kallocfree.Profiles[*profileFlag]
+		if !ok {
+			return fmt.Errorf("unknown --profile %q", *profileFlag)
+		}
+	}
+
+	devices := strings.Split(*kmodDevicesFlag, ",")
+
+	// Remember this before restricting to the housekeeping CPUs, the
+	// findlimit child goes back to it.
+	origCPUs, err := linux.SchedGetaffinity(linux.PIDCallingThread)
+	if err != nil {
+		return fmt.Errorf("getting CPU affinity: %v", err)
+	}
+	workerCPUs := origCPUs
+	if *housekeepingCPUsFlag != "" {
+		var housekeeping linux.CPUMask
+		housekeeping, workerCPUs, err = splitHousekeepingCPUs(origCPUs, *housekeepingCPUsFlag)
+		if err != nil {
+			return fmt.Errorf("--housekeeping-cpus: %v", err)
+		}
+		// The kallocfree workers pin themselves to their own CPUs, this
+		// is for everything else (GC workers, sysmon, etc).
+		if err := linux.SetProcessAffinity(housekeeping); err != nil {
+			return fmt.Errorf("restricting to housekeeping CPUs: %v", err)
+		}
+		findlimitCPUs = origCPUs
+	}
+
+	kallocfreeOpts := kallocfree.Options{
+		MeasureLatencies:      *latenciesFlag,
+		MeasureWarmCold:       *warmColdFlag,
+		CrossCPUFree:          *crossCPUFreeFlag,
+		FallbackOrders:        *fallbackOrdersFlag,
+		FillToMemFree:         kallocfreeFillToMemFree,
+		ProbeMaxOrderInterval: time.Duration(*probeMaxOrderMSFlag) * time.Millisecond,
+		CPUs:                  workerCPUs,
+		SamplingSeed:          *samplingSeedFlag,
+		VerifyContents:        *verifyPageContentsFlag,
+		TargetPages:           *kernelTargetPagesFlag,
+		SwingPages:            *kernelSwingPagesFlag,
+		NoFree:                *kernelNoFreeFlag,
+	}
+	if *latencyHistogramFlag {
+		kallocfreeOpts.LatencyHistogramBounds = latencyHistogramBounds()
+	}
+	if *kernelAllocNodeFlag >= 0 {
+		kallocfreeOpts.AllocNode = kernelAllocNodeFlag
+	}
+	kallocfreeOpts.GFP, err = kmod.ParseGFP(*kernelGFPFlag)
+	if err != nil {
+		return fmt.Errorf("--kernel-gfp: %v", err)
+	}
+	if *saveNUMATopologyFlag != "" {
+		cpuToNode, err := linux.CPUToNode()
+		if err != nil {
+			return fmt.Errorf("reading NUMA topology: %v", err)
+		}
+		if err := linux.WriteCPUToNode(*saveNUMATopologyFlag, cpuToNode); err != nil {
+			return fmt.Errorf("saving NUMA topology: %v", err)
+		}
+	}
+	if *loadNUMATopologyFlag != "" {
+		kallocfreeOpts.CPUToNode, err = linux.ReadCPUToNode(*loadNUMATopologyFlag)
+		if err != nil {
+			return fmt.Errorf("loading NUMA topology: %v", err)
+		}
+	}
+
+	meminfoBefore, err := linux.ReadMeminfo()
+	if err != nil {
+		return fmt.Errorf("reading meminfo: %v", err)
+	}
+
+	if *httpAddrFlag != "" {
+		if err := serveStats(ctx, *httpAddrFlag); err != nil {
+			return fmt.Errorf("--http-addr: %v", err)
+		}
+	}
+
+	var stream *resultStream
+	if *streamOutputFlag != "" {
+		stream, err = openResultStream(*streamOutputFlag)
+		if err != nil {
+			return fmt.Errorf("--stream-output: %v", err)
+		}
+		defer stream.close()
+	}
+
+	result := make(map[string][]int64)
+	// Per device, for the order comparison.
+	orderResults := make([]map[int]map[string][]int64, len(devices))
+	// Set if the run was cut short by Ctrl-C. Results for whatever orders
+	// had completed are still output.
+	partial := false
+	if *idleOnlyFlag {
+		// The idle assessment doesn't depend on the order, so only do
+		// it once and don't suffix the metrics.
+		idleResult, err := runIdleOnly(ctx)
+		if interrupted(err) {
+			partial = true
+		} else if err != nil {
 			return err
+		} else {
+			result = idleResult
+			if err := stream.write(result, nil); err != nil {
+				return err
+			}
 		}
+	} else {
+	devicesLoop:
+		for i, device := range devices {
+			// Only tag the results with the instance when there's
+			// more than one, so the common case is less noisy.
+			instance := ""
+			if len(devices) > 1 {
+				instance = fmt.Sprintf("_instance%d", i)
+				fmt.Printf("Running against kernel module instance %d (%s)\n", i, device)
+			}
+			orderResults[i] = make(map[int]map[string][]int64)
 
-		for key, val := range orderResult {
-			result[fmt.Sprintf("%s_order%d", key, order)] = val
+			if profileWeights != nil {
+				opts := kallocfreeOpts
+				opts.OrderWeights = profileWeights
+				opts.DevicePath = device
+				profileResult, err := run(ctx, opts)
+				if interrupted(err) {
+					partial = true
+					break devicesLoop
+				}
+				if err != nil {
+					return err
+				}
+				streamed := make(map[string][]int64)
+				for key, val := range profileResult {
+					name := fmt.Sprintf("%s%s_%s", key, instance, *profileFlag)
+					streamed[name] = val
+					result[name] = val
+				}
+				if err := stream.write(streamed, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			for _, order := range orders {
+				opts := kallocfreeOpts
+				opts.Order = order
+				opts.DevicePath = device
+				orderResult, err := run(ctx, opts)
+				if interrupted(err) {
+					partial = true
+					break devicesLoop
+				}
+				if err != nil {
+					return err
+				}
+				orderResults[i][order] = orderResult
+
+				streamed := make(map[string][]int64)
+				for key, val := range orderResult {
+					streamed[key+instance] = val
+					result[fmt.Sprintf("%s%s_order%d", key, instance, order)] = val
+				}
+				if err := stream.write(streamed, &order); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
-	printResult(result)
+	meminfoAfter, err := linux.ReadMeminfo()
+	if err != nil {
+		return fmt.Errorf("reading meminfo: %v", err)
+	}
+	teardown := verifyTeardown(meminfoBefore, meminfoAfter)
+	for key, val := range teardown {
+		result[key] = val
+	}
+	if err := stream.write(teardown, nil); err != nil {
+		return err
+	}
+
+	printResult(result, latencyUnit)
+	for i, device := range devices {
+		if len(devices) > 1 && len(orderResults[i]) > 1 {
+			fmt.Printf("Kernel module instance %d (%s):\n", i, device)
+		}
+		printOrderComparison(orderResults[i], latencyUnit)
+	}
 
+	if *foldedLatencyPathFlag != "" {
+		if err := writeFoldedLatencies(*foldedLatencyPathFlag); err != nil {
+			return err
+		}
+	}
+	if *prometheusPathFlag != "" {
+		if err := writePrometheus(*prometheusPathFlag, result); err != nil {
+			return err
+		}
+	}
 	if *outputPathFlag != "" {
-		return writeOutput(*outputPathFlag, result)
+		// The orders don't apply when they're overridden.
+		var configOrders []int
+		if !*idleOnlyFlag && profileWeights == nil {
+			configOrders = orders
+		}
+		config := currentConfig(configOrders, profileWeights)
+		config.Partial = partial
+		if err := writeResultFile(*outputPathFlag, config, result); err != nil {
+			return err
+		}
+	}
+	if partial {
+		return fmt.Errorf("interrupted, results are partial")
 	}
 	return nil
 }
 
+// Writes the result to --output-path in the --output-format.
+func writeResultFile(path string, config *outputConfig, result map[string][]int64) error {
+	switch *outputFormatFlag {
+	case "csv":
+		return writeCSV(path, result)
+	case "gobench":
+		return writeGoBench(path, result)
+	}
+	return writeOutput(path, config, result)
+}
+
 func main() {
 	flag.Parse()
 
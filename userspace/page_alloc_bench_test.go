@@ -0,0 +1,577 @@
+// Copyright 2023 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/page_alloc_bench/linux"
+	"github.com/google/page_alloc_bench/pab"
+	"github.com/google/page_alloc_bench/workload/findlimit"
+	"github.com/google/page_alloc_bench/workload/kallocfree"
+)
+
+func TestUnusableFreeIndex(t *testing.T) {
+	zones := []linux.BuddyinfoZone{
+		// 4 free pages at order 0, 2 blocks (4 pages) at order 1.
+		{Node: 0, Zone: "DMA32", FreeByOrder: [linux.BuddyinfoOrders]int64{4, 2}},
+		// 1 block (8 pages) at order 3.
+		{Node: 0, Zone: "Normal", FreeByOrder: [linux.BuddyinfoOrders]int64{0, 0, 0, 1}},
+	}
+	// 16 free pages in total.
+	for _, tc := range []struct {
+		order int
+		want  float64
+	}{
+		{order: 0, want: 0},
+		{order: 1, want: 4.0 / 16},
+		{order: 2, want: 8.0 / 16},
+		{order: 3, want: 8.0 / 16},
+		{order: 4, want: 1},
+	} {
+		if got := unusableFreeIndex(zones, tc.order); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("unusableFreeIndex(order %d) = %v, want %v", tc.order, got, tc.want)
+		}
+	}
+	if got := unusableFreeIndex(nil, 0); got != 1 {
+		t.Errorf("unusableFreeIndex with no free memory = %v, want 1", got)
+	}
+}
+
+// Installs a shell script as the findlimit child for the duration of the test.
+// The script runs in a fresh directory, which it can use for state.
+func stubFindlimitChild(t *testing.T, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "child")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\ncd "+dir+"\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldPath, oldSem, oldConcurrency, oldTimeout := findlimitChildPath, findlimitSem, findlimitConcurrency, *iterationTimeoutSFlag
+	t.Cleanup(func() {
+		findlimitChildPath, findlimitSem, findlimitConcurrency, *iterationTimeoutSFlag = oldPath, oldSem, oldConcurrency, oldTimeout
+	})
+	findlimitChildPath = path
+	setFindlimitConcurrency(1)
+}
+
+// Reports 4096 bytes allocated then dies like it was OOM-killed.
+const oomingChild = "echo 4096\nkill -KILL $$\n"
+
+func TestRepeatFindlimitIterationTimeout(t *testing.T) {
+	// The first iteration hangs, the rest succeed.
+	stubFindlimitChild(t, "if mkdir hung 2>/dev/null; then exec sleep 1000; fi\n"+oomingChild)
+	*iterationTimeoutSFlag = 1
+
+	results, timeouts, err := repeatFindlimit(context.Background(), 3, "idle", 0)
+	if err != nil {
+		t.Fatalf("repeatFindlimit: %v", err)
+	}
+	if timeouts != 1 {
+		t.Errorf("got %d timeouts, want 1", timeouts)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, r := range results {
+		if r.Allocated != 4096 {
+			t.Errorf("got result of %v allocated, want 4096 bytes", r.Allocated)
+		}
+	}
+
+	metrics := make(map[string][]int64)
+	addFindlimitMetrics(metrics, results, timeouts, idleFindlimitPrefixes)
+	if got := metrics[idleTimeoutsPrefix]; len(got) != 1 || got[0] != 1 {
+		t.Errorf("got %s %v, want [1]", idleTimeoutsPrefix, got)
+	}
+	if got := metrics[idleAvailableBytesPrefix]; len(got) != 2 {
+		t.Errorf("got %s %v, want 2 values", idleAvailableBytesPrefix, got)
+	}
+}
+
+func TestRepeatFindlimitConcurrency(t *testing.T) {
+	const k = 2
+	// Each child records how many children are running when it starts.
+	stubFindlimitChild(t, `mkdir running.$$
+ls -d running.* | wc -l >> counts
+sleep 0.3
+rmdir running.$$
+`+oomingChild)
+	setFindlimitConcurrency(k)
+
+	results, timeouts, err := repeatFindlimit(context.Background(), 6, "idle", 0)
+	if err != nil {
+		t.Fatalf("repeatFindlimit: %v", err)
+	}
+	if len(results) != 6 || timeouts != 0 {
+		t.Errorf("got %d results and %d timeouts, want 6 and 0", len(results), timeouts)
+	}
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(findlimitChildPath), "counts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxRunning := 0
+	for _, line := range strings.Fields(string(data)) {
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			t.Fatalf("bad count %q from child: %v", line, err)
+		}
+		maxRunning = max(maxRunning, n)
+	}
+	if maxRunning > k {
+		t.Errorf("%d children ran at once, want at most %d", maxRunning, k)
+	}
+	if maxRunning < 2 {
+		t.Errorf("children never ran concurrently")
+	}
+}
+
+func TestRepeatFindlimitDropCaches(t *testing.T) {
+	stubFindlimitChild(t, `mkdir running.$$
+sleep 0.2
+rmdir running.$$
+`+oomingChild)
+	setFindlimitConcurrency(2)
+	oldDrop, oldFlag := dropCaches, *dropCachesFlag
+	t.Cleanup(func() { dropCaches, *dropCachesFlag = oldDrop, oldFlag })
+	*dropCachesFlag = true
+	// Records how many children were running at each drop.
+	var running []int
+	dropCaches = func(mode int) error {
+		matches, err := filepath.Glob(filepath.Join(filepath.Dir(findlimitChildPath), "running.*"))
+		if err != nil {
+			return err
+		}
+		running = append(running, len(matches))
+		return nil
+	}
+
+	results, _, err := repeatFindlimit(context.Background(), 4, "idle", 0)
+	if err != nil {
+		t.Fatalf("repeatFindlimit: %v", err)
+	}
+	if len(results) != 4 {
+		t.Errorf("got %d results, want 4", len(results))
+	}
+	if !slices.Equal(running, []int{0, 0, 0, 0}) {
+		t.Errorf("got %v children running when caches were dropped, want none each time", running)
+	}
+}
+
+func TestRunIdleOnly(t *testing.T) {
+	stubFindlimitChild(t, oomingChild)
+	oldIterations := *iterationsFlag
+	t.Cleanup(func() { *iterationsFlag = oldIterations })
+	*iterationsFlag = 2
+
+	result, err := runIdleOnly(context.Background())
+	if err != nil {
+		t.Fatalf("runIdleOnly: %v", err)
+	}
+	if got := result[idleAvailableBytesPrefix]; !slices.Equal(got, []int64{4096, 4096}) {
+		t.Errorf("got %s %v, want [4096 4096]", idleAvailableBytesPrefix, got)
+	}
+	for key := range result {
+		if !strings.HasPrefix(key, "idle_") {
+			t.Errorf("got metric %q from the idle-only run", key)
+		}
+	}
+}
+
+func TestKernelMemoryFlag(t *testing.T) {
+	old := kallocfreeTotalMemory
+	t.Cleanup(func() { kallocfreeTotalMemory = old })
+	if kallocfreeTotalMemory != 128*pab.Megabyte {
+		t.Errorf("default kernel memory is %v, want 128MiB", kallocfreeTotalMemory)
+	}
+	for _, tc := range []struct {
+		name, value string
+		want        pab.ByteSize
+	}{
+		{name: "total-memory", value: "256MiB", want: 256 * pab.Megabyte},
+		{name: "kernel-memory", value: "1GiB", want: pab.Gigabyte},
+	} {
+		if err := flag.CommandLine.Set(tc.name, tc.value); err != nil {
+			t.Fatalf("setting --%s=%s: %v", tc.name, tc.value, err)
+		}
+		if kallocfreeTotalMemory != tc.want {
+			t.Errorf("after --%s=%s, kernel memory is %v, want %v", tc.name, tc.value, kallocfreeTotalMemory, tc.want)
+		}
+	}
+	if err := flag.CommandLine.Set("kernel-memory", "lots"); err == nil {
+		t.Errorf("--kernel-memory=lots was accepted")
+	}
+}
+
+func TestAddKallocfreeMetricsLatencies(t *testing.T) {
+	res := &kallocfree.Result{
+		AllocLatencies:  []time.Duration{100, 200, 300},
+		FreeLatencies:   []time.Duration{10, 20, 30, 40, 50},
+		MinAllocLatency: 100,
+		MaxAllocLatency: 300,
+		MinFreeLatency:  10,
+		MaxFreeLatency:  50,
+		KmodBytesHeld:   -1,
+	}
+	result := make(map[string][]int64)
+	addKallocfreeMetrics(result, res, &kallocfree.Options{})
+
+	for _, tc := range []struct {
+		key  string
+		want []int64
+	}{
+		{key: kernelPageAllocLatenciesNSPrefix, want: []int64{100, 200, 300}},
+		{key: kernelPageFreeLatenciesNSPrefix, want: []int64{10, 20, 30, 40, 50}},
+		{key: kernelPageAllocLatencyMinNSPrefix, want: []int64{100}},
+		{key: kernelPageFreeLatencyMaxNSPrefix, want: []int64{50}},
+	} {
+		got, ok := result[tc.key]
+		if !ok {
+			t.Errorf("no %s metric", tc.key)
+			continue
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s = %v, want %v", tc.key, got, tc.want)
+		}
+	}
+	if _, ok := result[kernelKmodBytesHeldPrefix]; ok {
+		t.Errorf("got %s for a kmod that doesn't report it", kernelKmodBytesHeldPrefix)
+	}
+}
+
+func TestCompareOrders(t *testing.T) {
+	results := map[int]map[string][]int64{
+		0: {
+			kernelPageAllocLatenciesNSPrefix: {100, 100, 100},
+			kernelPageAllocsPrefix:           {1000},
+			kernelAllocFailuresPrefix:        {0},
+		},
+		// No latencies, skipped.
+		1: {kernelPageAllocsPrefix: {1000}},
+		// A bit slower, not a jump.
+		2: {
+			kernelPageAllocLatenciesNSPrefix: {150, 150, 150},
+			kernelPageAllocsPrefix:           {1000},
+			kernelAllocFailuresPrefix:        {0},
+		},
+		// Same latency but starts failing.
+		3: {
+			kernelPageAllocLatenciesNSPrefix: {150, 150, 150},
+			kernelPageAllocsPrefix:           {990},
+			kernelAllocFailuresPrefix:        {10},
+		},
+		// Much slower.
+		4: {
+			kernelPageAllocLatenciesNSPrefix: {150, 150, 1000},
+			kernelPageAllocsPrefix:           {990},
+			kernelAllocFailuresPrefix:        {10},
+		},
+	}
+	want := []orderComparison{
+		{order: 0, medianNS: 100, p95NS: 100},
+		{order: 2, medianNS: 150, p95NS: 150},
+		{order: 3, medianNS: 150, p95NS: 150, failureRate: 0.01, jump: true},
+		{order: 4, medianNS: 150, p95NS: 1000, failureRate: 0.01, jump: true},
+	}
+	if got := compareOrders(results); !slices.Equal(got, want) {
+		t.Errorf("compareOrders got %+v, want %+v", got, want)
+	}
+
+	for _, tc := range []struct {
+		prev, cur float64
+		want      bool
+	}{
+		{prev: 100, cur: 200, want: false},
+		{prev: 100, cur: 201, want: true},
+		{prev: 100, cur: 50, want: false},
+		{prev: 0, cur: 100, want: false},
+	} {
+		if got := grewSharply(tc.prev, tc.cur); got != tc.want {
+			t.Errorf("grewSharply(%v, %v) = %v, want %v", tc.prev, tc.cur, got, tc.want)
+		}
+	}
+}
+
+func TestRepeatFindlimitBudget(t *testing.T) {
+	stubFindlimitChild(t, "sleep 0.3\n"+oomingChild)
+
+	// One at a time, so the third would start after 600ms.
+	results, _, err := repeatFindlimit(context.Background(), 5, "antagonized", 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("repeatFindlimit: %v", err)
+	}
+	if len(results) != 2 {
+		t.Errorf("got %d results, want 2 within the budget", len(results))
+	}
+}
+
+func TestParsePercentiles(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    []float64
+		wantErr bool
+	}{
+		{in: "95", want: []float64{95}},
+		{in: "99.9, 50,95,50", want: []float64{50, 95, 99.9}},
+		{in: "100", want: []float64{100}},
+		{in: "0", wantErr: true},
+		{in: "101", wantErr: true},
+		{in: "-5", wantErr: true},
+		{in: "NaN", wantErr: true},
+		{in: "p99", wantErr: true},
+		{in: "", wantErr: true},
+	} {
+		got, err := parsePercentiles(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parsePercentiles(%q) = %v, want error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tc.want) {
+			t.Errorf("parsePercentiles(%q) = %v, %v, want %v", tc.in, got, err, tc.want)
+		}
+	}
+
+	// p100 is the max, and tiny percentiles don't go off the front.
+	s := summarize([]int64{5, 1, 4, 2, 3})
+	for _, tc := range []struct {
+		p    float64
+		want int64
+	}{{p: 100, want: 5}, {p: 50, want: 3}, {p: 0.001, want: 1}} {
+		if got := s.percentile(tc.p); got != tc.want {
+			t.Errorf("p%v = %d, want %d", tc.p, got, tc.want)
+		}
+	}
+}
+
+// Returns what f writes to os.Stderr.
+func captureStderr(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = old }()
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+	f()
+	w.Close()
+	return string(<-done)
+}
+
+func TestVerifyTeardown(t *testing.T) {
+	meminfo := func(available, free pab.ByteSize) *linux.Meminfo {
+		return &linux.Meminfo{Sizes: map[string]pab.ByteSize{
+			"MemTotal":     1000 * pab.Megabyte,
+			"MemAvailable": available,
+			"MemFree":      free,
+		}}
+	}
+	before := meminfo(800*pab.Megabyte, 500*pab.Megabyte)
+	for _, tc := range []struct {
+		name                    string
+		after                   *linux.Meminfo
+		wantAvailable, wantFree pab.ByteSize
+		wantWarning             bool
+	}{
+		{name: "recovered", after: meminfo(800*pab.Megabyte, 400*pab.Megabyte), wantFree: -100 * pab.Megabyte},
+		{name: "within tolerance", after: meminfo(795*pab.Megabyte, 500*pab.Megabyte), wantAvailable: -5 * pab.Megabyte},
+		{name: "more available", after: meminfo(900*pab.Megabyte, 600*pab.Megabyte), wantAvailable: 100 * pab.Megabyte, wantFree: 100 * pab.Megabyte},
+		{name: "leaked", after: meminfo(700*pab.Megabyte, 500*pab.Megabyte), wantAvailable: -100 * pab.Megabyte, wantWarning: true},
+	} {
+		var metrics map[string][]int64
+		stderr := captureStderr(t, func() { metrics = verifyTeardown(before, tc.after) })
+		if got := metrics[teardownMemAvailableDeltaPrefix]; !slices.Equal(got, []int64{tc.wantAvailable.Bytes()}) {
+			t.Errorf("%s: got %s %v, want [%d]", tc.name, teardownMemAvailableDeltaPrefix, got, tc.wantAvailable.Bytes())
+		}
+		if got := metrics[teardownMemFreeDeltaPrefix]; !slices.Equal(got, []int64{tc.wantFree.Bytes()}) {
+			t.Errorf("%s: got %s %v, want [%d]", tc.name, teardownMemFreeDeltaPrefix, got, tc.wantFree.Bytes())
+		}
+		if gotWarning := strings.Contains(stderr, "WARNING"); gotWarning != tc.wantWarning {
+			t.Errorf("%s: got stderr %q, want warning: %v", tc.name, stderr, tc.wantWarning)
+		}
+	}
+}
+
+func TestAddKallocfreeMetricsPerNodeLatencies(t *testing.T) {
+	res := &kallocfree.Result{
+		AllocLatencies: []time.Duration{100, 200, 300},
+		AllocLatenciesByNode: map[int][]time.Duration{
+			0:  {100, 300},
+			12: {200},
+		},
+		KmodBytesHeld: -1,
+	}
+	result := make(map[string][]int64)
+	addKallocfreeMetrics(result, res, &kallocfree.Options{})
+
+	for key, want := range map[string][]int64{
+		"kernel_page_alloc_latencies_ns_node0":  {100, 300},
+		"kernel_page_alloc_latencies_ns_node12": {200},
+	} {
+		if got := result[key]; !slices.Equal(got, want) {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+		if !isLatencyMetric(key) {
+			t.Errorf("%s isn't printed as a latency", key)
+		}
+	}
+	if _, ok := result["kernel_page_alloc_latencies_ns_node1"]; ok {
+		t.Errorf("got latencies for node 1, which had none")
+	}
+}
+
+func TestOutputConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "result.json")
+	config := currentConfig(nil, kallocfree.Profiles["networking"])
+	if err := writeOutput(path, config, map[string][]int64{idleAvailableBytesPrefix: {4096}}); err != nil {
+		t.Fatalf("writeOutput: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output struct {
+		Config map[string]json.RawMessage `json:"config"`
+	}
+	if err := json.Unmarshal(data, &output); err != nil {
+		t.Fatalf("parsing output: %v\n%s", err, data)
+	}
+	var got outputConfig
+	if err := json.Unmarshal(data, &struct {
+		Config *outputConfig `json:"config"`
+	}{&got}); err != nil {
+		t.Fatalf("parsing output: %v\n%s", err, data)
+	}
+
+	if got.Flags["iterations"] != strconv.Itoa(*iterationsFlag) || got.Flags["alloc-orders"] != *allocOrdersFlag {
+		t.Errorf("got flags %v, want the current values of --iterations and --alloc-orders", got.Flags)
+	}
+	if got.NumCPUs < 1 || got.PageSizeBytes != pab.PageSize().Bytes() || got.KallocfreeTotalMemoryBytes != kallocfreeTotalMemory.Bytes() {
+		t.Errorf("got config %+v, want it to describe this system", got)
+	}
+	if !reflect.DeepEqual(got.OrderWeights, kallocfree.Profiles["networking"]) {
+		t.Errorf("got order weights %v, want the networking profile", got.OrderWeights)
+	}
+	// Unset optional fields are left out.
+	for _, key := range []string{"orders", "partial", "latency_histogram_bounds_ns"} {
+		if _, ok := output.Config[key]; ok {
+			t.Errorf("got %q in config, want it omitted", key)
+		}
+	}
+}
+
+func TestStolenMetrics(t *testing.T) {
+	results := func(allocated ...pab.ByteSize) []*findlimit.Result {
+		var rs []*findlimit.Result
+		for _, a := range allocated {
+			rs = append(rs, &findlimit.Result{Allocated: a})
+		}
+		return rs
+	}
+	for _, tc := range []struct {
+		name              string
+		idle, antagonized []*findlimit.Result
+		want              map[string][]int64
+	}{
+		{
+			name:        "stolen",
+			idle:        results(1000, 3000),
+			antagonized: results(1500),
+			want:        map[string][]int64{stolenBytesPrefix: {500}, stolenPPMPrefix: {250000}},
+		},
+		{
+			name:        "antagonized got more",
+			idle:        results(1000),
+			antagonized: results(1100, 1300),
+			want:        map[string][]int64{stolenBytesPrefix: {-200}, stolenPPMPrefix: {-200000}},
+		},
+		{
+			name:        "nothing idle",
+			idle:        results(0),
+			antagonized: results(0),
+			want:        map[string][]int64{stolenBytesPrefix: {0}},
+		},
+		{name: "no idle results", antagonized: results(1000)},
+		{name: "no antagonized results", idle: results(1000)},
+	} {
+		got := stolenMetrics(tc.idle, tc.antagonized)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for key, want := range tc.want {
+			if !slices.Equal(got[key], want) {
+				t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSplitHousekeepingCPUs(t *testing.T) {
+	allowed := linux.NewCPUMask(0, 1, 2, 3)
+	for _, tc := range []struct {
+		spec                          string
+		wantHousekeeping, wantWorkers []int
+		wantErr                       bool
+	}{
+		{spec: "0", wantHousekeeping: []int{0}, wantWorkers: []int{1, 2, 3}},
+		{spec: "0-1", wantHousekeeping: []int{0, 1}, wantWorkers: []int{2, 3}},
+		{spec: "3,7", wantHousekeeping: []int{3, 7}, wantWorkers: []int{0, 1, 2}},
+		{spec: "0-3", wantErr: true},
+		{spec: "4-5", wantErr: true},
+		{spec: "foo", wantErr: true},
+	} {
+		housekeeping, workers, err := splitHousekeepingCPUs(allowed, tc.spec)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: got housekeeping %s workers %s, want error", tc.spec, housekeeping, workers)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.spec, err)
+			continue
+		}
+		if got := housekeeping.CPUs(); !reflect.DeepEqual(got, tc.wantHousekeeping) {
+			t.Errorf("%q: got housekeeping CPUs %v, want %v", tc.spec, got, tc.wantHousekeeping)
+		}
+		if got := workers.CPUs(); !reflect.DeepEqual(got, tc.wantWorkers) {
+			t.Errorf("%q: got worker CPUs %v, want %v", tc.spec, got, tc.wantWorkers)
+		}
+		if workers.Intersect(housekeeping).Count() != 0 {
+			t.Errorf("%q: worker CPUs %s overlap housekeeping CPUs %s", tc.spec, workers, housekeeping)
+		}
+	}
+}
@@ -2,30 +2,77 @@
 package sampling
 
 import (
+	"container/heap"
+	"math"
 	"math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Algorithm selects how a Reservoir picks its samples. They all produce a
+// uniform sample of the input, they just differ in performance.
+type Algorithm int
+
+const (
+	// AlgorithmR is the simple algorithm, it generates a random number for
+	// every item added.
+	// https://en.wikipedia.org/wiki/Reservoir_sampling#Simple:_Algorithm_R
+	AlgorithmR Algorithm = iota
+	// AlgorithmL computes how many items to skip, so it only generates random
+	// numbers for items that end up in the sample. Much cheaper when the
+	// stream is much longer than the sample.
+	// https://en.wikipedia.org/wiki/Reservoir_sampling#Optimal:_Algorithm_L
+	AlgorithmL
+)
+
+// Config configures a Reservoir.
+type Config struct {
+	Size      int   // Desired output sample size.
+	Seed      int64 // Zero means seed from the current time.
+	Algorithm Algorithm
+}
+
 // Reservoir implements what is described in
 // https://en.wikipedia.org/wiki/Reservoir_sampling
+// It's not safe for concurrent use, see SyncReservoir for that.
 type Reservoir[T any] struct {
 	// Length of this slice is the desired output sample size.
 	outSamples   []T
 	numInSamples int
 	rand         *rand.Rand
+	algorithm    Algorithm
+	// Only for AlgorithmL.
+	w       float64
+	nextIdx int // Index of the next input sample that will be picked.
 }
 
-// NewReservoir initializes a Reservoir that will take a sample of up to the
-// given size of a stream of data.
-func NewReservoir[T any](size int) *Reservoir[T] {
+// New initializes a Reservoir according to cfg. Identically-seeded reservoirs
+// fed the same data produce the same samples.
+func New[T any](cfg Config) *Reservoir[T] {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
 	return &Reservoir[T]{
-		outSamples: make([]T, size),
-		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		outSamples: make([]T, cfg.Size),
+		rand:       rand.New(rand.NewSource(seed)),
+		algorithm:  cfg.Algorithm,
 	}
 }
 
 // Add adds an item to the reservoir.
 func (r *Reservoir[T]) Add(datum T) {
+	switch r.algorithm {
+	case AlgorithmL:
+		r.addL(datum)
+	default:
+		r.addR(datum)
+	}
+}
+
+func (r *Reservoir[T]) addR(datum T) {
 	outIdx := r.numInSamples
 	r.numInSamples++
 	// https://en.wikipedia.org/wiki/Reservoir_sampling#Simple:_Algorithm_R
@@ -41,8 +88,332 @@ func (r *Reservoir[T]) Add(datum T) {
 	r.outSamples[outIdx] = datum
 }
 
+// Random number in (0, 1], so it's safe to take the log.
+func (r *Reservoir[T]) randUnit() float64 {
+	return 1 - r.rand.Float64()
+}
+
+// Advance nextIdx past the items that Algorithm L skips.
+func (r *Reservoir[T]) skipL() {
+	skip := math.Floor(math.Log(r.randUnit()) / math.Log(1-r.w))
+	if skip > math.MaxInt32 { // Don't overflow, we'll never see that many anyway.
+		skip = math.MaxInt32
+	}
+	r.nextIdx += int(skip) + 1
+}
+
+func (r *Reservoir[T]) addL(datum T) {
+	k := len(r.outSamples)
+	idx := r.numInSamples
+	r.numInSamples++
+	if k == 0 {
+		return
+	}
+	// Until the sample is full we pick every input.
+	if idx < k {
+		r.outSamples[idx] = datum
+		if idx == k-1 {
+			r.w = math.Exp(math.Log(r.randUnit()) / float64(k))
+			r.nextIdx = idx
+			r.skipL()
+		}
+		return
+	}
+	if idx != r.nextIdx {
+		return
+	}
+	r.outSamples[r.rand.Intn(k)] = datum
+	r.w *= math.Exp(math.Log(r.randUnit()) / float64(k))
+	r.skipL()
+}
+
 // Samples returns, at any given time, a random sample of the data passed to
 // Add. The result is read-only.
 func (r *Reservoir[T]) Samples() []T {
-	return r.outSamples[:r.numInSamples]
+	return r.outSamples[:min(r.numInSamples, len(r.outSamples))]
+}
+
+// Count returns the number of items that have been added.
+func (r *Reservoir[T]) Count() int {
+	return r.numInSamples
+}
+
+// Reset discards everything that has been added, so the reservoir can be reused
+// for a new stream without reallocating. Slices previously returned by Samples
+// are invalidated: they will be overwritten by subsequent calls to Add.
+func (r *Reservoir[T]) Reset() {
+	clear(r.outSamples) // Don't hold on to anything the items reference.
+	r.numInSamples = 0
+	r.w = 0
+	r.nextIdx = 0
+}
+
+// Quantile returns the q-th quantile (for q in [0, 1]) of the current samples,
+// ordered by less. q=1 gives the maximum sample. Returns false if there are no
+// samples.
+func (r *Reservoir[T]) Quantile(q float64, less func(a, b T) bool) (T, bool) {
+	sorted := slices.Clone(r.Samples())
+	if len(sorted) == 0 {
+		var zero T
+		return zero, false
+	}
+	slices.SortFunc(sorted, func(a, b T) int {
+		if less(a, b) {
+			return -1
+		}
+		if less(b, a) {
+			return 1
+		}
+		return 0
+	})
+	idx := int(float64(len(sorted)) * q)
+	return sorted[min(max(idx, 0), len(sorted)-1)], true
+}
+
+// Merge combines reservoirs that sampled disjoint streams into one that
+// samples the combination of those streams, as if it had seen all their items.
+// Simply concatenating the samples would over-represent streams that had fewer
+// items. The size of the result is the largest size of the inputs. The result
+// uses AlgorithmR, more items can be added to it. Its random source is seeded
+// from seed as for Config.Seed, so a nonzero seed makes merging deterministic.
+// The inputs, including their random sources, are unmodified.
+//
+// This is exact as long as no input would have to contribute more items than
+// it has sampled, which is only likely if the inputs have very different sizes.
+func Merge[T any](seed int64, rs ...*Reservoir[T]) *Reservoir[T] {
+	size := 0
+	for _, r := range rs {
+		size = max(size, len(r.outSamples))
+	}
+	merged := New[T](Config{Size: size, Seed: seed})
+
+	// Draw items without replacement: each one comes from a stream with
+	// probability proportional to the number of that stream's items we
+	// haven't yet accounted for.
+	remaining := make([]int, len(rs)) // Items in each stream not yet accounted for.
+	available := make([][]T, len(rs)) // Samples from each stream not yet taken.
+	total := 0
+	for i, r := range rs {
+		available[i] = slices.Clone(r.Samples())
+		if len(available[i]) == 0 {
+			// No samples (e.g. Size 0) to take, however many items
+			// went in.
+			continue
+		}
+		remaining[i] = r.numInSamples
+		total += r.numInSamples
+	}
+	for out := 0; out < size && total > 0; out++ {
+		x := merged.rand.Intn(total)
+		i := 0
+		for x >= remaining[i] {
+			x -= remaining[i]
+			i++
+		}
+		// Take a random one of that stream's samples.
+		j := merged.rand.Intn(len(available[i]))
+		merged.outSamples[out] = available[i][j]
+		available[i][j] = available[i][len(available[i])-1]
+		available[i] = available[i][:len(available[i])-1]
+		remaining[i]--
+		total--
+		if len(available[i]) == 0 {
+			// Ran out of samples, can't take any more from here.
+			total -= remaining[i]
+			remaining[i] = 0
+		}
+	}
+	for _, r := range rs {
+		merged.numInSamples += r.numInSamples
+	}
+	return merged
+}
+
+// Stats is a Reservoir that also keeps track of the exact minimum and maximum
+// of the items added, which the sample alone would probably miss.
+type Stats[T any] struct {
+	*Reservoir[T]
+	less     func(a, b T) bool
+	min, max T
+}
+
+// NewStats wraps r to track the minimum and maximum of its items, ordered by
+// less. r should be empty.
+func NewStats[T any](r *Reservoir[T], less func(a, b T) bool) *Stats[T] {
+	return &Stats[T]{Reservoir: r, less: less}
+}
+
+// Add adds an item to the reservoir and updates the min and max.
+func (s *Stats[T]) Add(datum T) {
+	if s.Count() == 0 || s.less(datum, s.min) {
+		s.min = datum
+	}
+	if s.Count() == 0 || s.less(s.max, datum) {
+		s.max = datum
+	}
+	s.Reservoir.Add(datum)
+}
+
+// Min returns the smallest item added. Returns false if there are none.
+func (s *Stats[T]) Min() (T, bool) {
+	return s.min, s.Count() > 0
+}
+
+// Max returns the largest item added. Returns false if there are none.
+func (s *Stats[T]) Max() (T, bool) {
+	return s.max, s.Count() > 0
+}
+
+// Reset discards everything that has been added, see Reservoir.Reset.
+func (s *Stats[T]) Reset() {
+	var zero T
+	s.min, s.max = zero, zero
+	s.Reservoir.Reset()
+}
+
+// SyncReservoir is a Reservoir that's safe for concurrent use. It's slower, so
+// prefer a Reservoir per goroutine where possible.
+type SyncReservoir[T any] struct {
+	mu sync.Mutex
+	r  *Reservoir[T]
+}
+
+// NewSync is like New but returns a SyncReservoir.
+func NewSync[T any](cfg Config) *SyncReservoir[T] {
+	return &SyncReservoir[T]{r: New[T](cfg)}
+}
+
+// Add adds an item to the reservoir.
+func (s *SyncReservoir[T]) Add(datum T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.r.Add(datum)
+}
+
+// Samples is like Reservoir.Samples, but returns a copy, since the reservoir
+// might be modified concurrently.
+func (s *SyncReservoir[T]) Samples() []T {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.r.Samples())
+}
+
+type weightedItem[T any] struct {
+	datum T
+	key   float64
+}
+
+// Min-heap on key, for container/heap.
+type weightedHeap[T any] []weightedItem[T]
+
+func (h weightedHeap[T]) Len() int           { return len(h) }
+func (h weightedHeap[T]) Less(i, j int) bool { return h[i].key < h[j].key }
+func (h weightedHeap[T]) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *weightedHeap[T]) Push(x any)        { *h = append(*h, x.(weightedItem[T])) }
+func (h *weightedHeap[T]) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// WeightedReservoir is like Reservoir, except that each item has a weight, and
+// the probability of an item being in the sample is proportional to it. This
+// is Algorithm A-Res:
+// https://en.wikipedia.org/wiki/Reservoir_sampling#Algorithm_A-Res
+type WeightedReservoir[T any] struct {
+	size  int
+	items weightedHeap[T] // The current sample.
+	rand  *rand.Rand
+}
+
+// NewWeighted initializes a WeightedReservoir according to cfg. The Algorithm
+// is ignored.
+func NewWeighted[T any](cfg Config) *WeightedReservoir[T] {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &WeightedReservoir[T]{
+		size: cfg.Size,
+		rand: rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Add adds an item to the reservoir. Items with non-positive weight are never
+// picked.
+func (r *WeightedReservoir[T]) Add(datum T, weight float64) {
+	if r.size == 0 || !(weight > 0) {
+		return
+	}
+	// The key is u^(1/w) where u is uniform in (0, 1]. Its log is just as
+	// good for comparisons, and doesn't underflow for small weights.
+	key := math.Log(1-r.rand.Float64()) / weight
+	if len(r.items) < r.size {
+		heap.Push(&r.items, weightedItem[T]{datum: datum, key: key})
+		return
+	}
+	if key > r.items[0].key {
+		r.items[0] = weightedItem[T]{datum: datum, key: key}
+		heap.Fix(&r.items, 0)
+	}
+}
+
+// Samples returns the current sample, in no particular order.
+func (r *WeightedReservoir[T]) Samples() []T {
+	ret := make([]T, len(r.items))
+	for i, item := range r.items {
+		ret[i] = item.datum
+	}
+	return ret
+}
+
+// Histogram counts values into buckets with fixed bounds. Unlike a Reservoir it
+// sees every value. It's safe for concurrent use, so it can be read while it's
+// being filled.
+type Histogram struct {
+	bounds []time.Duration
+	counts []atomic.Uint64
+	sumNS  atomic.Int64
+}
+
+// NewHistogram creates a histogram with the given bucket bounds, which must be
+// in increasing order. Bucket i counts values <= bounds[i] (and greater than
+// bounds[i-1]), and there's an extra final bucket for values greater than all
+// the bounds, i.e. with an upper bound of +Inf.
+func NewHistogram(bounds []time.Duration) *Histogram {
+	return &Histogram{
+		bounds: slices.Clone(bounds),
+		counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+}
+
+// Add counts a value in the appropriate bucket.
+func (h *Histogram) Add(d time.Duration) {
+	// If d isn't found, this is the index of the first bound greater than it,
+	// or len(bounds) if there's none.
+	i, _ := slices.BinarySearch(h.bounds, d)
+	h.counts[i].Add(1)
+	h.sumNS.Add(d.Nanoseconds())
+}
+
+// Bounds returns the upper bounds of the buckets, excluding the final +Inf one.
+// The result is read-only.
+func (h *Histogram) Bounds() []time.Duration {
+	return h.bounds
+}
+
+// Buckets returns the count for each bucket. There's one more than there are
+// bounds, the last one counting values greater than all the bounds.
+func (h *Histogram) Buckets() []uint64 {
+	counts := make([]uint64, len(h.counts))
+	for i := range h.counts {
+		counts[i] = h.counts[i].Load()
+	}
+	return counts
+}
+
+// Sum returns the total of all the values added.
+func (h *Histogram) Sum() time.Duration {
+	return time.Duration(h.sumNS.Load())
 }
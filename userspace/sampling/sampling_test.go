@@ -0,0 +1,349 @@
+// Copyright 2024 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+
+package sampling
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func fill(r *Reservoir[int], n int) {
+	for i := 0; i < n; i++ {
+		r.Add(i)
+	}
+}
+
+// Every item should be picked with probability size/n, whatever the algorithm.
+func TestUniform(t *testing.T) {
+	const (
+		n      = 1000
+		size   = 100
+		trials = 2000
+	)
+	for _, alg := range []Algorithm{AlgorithmR, AlgorithmL} {
+		// Count how often items in each tenth of the stream are picked, so
+		// that the per-bucket counts are big enough to compare.
+		var counts [10]int
+		for seed := int64(1); seed <= trials; seed++ {
+			r := New[int](Config{Size: size, Seed: seed, Algorithm: alg})
+			fill(r, n)
+			if got := len(r.Samples()); got != size {
+				t.Fatalf("algorithm %d: got %d samples, want %d", alg, got, size)
+			}
+			for _, s := range r.Samples() {
+				counts[s*len(counts)/n]++
+			}
+		}
+		want := float64(trials*size) / float64(len(counts))
+		for i, got := range counts {
+			// Binomial standard deviation is about 126, allow 5 of them.
+			if math.Abs(float64(got)-want) > 5*math.Sqrt(want*0.9) {
+				t.Errorf("algorithm %d: bucket %d picked %d times, want about %.0f", alg, i, got, want)
+			}
+		}
+	}
+}
+
+func TestFewerItemsThanSize(t *testing.T) {
+	for _, alg := range []Algorithm{AlgorithmR, AlgorithmL} {
+		r := New[int](Config{Size: 10, Seed: 1, Algorithm: alg})
+		fill(r, 3)
+		if got, want := r.Samples(), []int{0, 1, 2}; !slices.Equal(got, want) {
+			t.Errorf("algorithm %d: got samples %v, want %v", alg, got, want)
+		}
+		if got := r.Count(); got != 3 {
+			t.Errorf("algorithm %d: got count %d, want 3", alg, got)
+		}
+	}
+}
+
+func TestSeedDeterministic(t *testing.T) {
+	for _, alg := range []Algorithm{AlgorithmR, AlgorithmL} {
+		a := New[int](Config{Size: 50, Seed: 42, Algorithm: alg})
+		b := New[int](Config{Size: 50, Seed: 42, Algorithm: alg})
+		fill(a, 10000)
+		fill(b, 10000)
+		if !slices.Equal(a.Samples(), b.Samples()) {
+			t.Errorf("algorithm %d: identically-seeded reservoirs differ:\n%v\n%v", alg, a.Samples(), b.Samples())
+		}
+	}
+
+	wa := NewWeighted[int](Config{Size: 50, Seed: 42})
+	wb := NewWeighted[int](Config{Size: 50, Seed: 42})
+	for i := 0; i < 10000; i++ {
+		wa.Add(i, float64(i%7+1))
+		wb.Add(i, float64(i%7+1))
+	}
+	if !slices.Equal(wa.Samples(), wb.Samples()) {
+		t.Errorf("identically-seeded weighted reservoirs differ:\n%v\n%v", wa.Samples(), wb.Samples())
+	}
+}
+
+func TestSyncReservoirConcurrent(t *testing.T) {
+	const (
+		goroutines = 8
+		perG       = 1000
+		size       = 100
+	)
+	s := NewSync[int](Config{Size: size, Seed: 1})
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perG; i++ {
+				s.Add(g*perG + i)
+				if i%100 == 0 {
+					s.Samples()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	samples := s.Samples()
+	if len(samples) != size {
+		t.Fatalf("got %d samples, want %d", len(samples), size)
+	}
+	seen := make(map[int]bool)
+	for _, x := range samples {
+		if x < 0 || x >= goroutines*perG || seen[x] {
+			t.Errorf("unexpected or duplicate sample %d", x)
+		}
+		seen[x] = true
+	}
+}
+
+// With a sample size of 1, each item should be picked with probability
+// proportional to its weight.
+func TestWeighted(t *testing.T) {
+	const trials = 20000
+	weights := []float64{1, 3, 0, 4}
+	counts := make([]int, len(weights))
+	for seed := int64(1); seed <= trials; seed++ {
+		r := NewWeighted[int](Config{Size: 1, Seed: seed})
+		for i, w := range weights {
+			r.Add(i, w)
+		}
+		samples := r.Samples()
+		if len(samples) != 1 {
+			t.Fatalf("got %d samples, want 1", len(samples))
+		}
+		counts[samples[0]]++
+	}
+	for i, w := range weights {
+		p := w / 8
+		want := p * trials
+		// Allow 5 standard deviations.
+		if got := float64(counts[i]); math.Abs(got-want) > 5*math.Sqrt(trials*p*(1-p)) {
+			t.Errorf("item with weight %v picked %v times, want about %v", w, got, want)
+		}
+	}
+}
+
+func TestWeightedNonPositive(t *testing.T) {
+	r := NewWeighted[int](Config{Size: 5, Seed: 1})
+	r.Add(1, 0)
+	r.Add(2, -1)
+	r.Add(3, math.NaN())
+	if got := r.Samples(); len(got) != 0 {
+		t.Errorf("got samples %v, want none", got)
+	}
+}
+
+// A stream with 9 times as many items should contribute 9 times as many items
+// to the merged sample, even though both inputs have full samples.
+func TestMerge(t *testing.T) {
+	const (
+		size   = 100
+		trials = 500
+	)
+	ones := 0
+	for seed := int64(1); seed <= trials; seed++ {
+		big := New[int](Config{Size: size, Seed: seed})
+		small := New[int](Config{Size: size, Seed: seed + trials})
+		for i := 0; i < 900; i++ {
+			big.Add(0)
+		}
+		for i := 0; i < 100; i++ {
+			small.Add(1)
+		}
+		merged := Merge(seed, big, small)
+		if got := merged.Count(); got != 1000 {
+			t.Fatalf("got merged count %d, want 1000", got)
+		}
+		samples := merged.Samples()
+		if len(samples) != size {
+			t.Fatalf("got %d merged samples, want %d", len(samples), size)
+		}
+		for _, s := range samples {
+			ones += s
+		}
+	}
+	want := 0.1 * size * trials
+	// Sampling without replacement makes this tighter than binomial, so 5
+	// binomial standard deviations is generous.
+	if got := float64(ones); math.Abs(got-want) > 5*math.Sqrt(size*trials*0.1*0.9) {
+		t.Errorf("got %v items from the small stream, want about %v", got, want)
+	}
+}
+
+func TestMergeLeavesInputsUnmodified(t *testing.T) {
+	a := New[int](Config{Size: 10, Seed: 7})
+	b := New[int](Config{Size: 10, Seed: 7})
+	fill(a, 100)
+	fill(b, 100)
+	before := slices.Clone(a.Samples())
+
+	m1 := Merge(3, a)
+	if !slices.Equal(a.Samples(), before) {
+		t.Errorf("Merge modified input samples: got %v, want %v", a.Samples(), before)
+	}
+	// a's random source must be untouched, so it carries on exactly like b.
+	for i := 100; i < 1000; i++ {
+		a.Add(i)
+		b.Add(i)
+	}
+	if !slices.Equal(a.Samples(), b.Samples()) {
+		t.Errorf("Merge advanced the input's random source:\n%v\n%v", a.Samples(), b.Samples())
+	}
+
+	c := New[int](Config{Size: 10, Seed: 7})
+	fill(c, 100)
+	if m2 := Merge(3, c); !slices.Equal(m1.Samples(), m2.Samples()) {
+		t.Errorf("identically-seeded merges differ:\n%v\n%v", m1.Samples(), m2.Samples())
+	}
+}
+
+// A stream with items but no samples (Size 0) can't contribute any, the others
+// should fill the merged sample.
+func TestMergeEmptySample(t *testing.T) {
+	empty := New[int](Config{Size: 0, Seed: 1})
+	full := New[int](Config{Size: 4, Seed: 1})
+	for i := 0; i < 10; i++ {
+		empty.Add(-1)
+		full.Add(i)
+	}
+	merged := Merge(1, empty, full)
+	if got := merged.Count(); got != 20 {
+		t.Errorf("got merged count %d, want 20", got)
+	}
+	samples := merged.Samples()
+	if len(samples) != 4 {
+		t.Fatalf("got %d merged samples, want 4", len(samples))
+	}
+	for _, s := range samples {
+		if s < 0 {
+			t.Errorf("got sample %d from the empty stream", s)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	less := func(a, b int) bool { return a < b }
+	r := New[int](Config{Size: 100, Seed: 1})
+	if _, ok := r.Quantile(0.5, less); ok {
+		t.Errorf("Quantile of empty reservoir returned ok")
+	}
+	// Add 1..100 in reverse, so they all fit and the quantiles are exact.
+	for i := 100; i >= 1; i-- {
+		r.Add(i)
+	}
+	for _, tc := range []struct {
+		q    float64
+		want int
+	}{
+		{q: 0, want: 1},
+		{q: 0.5, want: 51},
+		{q: 0.95, want: 96},
+		{q: 1, want: 100},
+	} {
+		got, ok := r.Quantile(tc.q, less)
+		if !ok || got != tc.want {
+			t.Errorf("Quantile(%v) = %v, %v; want %v, true", tc.q, got, ok, tc.want)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	for _, alg := range []Algorithm{AlgorithmR, AlgorithmL} {
+		r := New[int](Config{Size: 5, Seed: 1, Algorithm: alg})
+		fill(r, 1000)
+		r.Reset()
+		if got := r.Count(); got != 0 {
+			t.Errorf("algorithm %d: got count %d after Reset, want 0", alg, got)
+		}
+		if got := r.Samples(); len(got) != 0 {
+			t.Errorf("algorithm %d: got samples %v after Reset, want none", alg, got)
+		}
+		// It should behave like a new reservoir again, taking every item
+		// until it's full.
+		for i := 10; i < 15; i++ {
+			r.Add(i)
+		}
+		if got, want := r.Samples(), []int{10, 11, 12, 13, 14}; !slices.Equal(got, want) {
+			t.Errorf("algorithm %d: got samples %v after Reset, want %v", alg, got, want)
+		}
+	}
+}
+
+// Stats should track the exact extremes and count, not just the samples.
+func TestStats(t *testing.T) {
+	s := NewStats(New[int](Config{Size: 2, Seed: 1}), func(a, b int) bool { return a < b })
+	if _, ok := s.Min(); ok {
+		t.Errorf("Min() of empty Stats returned ok")
+	}
+	for _, x := range []int{5, -3, 8} {
+		s.Add(x)
+	}
+	if lo, ok := s.Min(); !ok || lo != -3 {
+		t.Errorf("Min() = %v, %v; want -3, true", lo, ok)
+	}
+	if hi, ok := s.Max(); !ok || hi != 8 {
+		t.Errorf("Max() = %v, %v; want 8, true", hi, ok)
+	}
+	if got := s.Count(); got != 3 {
+		t.Errorf("Count() = %d, want 3", got)
+	}
+	s.Reset()
+	if _, ok := s.Min(); ok {
+		t.Errorf("Min() after Reset returned ok")
+	}
+	s.Add(100)
+	if lo, _ := s.Min(); lo != 100 {
+		t.Errorf("Min() after Reset and Add(100) = %v, want 100", lo)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]time.Duration{10, 20, 30})
+	values := []time.Duration{5, 10, 11, 20, 25, 31, 100}
+	for _, v := range values {
+		h.Add(v)
+	}
+	// Bucket i counts values in (bounds[i-1], bounds[i]], then there's +Inf.
+	if got, want := h.Buckets(), []uint64{2, 2, 1, 2}; !slices.Equal(got, want) {
+		t.Errorf("Buckets() = %v, want %v", got, want)
+	}
+	if got, want := h.Sum(), time.Duration(202); got != want {
+		t.Errorf("Sum() = %v, want %v", got, want)
+	}
+	if got, want := h.Bounds(), []time.Duration{10, 20, 30}; !slices.Equal(got, want) {
+		t.Errorf("Bounds() = %v, want %v", got, want)
+	}
+}
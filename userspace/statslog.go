@@ -0,0 +1,117 @@
+// Copyright 2024 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+
+// This file has the --stats-log feature, for post-mortem debugging of runs.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/page_alloc_bench/pab"
+	"github.com/google/page_alloc_bench/workload/kallocfree"
+)
+
+// Once the stats log gets this big it's moved to a ".1" suffix (replacing
+// whatever was there) and a new one is started. So the total disk usage is
+// capped at about twice this.
+const statsLogMaxSize = 16 * pab.Megabyte
+
+// A log file that rotates itself when it gets too big.
+type statsLog struct {
+	path string
+	file *os.File
+	size pab.ByteSize
+}
+
+func openStatsLog(path string) (*statsLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &statsLog{path: path, file: file, size: pab.ByteSize(info.Size())}, nil
+}
+
+func (l *statsLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	newLog, err := openStatsLog(l.path)
+	if err != nil {
+		return err
+	}
+	*l = *newLog
+	return nil
+}
+
+func (l *statsLog) writeLine(line string) error {
+	if l.size >= statsLogMaxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("rotating %s: %v", l.path, err)
+		}
+	}
+	n, err := l.file.WriteString(line + "\n")
+	l.size += pab.ByteSize(n)
+	return err
+}
+
+func formatCounters(t time.Time, c kallocfree.Counters) string {
+	return fmt.Sprintf("%s pages_allocated=%d pages_freed=%d alloc_failures=%d free_failures=%d cross_cpu_frees=%d backoff_ns=%d",
+		t.Format(time.RFC3339Nano), c.PagesAllocated, c.PagesFreed,
+		c.AllocFailures, c.FreeFailures, c.CrossCPUFrees, c.TotalBackoff.Nanoseconds())
+}
+
+// Parses --stats-log-interval-ms.
+func parseStatsLogInterval(ms int) (time.Duration, error) {
+	if ms <= 0 {
+		return 0, fmt.Errorf("must be positive, got %d", ms)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Appends a line with the workload's counters to the file at path every
+// interval (see parseStatsLogInterval), until ctx is cancelled. A final line is
+// written on the way out.
+func logStats(ctx context.Context, path string, interval time.Duration, w *kallocfree.Workload) error {
+	l, err := openStatsLog(path)
+	if err != nil {
+		return fmt.Errorf("opening stats log: %v", err)
+	}
+	defer l.file.Close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return l.writeLine(formatCounters(time.Now(), w.Counters()))
+		case t := <-ticker.C:
+			if err := l.writeLine(formatCounters(t, w.Counters())); err != nil {
+				return fmt.Errorf("writing stats log: %v", err)
+			}
+		}
+	}
+}
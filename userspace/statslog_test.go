@@ -0,0 +1,104 @@
+// Copyright 2024 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/page_alloc_bench/workload/kallocfree"
+)
+
+func TestFormatCounters(t *testing.T) {
+	c := kallocfree.Counters{
+		PagesAllocated: 10,
+		PagesFreed:     8,
+		AllocFailures:  3,
+		FreeFailures:   1,
+		CrossCPUFrees:  4,
+		TotalBackoff:   1500 * time.Millisecond,
+	}
+	got := formatCounters(time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC), c)
+	want := "2024-05-01T12:00:00.0000005Z pages_allocated=10 pages_freed=8 alloc_failures=3 free_failures=1 cross_cpu_frees=4 backoff_ns=1500000000"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStatsLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.log")
+	l, err := openStatsLog(path)
+	if err != nil {
+		t.Fatalf("openStatsLog: %v", err)
+	}
+	defer func() { l.file.Close() }()
+	if err := l.writeLine("first"); err != nil {
+		t.Fatalf("writeLine: %v", err)
+	}
+	// Pretend it's full, rather than writing 16MiB.
+	l.size = statsLogMaxSize
+	if err := l.writeLine("second"); err != nil {
+		t.Fatalf("writeLine: %v", err)
+	}
+
+	for _, tc := range []struct{ path, want string }{
+		{path: path + ".1", want: "first\n"},
+		{path: path, want: "second\n"},
+	} {
+		data, err := os.ReadFile(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tc.want {
+			t.Errorf("%s has %q, want %q", filepath.Base(tc.path), data, tc.want)
+		}
+	}
+
+	// Reopening carries on from the existing size.
+	l.file.Close()
+	if l, err = openStatsLog(path); err != nil {
+		t.Fatalf("openStatsLog: %v", err)
+	}
+	if got := l.size; got != 7 {
+		t.Errorf("reopened log has size %v, want 7 bytes", got)
+	}
+}
+
+func TestParseStatsLogInterval(t *testing.T) {
+	for _, tc := range []struct {
+		ms      int
+		want    time.Duration
+		wantErr bool
+	}{
+		{ms: 1000, want: time.Second},
+		{ms: 1, want: time.Millisecond},
+		{ms: 0, wantErr: true},
+		{ms: -1, wantErr: true},
+	} {
+		got, err := parseStatsLogInterval(tc.ms)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseStatsLogInterval(%d) = %v, want error", tc.ms, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("parseStatsLogInterval(%d) = %v, %v, want %v", tc.ms, got, err, tc.want)
+		}
+	}
+}
@@ -20,31 +20,162 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math/bits"
+	"math/rand"
 	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
+	"github.com/google/page_alloc_bench/linux"
 	"github.com/google/page_alloc_bench/pab"
+	"github.com/google/page_alloc_bench/workload/findlimit"
 )
 
 var (
-	initAllocSize = flag.Int("init-alloc-size", 0, "Size of initial up-front alloc. Optional.")
-	allocSize     = flag.Int("alloc-size", 0, "Size of subsequent individual allocs.")
+	initAllocSize    pab.ByteSize
+	allocSize        pab.ByteSize
+	stopAt           pab.ByteSize
+	churnWindow      pab.ByteSize
+	reportIntervalMS = flag.Int("report-interval-ms", 50, "How often to print the number of bytes allocated so far. The last value printed before getting OOM-killed is the result, so this bounds how stale it can be.")
+	touchGoros       = flag.Int("touch-goroutines", 0, "Number of goroutines to touch pages with. 0 means the biggest power of two up to the number of CPUs.")
+	touchPattern     = flag.String("touch-pattern", string(findlimit.TouchFirstByte), "How to dirty each page.")
+	hugePages        = flag.Bool("huge-pages", false, "Allocate default-sized hugetlb pages instead of base pages, and exit successfully once no more are available.")
+	cpusFlag         = flag.String("cpus", "", "If set, CPUs (in cpulist format, e.g. 0-3) to run on, instead of the affinity inherited from the parent.")
 )
 
-func mmap(size int) ([]byte, error) {
+func init() {
+	flag.Var(&initAllocSize, "init-alloc-size", "Size of initial up-front alloc. Optional.")
+	flag.Var(&allocSize, "alloc-size", "Size of subsequent individual allocs.")
+	flag.Var(&stopAt, "stop-at", "If set, exit successfully after allocating this much, instead of carrying on until OOM-killed.")
+	flag.Var(&churnWindow, "churn-window", "If set, only keep this much memory mapped, cycle through it dropping the oldest pages with MADV_DONTNEED before faulting new ones. The printed number is then the total bytes faulted in.")
+}
+
+// Where the log2 of the huge page size goes in mmap flags, from
+// include/uapi/asm-generic/hugetlb_encode.h. Package syscall doesn't have it.
+const mapHugeShift = 26
+
+// Maps anonymous memory. If hugePageSize is nonzero, it's backed by hugetlb
+// pages of that size.
+func mmap(size int, hugePageSize pab.ByteSize) ([]byte, error) {
 	prot := syscall.PROT_READ | syscall.PROT_WRITE
 	flags := syscall.MAP_PRIVATE | syscall.MAP_ANONYMOUS
+	if hugePageSize != 0 {
+		flags |= syscall.MAP_HUGETLB | bits.TrailingZeros64(uint64(hugePageSize.Bytes()))<<mapHugeShift
+	}
 	return syscall.Mmap(-1, 0, size, prot, flags)
 }
 
+// Maps the next chunk of hugetlb memory with mmapFn, trying size bytes first.
+// hugetlb pages are reserved at mmap time, so once they run low mmap fails with
+// ENOMEM. Then this narrows down how much is left by halving the size, to a
+// whole number of huge pages, and returns the size that worked for next time.
+// Returns nil data once not even one huge page is left, which is an error if
+// none were mapped before (i.e. first is set).
+func mmapHuge(mmapFn func(size pab.ByteSize) ([]byte, error), size, hugePageSize pab.ByteSize, first bool) ([]byte, pab.ByteSize, error) {
+	for {
+		data, err := mmapFn(size)
+		if err == nil {
+			return data, size, nil
+		}
+		if !errors.Is(err, syscall.ENOMEM) {
+			return nil, size, fmt.Errorf("mmap(%v) of huge pages: %w", size, err)
+		}
+		if size <= hugePageSize {
+			if first {
+				return nil, size, fmt.Errorf("couldn't allocate a single %v huge page. Are any reserved? "+
+					"See /proc/sys/vm/nr_hugepages and /proc/sys/vm/nr_overcommit_hugepages", hugePageSize)
+			}
+			return nil, size, nil
+		}
+		size = max((size/2)-(size/2)%hugePageSize, hugePageSize)
+	}
+}
+
+// Splits numPages pages between n goroutines as evenly as possible, the first
+// numPages%n get an extra page. Returns the index of each goroutine's first
+// page, followed by numPages.
+func splitPages(numPages, n int64) []int64 {
+	bounds := []int64{0}
+	for i := int64(0); i < n; i++ {
+		size := numPages / n
+		if i < numPages%n {
+			size++
+		}
+		bounds = append(bounds, bounds[i]+size)
+	}
+	return bounds
+}
+
+// Dirties the page, thus faulting it in, according to pattern.
+func touch(page []byte, pattern findlimit.TouchPattern, random *rand.Rand) {
+	switch pattern {
+	case findlimit.TouchWholePage:
+		for i := range page {
+			page[i] = 0xa5
+		}
+	case findlimit.TouchRandomByte:
+		page[random.Intn(len(page))] = byte(random.Uint32())
+	default:
+		page[0] = 0
+	}
+}
+
+// Prints the counter to w every interval, if it's changed, until done is
+// closed. mu is held while printing.
+func reportProgress(w io.Writer, mu *sync.Mutex, counter *atomic.Int64, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := counter.Load()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		mu.Lock()
+		if n := counter.Load(); n != last {
+			fmt.Fprintf(w, "%d\n", n)
+			last = n
+		}
+		mu.Unlock()
+	}
+}
+
 func doMain() error {
+	pattern, err := findlimit.ParseTouchPattern(*touchPattern)
+	if err != nil {
+		return err
+	}
+	if churnWindow != 0 && *hugePages {
+		return fmt.Errorf("--churn-window and --huge-pages are incompatible")
+	}
+	if *reportIntervalMS <= 0 {
+		return fmt.Errorf("--report-interval-ms must be positive, got %d", *reportIntervalMS)
+	}
+
+	// The parent might have confined itself to housekeeping CPUs, which
+	// we inherited. The runtime sized itself from that, so resize it too.
+	numCPUs := runtime.NumCPU()
+	if *cpusFlag != "" {
+		cpus, err := linux.CPUMaskFromString(*cpusFlag)
+		if err != nil {
+			return fmt.Errorf("--cpus: %v", err)
+		}
+		if err := linux.SetProcessAffinity(cpus); err != nil {
+			return err
+		}
+		numCPUs = cpus.Count()
+		runtime.GOMAXPROCS(numCPUs)
+	}
+
 	// Ensure that this process is always the one killed by the OOM killer
 	// (assuming nobody else in the system has this oom_score_adj). This lets us
 	// allocate memory extremely agressively without worrying about the main
@@ -60,47 +191,118 @@ func doMain() error {
 	// fast; I'm not sure if that's just a tuning problem or if hundreds of
 	// goroutines contending to send on a channel is inherently slow. Anyway, it
 	// turns out the dumbest possible thing is really fast: they can all just
-	// contend on an atomic variable which we then print in a loop.
+	// contend on an atomic variable which we then print periodically. (It
+	// used to be printed in a tight loop, but that burns a whole CPU that
+	// could be faulting pages in).
 	var allocedBytes atomic.Int64
-	go func() {
-		for {
+	// Held while printing, so that the last value printed before a --stop-at
+	// exit is the final one.
+	var printMu sync.Mutex
+	fmt.Printf("0\n")
+	go reportProgress(os.Stdout, &printMu, &allocedBytes, time.Duration(*reportIntervalMS)*time.Millisecond, nil)
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() {
+			printMu.Lock() // Never unlocked, we're exiting.
 			fmt.Printf("%d\n", allocedBytes.Load())
-		}
-	}()
+			os.Exit(0)
+		})
+	}
 
-	for {
-		// Make this bigger to reduce the number of syscalls and speed the benchmark
-		// up. Make it smaller to make the benchmark work on teeny weeny leedle
-		// computers. The code below assumes it's a multiple of the page size.
-		const mmapSize = 8 * pab.Gigabyte
-		data, err := mmap(int(mmapSize.Bytes()))
+	// Make this bigger to reduce the number of syscalls and speed the benchmark
+	// up. Make it smaller to make the benchmark work on teeny weeny leedle
+	// computers. The code below assumes it's a multiple of the page size.
+	mmapSize := 8 * pab.Gigabyte
+	pageSize := int64(os.Getpagesize()) // This is a syscall so just do it once.
+	var hugePageSize pab.ByteSize
+	if *hugePages {
+		hugePageSize, err = pab.DefaultHugePageSize()
 		if err != nil {
-			log.Fatalf("mmap(%s) failed. Computer too teeny? /proc/sys/vm/overcommit_memory set to 2? %v",
-				mmapSize, err)
+			return err
 		}
+		pageSize = hugePageSize.Bytes()
+		// hugetlb pages are reserved at mmap time, so mmap fails once
+		// they run out instead of anyone getting OOM-killed. Map them
+		// --alloc-size at a time so that doesn't happen too early.
+		mmapSize = max(allocSize-allocSize%hugePageSize, hugePageSize)
+	}
 
-		// Touch pages to actually fault them into memory, this is where the
-		// real allocation happens. We'll do this in parallel for speed. We
-		// divide the mmaped region into equally sized chunks and run a
-		// goroutine per chunk, to make them equally sized we just divide them
-		// into a power of two. I can't do maths with other numbers sorry.
-		goros := 1 << (63 - bits.LeadingZeros64(uint64(runtime.NumCPU())))
-		chunkSize := mmapSize.Bytes() / int64(goros)
-		pageSize := int64(os.Getpagesize()) // This is a syscall so just do it once.
+	// Touch pages to actually fault them into memory, this is where the
+	// real allocation happens. We'll do this in parallel for speed. We
+	// divide the region into chunks of whole pages and run a goroutine per
+	// chunk.
+	goros := int64(*touchGoros)
+	if goros <= 0 {
+		goros = 1 << (63 - bits.LeadingZeros64(uint64(numCPUs)))
+	}
+	touchAll := func(data []byte) {
+		bounds := splitPages(int64(len(data))/pageSize, goros)
 		var wg sync.WaitGroup
-		for chunkStart := int64(0); chunkStart < mmapSize.Bytes(); chunkStart += chunkSize {
+		for i := range goros {
 			wg.Add(1)
 			go func() {
-				for offset := int64(0); offset < chunkSize; offset += pageSize {
-					data[chunkStart+offset] = 0
-					allocedBytes.Add(int64(pageSize))
+				chunkStart := bounds[i] * pageSize
+				random := rand.New(rand.NewSource(chunkStart))
+				for pageStart := chunkStart; pageStart < bounds[i+1]*pageSize; pageStart += pageSize {
+					touch(data[pageStart:pageStart+pageSize], pattern, random)
+					if n := allocedBytes.Add(int64(pageSize)); stopAt != 0 && n >= stopAt.Bytes() {
+						stop()
+					}
 				}
 				wg.Done()
 			}()
 		}
-
 		wg.Wait()
 	}
+
+	if churnWindow != 0 {
+		// Fault the window in --alloc-size at a time, then keep going
+		// round it, dropping each chunk before faulting it in again. So
+		// RSS stays around the window size while the kernel keeps
+		// freeing and allocating pages.
+		window := churnWindow.RoundUpToPage().Bytes()
+		data, err := mmap(int(window), 0)
+		if err != nil {
+			return fmt.Errorf("mmap(%v) for churn window: %v", churnWindow, err)
+		}
+		chunkSize := min(max(allocSize.RoundUpToPage().Bytes(), pageSize), window)
+		for lap := 0; ; lap++ {
+			for start := int64(0); start < window; start += chunkSize {
+				chunk := data[start:min(start+chunkSize, window)]
+				if lap > 0 {
+					if err := linux.Madvise(chunk, linux.MADV_DONTNEED); err != nil {
+						return err
+					}
+				}
+				touchAll(chunk)
+			}
+		}
+	}
+
+	if *hugePages {
+		mmapFn := func(size pab.ByteSize) ([]byte, error) { return mmap(int(size.Bytes()), hugePageSize) }
+		for {
+			var data []byte
+			data, mmapSize, err = mmapHuge(mmapFn, mmapSize, hugePageSize, allocedBytes.Load() == 0)
+			if err != nil {
+				return err
+			}
+			if data == nil {
+				stop()
+			}
+			touchAll(data)
+		}
+	}
+
+	for {
+		data, err := mmap(int(mmapSize.Bytes()), 0)
+		if err != nil {
+			log.Fatalf("mmap(%s) failed. Computer too teeny? /proc/sys/vm/overcommit_memory set to 2? %v",
+				mmapSize, err)
+		}
+
+		touchAll(data)
+	}
 }
 
 func main() {
@@ -0,0 +1,211 @@
+// Copyright 2024 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/page_alloc_bench/pab"
+	"github.com/google/page_alloc_bench/workload/findlimit"
+)
+
+func TestTouch(t *testing.T) {
+	const pageSize = 4096
+	// Returns a page of 0xff with the given bytes changed.
+	pageWith := func(changes map[int]byte) []byte {
+		page := bytes.Repeat([]byte{0xff}, pageSize)
+		for i, b := range changes {
+			page[i] = b
+		}
+		return page
+	}
+	// Mirrors the random numbers the random-byte pattern uses.
+	mirror := rand.New(rand.NewSource(1))
+	for _, tc := range []struct {
+		pattern findlimit.TouchPattern
+		want    func() []byte
+	}{
+		{
+			pattern: findlimit.TouchFirstByte,
+			want:    func() []byte { return pageWith(map[int]byte{0: 0}) },
+		},
+		{
+			pattern: findlimit.TouchWholePage,
+			want:    func() []byte { return bytes.Repeat([]byte{0xa5}, pageSize) },
+		},
+		{
+			pattern: findlimit.TouchRandomByte,
+			want: func() []byte {
+				i := mirror.Intn(pageSize)
+				return pageWith(map[int]byte{i: byte(mirror.Uint32())})
+			},
+		},
+	} {
+		random := rand.New(rand.NewSource(1))
+		for i := 0; i < 10; i++ {
+			page := pageWith(nil)
+			touch(page, tc.pattern, random)
+			if want := tc.want(); !bytes.Equal(page, want) {
+				t.Errorf("%s: touched page %d wrongly, got:\n%x\nwant:\n%x", tc.pattern, i, page, want)
+				break
+			}
+		}
+	}
+}
+
+func TestSplitPages(t *testing.T) {
+	for _, tc := range []struct {
+		numPages, n int64
+		want        []int64
+	}{
+		{numPages: 8, n: 4, want: []int64{0, 2, 4, 6, 8}},
+		{numPages: 10, n: 4, want: []int64{0, 3, 6, 8, 10}},
+		{numPages: 2, n: 4, want: []int64{0, 1, 2, 2, 2}},
+		{numPages: 0, n: 2, want: []int64{0, 0, 0}},
+		{numPages: 5, n: 1, want: []int64{0, 5}},
+	} {
+		if got := splitPages(tc.numPages, tc.n); !slices.Equal(got, tc.want) {
+			t.Errorf("splitPages(%d, %d) = %v, want %v", tc.numPages, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestReportProgress(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	var (
+		out     bytes.Buffer
+		mu      sync.Mutex
+		counter atomic.Int64
+	)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	start := time.Now()
+	go func() {
+		reportProgress(&out, &mu, &counter, interval, done)
+		close(stopped)
+	}()
+
+	// Count as fast as possible for a while, then stop and give it time to
+	// print the final value.
+	for time.Since(start) < 10*interval {
+		counter.Add(4096)
+	}
+	time.Sleep(3 * interval)
+	close(done)
+	<-stopped
+	elapsed := time.Since(start)
+
+	lines := strings.Fields(out.String())
+	if limit := int(elapsed/interval) + 1; len(lines) > limit {
+		t.Errorf("printed %d lines in %v, want at most one per %v (%d)", len(lines), elapsed, interval, limit)
+	}
+	last := int64(0)
+	for _, line := range lines {
+		n, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			t.Fatalf("printed %q, want a number", line)
+		}
+		if n <= last {
+			t.Errorf("printed %d after %d, want only increasing values", n, last)
+		}
+		last = n
+	}
+	if want := counter.Load(); last != want {
+		t.Errorf("last printed %d, want the final value %d", last, want)
+	}
+}
+
+// Fakes mmapping from a pool of free huge pages, recording the sizes tried.
+type fakeHugePool struct {
+	free     int64
+	pageSize pab.ByteSize
+	tried    []pab.ByteSize
+}
+
+func (p *fakeHugePool) mmap(size pab.ByteSize) ([]byte, error) {
+	p.tried = append(p.tried, size)
+	pages := size.Bytes() / p.pageSize.Bytes()
+	if pages > p.free {
+		return nil, syscall.ENOMEM
+	}
+	p.free -= pages
+	return make([]byte, size.Bytes()), nil
+}
+
+func TestMmapHuge(t *testing.T) {
+	const hugePageSize = 2 * pab.Megabyte
+	for _, tc := range []struct {
+		desc      string
+		freePages int64
+		size      pab.ByteSize
+	}{
+		{desc: "fits", freePages: 100, size: 16 * pab.Megabyte},
+		{desc: "shrinks", freePages: 13, size: 64 * pab.Megabyte},
+		{desc: "not a power of two pages", freePages: 5, size: 22 * pab.Megabyte},
+		{desc: "one page at a time", freePages: 3, size: hugePageSize},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			pool := &fakeHugePool{free: tc.freePages, pageSize: hugePageSize}
+			var mapped int64
+			size := tc.size
+			for first := true; ; first = false {
+				data, next, err := mmapHuge(pool.mmap, size, hugePageSize, first)
+				if err != nil {
+					t.Fatalf("mmapHuge(%v) with %d pages left: %v", size, pool.free, err)
+				}
+				if data == nil {
+					break
+				}
+				if int64(len(data)) != next.Bytes() {
+					t.Errorf("mmapHuge returned %d bytes, and %v as the size that worked", len(data), next)
+				}
+				mapped += int64(len(data))
+				size = next
+			}
+			if want := tc.freePages * hugePageSize.Bytes(); mapped != want {
+				t.Errorf("mapped %d bytes in total, want the whole pool of %d", mapped, want)
+			}
+			for _, size := range pool.tried {
+				if size < hugePageSize || size%hugePageSize != 0 {
+					t.Errorf("tried to map %v, want a whole number of huge pages", size)
+				}
+			}
+		})
+	}
+}
+
+func TestMmapHugeEmptyPool(t *testing.T) {
+	pool := &fakeHugePool{pageSize: 2 * pab.Megabyte}
+	_, _, err := mmapHuge(pool.mmap, 8*pab.Megabyte, pool.pageSize, true)
+	if err == nil || !strings.Contains(err.Error(), "nr_hugepages") {
+		t.Errorf("mmapHuge from an empty pool returned %v, want an error pointing at nr_hugepages", err)
+	}
+
+	// Other errors aren't mistaken for running out.
+	_, _, err = mmapHuge(func(pab.ByteSize) ([]byte, error) { return nil, syscall.EINVAL }, pool.pageSize, pool.pageSize, true)
+	if !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("mmapHuge with failing mmap returned %v, want EINVAL", err)
+	}
+}
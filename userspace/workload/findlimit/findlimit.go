@@ -27,23 +27,110 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/google/page_alloc_bench/linux"
 	"github.com/google/page_alloc_bench/pab"
 )
 
+// TouchPattern is how the child dirties the pages it allocates. This can
+// matter if the kernel does stuff like KSM or zswap, since those care about
+// page contents.
+type TouchPattern string
+
+const (
+	// Write a zero to the first byte of each page. Just enough to fault it.
+	TouchFirstByte TouchPattern = "first-byte"
+	// Write a non-zero value to every byte of the page.
+	TouchWholePage TouchPattern = "whole-page"
+	// Write a random value to a random byte of the page.
+	TouchRandomByte TouchPattern = "random-byte"
+)
+
+// ParseTouchPattern returns an error if s isn't one of the TouchPattern values.
+func ParseTouchPattern(s string) (TouchPattern, error) {
+	switch p := TouchPattern(s); p {
+	case TouchFirstByte, TouchWholePage, TouchRandomByte:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown touch pattern %q, want %s, %s or %s",
+		s, TouchFirstByte, TouchWholePage, TouchRandomByte)
+}
+
 type Options struct {
 	AllocSize pab.ByteSize // Optional.
+	// Optional, defaults to TouchFirstByte.
+	TouchPattern TouchPattern
+	// Optional. If set, the child stops and exits cleanly once it has
+	// allocated this much, instead of running until it gets OOM-killed.
+	// This is less disruptive, but only tells you whether the system could
+	// provide this much. If it can't the child still gets OOM-killed, then
+	// Result.Allocated is less than this.
+	StopAt pab.ByteSize
+	// Optional. Number of goroutines the child touches pages with. By
+	// default it's the biggest power of two up to the number of CPUs.
+	TouchGoroutines int
+	// Allocate the kernel's default-sized hugetlb pages instead of base
+	// pages. These come from the huge page pool (see
+	// /proc/sys/vm/nr_hugepages and nr_overcommit_hugepages) rather than
+	// overcommitting, so instead of getting OOM-killed the child exits
+	// cleanly once the pool can't provide another one.
+	HugePages bool
+	// Optional. If set, the child only keeps this much memory mapped.
+	// Once it's all faulted in, the child goes back round it, dropping
+	// the oldest pages with MADV_DONTNEED before faulting them in again.
+	// This exercises the allocator's freeing and reuse paths rather than
+	// just growing until OOM. It never finishes on its own, so StopAt is
+	// required, and then counts the total bytes faulted in. Incompatible
+	// with HugePages.
+	ChurnWindow pab.ByteSize
+	// Optional. If set, this is updated with the number of bytes allocated
+	// so far as the child reports them.
+	Progress *atomic.Int64
+	// Optional. How often the child reports the number of bytes allocated
+	// so far, to a resolution of 1ms. The last report before it gets
+	// OOM-killed is Result.Allocated, so this bounds how stale that can be,
+	// but reporting more often takes CPU time from faulting pages in.
+	// Defaults to 50ms.
+	ReportInterval time.Duration
+	// Optional. If set, the child runs on these CPUs instead of inheriting
+	// the calling process' affinity, which might have been confined to
+	// housekeeping CPUs.
+	CPUs linux.CPUMask
+	// Optional. Path of the child binary. By default it's the one built
+	// alongside the running executable.
+	ChildPath string
 }
 
 type Result struct {
 	Allocated pab.ByteSize
+	// From starting the child process to it dying. This reflects how fast
+	// the kernel can fault in and reclaim memory.
+	Duration time.Duration
+	// The child's peak resident set size, according to the kernel. Allocated
+	// comes from the child's own progress output, which can lag behind what
+	// it actually allocated by the time it got killed. Zero if unavailable.
+	PeakRSS pab.ByteSize
+	// Base pages faulted in per second, over Duration. Mostly interesting
+	// with Options.ChurnWindow, where this is the sustained throughput.
+	FaultRate float64
 }
 
-func readLastLine(r io.Reader) (string, error) {
+// Reads lines until EOF and returns the last one. If progress is non-nil, it's
+// set to each line that parses as an int.
+func readLastLine(r io.Reader, progress *atomic.Int64) (string, error) {
 	scanner := bufio.NewScanner(r)
 	var line string
 	for scanner.Scan() {
 		line = scanner.Text()
+		if progress == nil {
+			continue
+		}
+		if n, err := strconv.ParseInt(line, 10, 64); err == nil {
+			progress.Store(n)
+		}
 	}
 	if err := scanner.Err(); err != nil {
 		return "", err
@@ -51,26 +138,71 @@ func readLastLine(r io.Reader) (string, error) {
 	return line, nil
 }
 
+// Returns the peak RSS from an exited process' os.ProcessState.SysUsage, zero
+// if unavailable.
+func peakRSS(sysUsage any) pab.ByteSize {
+	rusage, ok := sysUsage.(*syscall.Rusage)
+	if !ok || rusage == nil {
+		return 0
+	}
+	return pab.ByteSize(rusage.Maxrss) * pab.Kilobyte // It's in KiB.
+}
+
+// Run runs a child process that allocates memory until it gets OOM-killed (or
+// reaches opts.StopAt). Each child tries to eat all the memory in the system,
+// so callers running several concurrently should bound them, otherwise a big
+// machine can get wedged.
 func Run(ctx context.Context, opts *Options) (*Result, error) {
-	myPath, err := os.Executable()
-	if err != nil {
-		return nil, fmt.Errorf("getting executable path: %v\n", err)
+	path := opts.ChildPath
+	if path == "" {
+		myPath, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("getting executable path: %v\n", err)
+		}
+		path = filepath.Join(filepath.Dir(myPath), "workload", "findlimit", "child", "child")
 	}
-	path := filepath.Join(filepath.Dir(myPath), "workload", "findlimit", "child", "child")
 	size := opts.AllocSize
 	if size == pab.ByteSize(0) {
 		size = 128 * pab.Megabyte
 	}
-	cmd := exec.CommandContext(ctx, path, fmt.Sprintf("--alloc-size=%d", size.Bytes()))
+	// The child assumes whole pages.
+	size = size.RoundUpToPage()
+	if opts.ChurnWindow != 0 && opts.StopAt == 0 {
+		return nil, fmt.Errorf("findlimit ChurnWindow requires StopAt")
+	}
+	if opts.ChurnWindow != 0 && opts.HugePages {
+		return nil, fmt.Errorf("findlimit ChurnWindow and HugePages are incompatible")
+	}
+	if opts.ReportInterval != 0 && opts.ReportInterval < time.Millisecond {
+		return nil, fmt.Errorf("findlimit ReportInterval must be at least 1ms, got %v", opts.ReportInterval)
+	}
+	touchPattern := opts.TouchPattern
+	if touchPattern == "" {
+		touchPattern = TouchFirstByte
+	}
+	args := []string{fmt.Sprintf("--alloc-size=%d", size.Bytes()),
+		fmt.Sprintf("--touch-pattern=%s", touchPattern),
+		fmt.Sprintf("--stop-at=%d", opts.StopAt.Bytes()),
+		fmt.Sprintf("--touch-goroutines=%d", opts.TouchGoroutines),
+		fmt.Sprintf("--huge-pages=%v", opts.HugePages),
+		fmt.Sprintf("--churn-window=%d", opts.ChurnWindow.Bytes())}
+	if opts.ReportInterval != 0 {
+		args = append(args, fmt.Sprintf("--report-interval-ms=%d", opts.ReportInterval.Milliseconds()))
+	}
+	if opts.CPUs.Count() != 0 {
+		args = append(args, fmt.Sprintf("--cpus=%s", opts.CPUs))
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
 	cmd.Stderr = os.Stderr
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, fmt.Errorf("setting up stdout pipe: %v\n", err)
 	}
+	start := time.Now()
 	if err := cmd.Start(); err != nil {
 		return nil, fmt.Errorf("starting workload subprocess: %v\n", err)
 	}
-	lastLine, err := readLastLine(stdout)
+	lastLine, err := readLastLine(stdout, opts.Progress)
 	if err != nil {
 		return nil, fmt.Errorf("reading workload subprocess output: %v\n", err)
 	}
@@ -81,23 +213,39 @@ func Run(ctx context.Context, opts *Options) (*Result, error) {
 	// the output as an int. Hopefully this will give us a more useful clue if
 	// something caused the workload to shut down immediately.
 	err = cmd.Wait()
-	if err == nil {
-		return nil, fmt.Errorf("expected workload subprocess to get OOM-killed, but it succeeded")
+	duration := time.Since(start)
+	// Cancellation kills the child with SIGKILL, don't mistake that for
+	// the OOM killer.
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
-	exitErr, ok := err.(*exec.ExitError)
-	if !ok {
-		return nil, fmt.Errorf("unexpected error waiting for workload subprocess: %v", err)
+	if err == nil && opts.StopAt == 0 && !opts.HugePages {
+		return nil, fmt.Errorf("expected workload subprocess to get OOM-killed, but it succeeded")
 	}
-	// Ideally we'd check that the signal was specifically SIGKILL here. But I
-	// dunno how to do that.
-	if cmd.ProcessState.Exited() {
-		return nil, fmt.Errorf("expected workload subprocessed to be killed by signal, but it exited (status %d)",
-			exitErr.ExitCode())
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, fmt.Errorf("unexpected error waiting for workload subprocess: %v", err)
+		}
+		if cmd.ProcessState.Exited() {
+			return nil, fmt.Errorf("expected workload subprocessed to be killed by signal, but it exited (status %d)",
+				exitErr.ExitCode())
+		}
+		// The OOM killer uses SIGKILL, anything else (e.g. SIGSEGV)
+		// means the child crashed.
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signal() != syscall.SIGKILL {
+			return nil, fmt.Errorf("expected workload subprocess to be killed by SIGKILL, but got %v", status.Signal())
+		}
 	}
 	numBytes, err := strconv.ParseInt(strings.TrimSpace(lastLine), 10, 64)
 	if err != nil {
 		return nil, fmt.Errorf("parsing last line of workload subprocess output (%q) as int: %v\n",
 			lastLine, err)
 	}
-	return &Result{pab.ByteSize(numBytes)}, nil
+	return &Result{
+		Allocated: pab.ByteSize(numBytes),
+		Duration:  duration,
+		PeakRSS:   peakRSS(cmd.ProcessState.SysUsage()),
+		FaultRate: float64(pab.ByteSize(numBytes).Pages()) / duration.Seconds(),
+	}, nil
 }
@@ -0,0 +1,253 @@
+// Copyright 2024 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+
+package findlimit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/page_alloc_bench/linux"
+	"github.com/google/page_alloc_bench/pab"
+)
+
+func TestPeakRSS(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		usage any
+		want  pab.ByteSize
+	}{
+		{name: "KiB", usage: &syscall.Rusage{Maxrss: 2048}, want: 2 * pab.Megabyte},
+		{name: "nil rusage", usage: (*syscall.Rusage)(nil), want: 0},
+		{name: "unavailable", usage: nil, want: 0},
+	} {
+		if got := peakRSS(tc.usage); got != tc.want {
+			t.Errorf("%s: peakRSS() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// Writes a shell script to use as the child, returns its path.
+func stubChild(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "child")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunStubChild(t *testing.T) {
+	// Reports 1MiB allocated then dies like it was OOM-killed.
+	path := stubChild(t, "echo 1048576\nkill -KILL $$\n")
+	result, err := Run(context.Background(), &Options{ChildPath: path})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.Allocated != pab.Megabyte {
+		t.Errorf("Allocated = %v, want 1MiB", result.Allocated)
+	}
+	// A shell's RSS is at least a few hundred KiB and much less than a GiB.
+	// Mixing up KiB and bytes would put it outside that range.
+	if result.PeakRSS < 100*pab.Kilobyte || result.PeakRSS > pab.Gigabyte {
+		t.Errorf("PeakRSS = %v, want a plausible size for a shell", result.PeakRSS)
+	}
+	if result.PeakRSS%pab.Kilobyte != 0 {
+		t.Errorf("PeakRSS = %d bytes, want a whole number of KiB", result.PeakRSS.Bytes())
+	}
+}
+
+func TestParseTouchPattern(t *testing.T) {
+	for _, s := range []string{"first-byte", "whole-page", "random-byte"} {
+		if got, err := ParseTouchPattern(s); err != nil || string(got) != s {
+			t.Errorf("ParseTouchPattern(%q) = %q, %v, want %q", s, got, err, s)
+		}
+	}
+	for _, s := range []string{"", "whole_page", "First-Byte"} {
+		if got, err := ParseTouchPattern(s); err == nil {
+			t.Errorf("ParseTouchPattern(%q) = %q, want error", s, got)
+		}
+	}
+}
+
+func TestRunDuration(t *testing.T) {
+	path := stubChild(t, "sleep 0.2\necho 1048576\nkill -KILL $$\n")
+	start := time.Now()
+	result, err := Run(context.Background(), &Options{ChildPath: path})
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.Duration < 200*time.Millisecond || result.Duration > elapsed {
+		t.Errorf("Duration = %v, want between 200ms and %v", result.Duration, elapsed)
+	}
+	if want := float64(pab.Megabyte.Pages()) / result.Duration.Seconds(); result.FaultRate != want {
+		t.Errorf("FaultRate = %v, want %v pages/s", result.FaultRate, want)
+	}
+}
+
+func TestRunStopAt(t *testing.T) {
+	// Allocates up to --stop-at then exits cleanly, like the real child.
+	path := stubChild(t, `for arg; do
+	case "$arg" in --stop-at=*) stop_at="${arg#--stop-at=}";; esac
+done
+echo "$stop_at"
+`)
+	result, err := Run(context.Background(), &Options{ChildPath: path, StopAt: 2 * pab.Megabyte})
+	if err != nil {
+		t.Fatalf("Run with StopAt: %v", err)
+	}
+	if result.Allocated != 2*pab.Megabyte {
+		t.Errorf("Allocated = %v, want 2MiB", result.Allocated)
+	}
+
+	// Without StopAt the child is meant to get OOM-killed, exiting is a
+	// bug.
+	if _, err := Run(context.Background(), &Options{ChildPath: path}); err == nil {
+		t.Errorf("Run without StopAt succeeded when the child exited")
+	}
+}
+
+// Runs a stub child with opts, returns its value for the given flag, or "" if
+// it wasn't passed.
+func childFlag(t *testing.T, opts *Options, name string) string {
+	t.Helper()
+	argsPath := filepath.Join(t.TempDir(), "args")
+	opts.ChildPath = stubChild(t, fmt.Sprintf("echo \"$@\" >%s\necho 4096\nkill -KILL $$\n", argsPath))
+	if _, err := Run(context.Background(), opts); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	args, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range strings.Fields(string(args)) {
+		if value, ok := strings.CutPrefix(arg, "--"+name+"="); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func TestRunCPUs(t *testing.T) {
+	for _, tc := range []struct {
+		cpus linux.CPUMask
+		want string
+	}{
+		{cpus: nil, want: ""},
+		{cpus: linux.NewCPUMask(0, 1, 2, 5), want: "0-2,5"},
+	} {
+		if got := childFlag(t, &Options{CPUs: tc.cpus}, "cpus"); got != tc.want {
+			t.Errorf("with CPUs %s, got --cpus=%q, want %q", tc.cpus, got, tc.want)
+		}
+	}
+}
+
+func TestRunReportInterval(t *testing.T) {
+	for _, tc := range []struct {
+		interval time.Duration
+		want     string
+	}{
+		{interval: 0, want: ""}, // The child's default.
+		{interval: 200 * time.Millisecond, want: "200"},
+	} {
+		if got := childFlag(t, &Options{ReportInterval: tc.interval}, "report-interval-ms"); got != tc.want {
+			t.Errorf("with ReportInterval %v, got --report-interval-ms=%q, want %q", tc.interval, got, tc.want)
+		}
+	}
+	for _, interval := range []time.Duration{-time.Millisecond, time.Microsecond} {
+		if _, err := Run(context.Background(), &Options{ReportInterval: interval}); err == nil {
+			t.Errorf("Run with ReportInterval %v succeeded, want error", interval)
+		}
+	}
+}
+
+func TestReadLastLine(t *testing.T) {
+	for _, tc := range []struct {
+		name, output string
+		want         string
+		wantProgress int64
+	}{
+		{name: "throttled", output: "0\n4096\n1048576\n", want: "1048576", wantProgress: 1048576},
+		// Killed while printing the final value.
+		{name: "no trailing newline", output: "0\n4096\n8192", want: "8192", wantProgress: 8192},
+		{name: "only the initial report", output: "0\n", want: "0", wantProgress: 0},
+		// Progress keeps the last number.
+		{name: "junk at the end", output: "0\n4096\noops\n", want: "oops", wantProgress: 4096},
+	} {
+		var progress atomic.Int64
+		got, err := readLastLine(strings.NewReader(tc.output), &progress)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %q (err %v), want %q", tc.name, got, err, tc.want)
+		}
+		if got := progress.Load(); got != tc.wantProgress {
+			t.Errorf("%s: got progress %d, want %d", tc.name, got, tc.wantProgress)
+		}
+	}
+}
+
+func TestRunRejectsCrashes(t *testing.T) {
+	for _, tc := range []struct {
+		name, script, want string
+	}{
+		{name: "SIGSEGV", script: "echo 4096\nkill -SEGV $$\n", want: "SIGKILL"},
+		{name: "SIGTERM", script: "echo 4096\nkill -TERM $$\n", want: "SIGKILL"},
+		{name: "exit status", script: "echo 4096\nexit 3\n", want: "status 3"},
+	} {
+		_, err := Run(context.Background(), &Options{ChildPath: stubChild(t, tc.script)})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: Run returned %v, want error mentioning %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestRunChurnWindow(t *testing.T) {
+	// Reports the --churn-window it was given, then exits like it hit
+	// --stop-at.
+	path := stubChild(t, `for arg; do
+	case "$arg" in --churn-window=*) echo "${arg#--churn-window=}";; esac
+done
+`)
+	for _, tc := range []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{name: "with StopAt", opts: Options{ChurnWindow: pab.Megabyte, StopAt: pab.Gigabyte}},
+		{name: "without StopAt", opts: Options{ChurnWindow: pab.Megabyte}, wantErr: true},
+		{name: "with HugePages", opts: Options{ChurnWindow: pab.Megabyte, StopAt: pab.Gigabyte, HugePages: true}, wantErr: true},
+	} {
+		tc.opts.ChildPath = path
+		result, err := Run(context.Background(), &tc.opts)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: Run succeeded, want error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Run: %v", tc.name, err)
+		} else if result.Allocated != pab.Megabyte {
+			t.Errorf("%s: child got --churn-window=%d, want %d", tc.name, result.Allocated.Bytes(), pab.Megabyte.Bytes())
+		}
+	}
+}
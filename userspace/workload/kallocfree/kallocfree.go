@@ -25,6 +25,7 @@ import (
 	"math/rand"
 	"os"
 	"runtime"
+	"slices"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -42,41 +43,281 @@ type Options struct {
 	TestDataPath     string
 	Order            int // Allocation order (i.e. alloc_pages arg).
 	MeasureLatencies bool
+	// Optional. Relative weights for randomly picking the order of each
+	// allocation, overrides Order. See also Profiles.
+	OrderWeights map[int]float64
+	// Requires MeasureLatencies. Every other free is immediately followed by
+	// an allocation of the same order ("warm", probably served from the page
+	// that was just freed), measured separately from other allocations
+	// ("cold"). With CrossCPUFree, only pages freed on the worker's own CPU
+	// are followed by a warm allocation.
+	MeasureWarmCold bool
+	// Optional. Whether to count NUMA-remote allocations. This costs a map
+	// lookup on every allocation so by default it's only done on systems with
+	// multiple NUMA nodes.
+	TrackNUMA *bool
+	// Optional. The file created by the kernel module, by default
+	// kmod.DefaultDevicePath.
+	DevicePath string
+	// Optional. Map from CPU number to NUMA node ID. By default this is read
+	// from sysfs (see linux.CPUToNode).
+	CPUToNode map[int]int
+	// Instead of freeing pages on the CPU that allocated them, hand them off
+	// to be freed by the worker for the next CPU. This models the common
+	// pattern of a page getting freed on a different CPU than allocated it.
+	CrossCPUFree bool
+	// When an allocation fails with ENOMEM, immediately retry at each lower
+	// order down to 0 before backing off, like many kernel callers do.
+	FallbackOrders bool
+	// If nonzero, instead of bouncing around a fixed number of pages, the
+	// workers allocate (without freeing) until MemFree in /proc/meminfo drops
+	// below this, then hold their pages, resuming if it rises again.
+	FillToMemFree pab.ByteSize
+	// If nonzero, periodically probe the largest order that can currently be
+	// allocated (up to MaxProbeOrder), to see fragmentation develop over the
+	// run. See Result.MaxOrderProbes.
+	ProbeMaxOrderInterval time.Duration
+	MaxProbeOrder         int // Defaults to DefaultMaxProbeOrder.
+	// Optional. CPUs to run workers on, one per CPU. By default this is the
+	// affinity of the thread calling New, so that it respects any cpuset
+	// the process is confined to.
+	CPUs linux.CPUMask
+	// If nonzero, seed the latency sampling deterministically from this, so
+	// that given the same latencies the same samples are reported. By
+	// default it's seeded from the current time.
+	SamplingSeed int64
+	// If set, allocation latencies are also counted into a histogram with
+	// these bucket bounds, see sampling.NewHistogram. Requires
+	// MeasureLatencies.
+	LatencyHistogramBounds []time.Duration
+	// If set, all pages are allocated from this NUMA node, even by workers
+	// on CPUs in other nodes. Allocations fail rather than falling back to
+	// other nodes, so this can drive deliberate cross-node traffic.
+	AllocNode *int
+	// kmod.GFP* flags for the workload's allocations. Zero means GFP_KERNEL.
+	GFP uint
+	// Fill each page with a pattern specific to the allocating worker, and
+	// check it's intact when the page is freed. See Result.Corruptions.
+	// Incompatible with CrossCPUFree. Pages freed when the workload stops
+	// aren't checked.
+	VerifyContents bool
+	// Each worker repeatedly picks a target number of allocations held,
+	// uniformly at random within SwingPages either side of TargetPages, then
+	// allocates or frees until it's there. Defaults to DefaultTargetPages and
+	// DefaultSwingPages. Set SwingPages to 1 for a fixed working set. Not
+	// used with FillToMemFree.
+	TargetPages int
+	SwingPages  int
+	// Workers only allocate, until they each hold their share of
+	// TotalMemory, then hold the pages until the workload stops. The steady
+	// state is reached once they're all there. This measures pure
+	// allocation cost, and leaves memory low. Incompatible with
+	// FillToMemFree.
+	NoFree bool
 }
 
+// Defaults for Options.TargetPages and Options.SwingPages.
+const (
+	DefaultTargetPages = 1000
+	DefaultSwingPages  = 1000
+)
+
+// DefaultMaxProbeOrder is the default for Options.MaxProbeOrder. Matches the
+// usual MAX_PAGE_ORDER on x86.
+const DefaultMaxProbeOrder = 10
+
+// MaxOrderProbe is the result of probing the largest allocatable order.
+type MaxOrderProbe struct {
+	Time  time.Duration // Since the workload started.
+	Order int           // -1 if even order 0 failed.
+}
+
+// Profiles are preset OrderWeights that mimic the mix of allocation orders seen
+// from some kernel subsystems. These are rough approximations, if you care about
+// a specific workload you should measure it (e.g. via the kmem:mm_page_alloc
+// tracepoint) and set OrderWeights yourself.
+var Profiles = map[string]map[int]float64{
+	// Mostly order-0 for page pools and skb data, plus order-3 for skb page
+	// frags (SKB_FRAG_PAGE_ORDER) and a bit of order-1/2 for larger skb heads.
+	"networking": {0: 0.75, 1: 0.05, 2: 0.05, 3: 0.15},
+	// Mostly order-0 page cache, plus large folios for readahead and
+	// writeback.
+	"filesystem": {0: 0.85, 2: 0.10, 4: 0.05},
+}
+
+// Upper bound on NUMA node IDs, the kernel's MAX_NUMNODES with the biggest
+// NODES_SHIFT.
+const maxNodes = 1024
+
 type stats struct {
 	pagesAllocated        atomic.Uint64
 	pagesFreed            atomic.Uint64
 	allocFailures         atomic.Uint64
+	freeFailures          atomic.Uint64
 	numaRemoteAllocations atomic.Uint64
-	allocLatencies        []*sampling.Reservoir[time.Duration] // Per CPU worker.
-	freeLatencies         []*sampling.Reservoir[time.Duration] // Per CPU worker.
+	zoneAllocations       [kmod.MaxZones]atomic.Uint64
+	orderAllocations      [kmod.NumOrders]atomic.Uint64
+	orderFrees            [kmod.NumOrders]atomic.Uint64
+	nodeAllocations       [maxNodes]atomic.Uint64 // Only for trackNUMA.
+	backoffNS             atomic.Int64            // Summed across all CPU workers.
+	crossCPUFrees         atomic.Uint64
+	implausibleLatencies  atomic.Uint64
+	corruptions           atomic.Uint64
+	// Only for FallbackOrders. Indexed by the order that the fallback
+	// succeeded at.
+	fallbacks     []atomic.Uint64
+	allocSamples  []*sampling.Stats[AllocSample]   // Per CPU worker.
+	freeLatencies []*sampling.Stats[time.Duration] // Per CPU worker.
+	// Only for MeasureWarmCold.
+	warmAllocLatencies []*sampling.Reservoir[time.Duration] // Per CPU worker.
+	coldAllocLatencies []*sampling.Reservoir[time.Duration] // Per CPU worker.
+	// Only when tracking NUMA. freeLatencies split by whether the page's
+	// node matched the freeing CPU's.
+	localFreeLatencies  []*sampling.Reservoir[time.Duration] // Per CPU worker.
+	remoteFreeLatencies []*sampling.Reservoir[time.Duration] // Per CPU worker.
+	numaRemoteFrees     atomic.Uint64
+	// Only for LatencyHistogramBounds.
+	allocLatencyHistograms []*sampling.Histogram // Per CPU worker.
+	// Seed for merging the per-worker reservoirs, zero means time-based.
+	mergeSeed int64
+}
+
+// AllocSample is a single sampled allocation, with some info about where it
+// came from.
+type AllocSample struct {
+	CPU     int // CPU that the allocation was done on.
+	Node    int // NUMA node of that worker's CPU.
+	Order   int
+	Latency time.Duration
 }
 
 type Result struct {
 	AllocFailures         uint64
 	PagesAllocated        uint64 // Only incremented; subtract pagesFreed to count leaks.
 	PagesFreed            uint64
-	NUMARemoteAllocations uint64          // Number of pages where page NID didn't match CPU's NID.
-	AllocLatencies        []time.Duration // Excludes userspace/syscall overhead. We only capture the last N allocations.
-	FreeLatencies         []time.Duration
+	FreeFailures          uint64         // Pages the kmod failed to free. Not included in PagesFreed.
+	NUMARemoteAllocations uint64         // Number of pages where page NID didn't match CPU's NID.
+	AllocationsByZone     map[int]uint64 // Zone index to number of allocations. Zones with no allocations are omitted.
+	TotalBackoff          time.Duration  // Time spent waiting after ENOMEM, summed across all CPU workers.
+	CrossCPUFrees         uint64         // Pages freed by a different CPU worker than allocated them. Only for CrossCPUFree.
+	// Latency values from the kmod that were negative or absurdly large.
+	// These are excluded from the latency samples.
+	ImplausibleLatencies uint64
+	// Only for ProbeMaxOrderInterval, in chronological order.
+	MaxOrderProbes []MaxOrderProbe
+	// Only for FallbackOrders. Maps order to the number of allocations that
+	// failed at their original order and then succeeded at that one. Orders
+	// with no fallbacks are omitted.
+	Fallbacks          map[int]uint64
+	AllocLatencies     []time.Duration // Excludes userspace/syscall overhead. We only capture the last N allocations.
+	AllocSamples       []AllocSample   // Same samples as AllocLatencies, with attribution.
+	FreeLatencies      []time.Duration
+	WarmAllocLatencies []time.Duration // Only for MeasureWarmCold. Also included in AllocLatencies.
+	ColdAllocLatencies []time.Duration // Ditto.
+	// AllocLatencies split up by the NUMA node of the CPU doing the
+	// allocation. Only when there are multiple NUMA nodes.
+	AllocLatenciesByNode map[int][]time.Duration
+	// Only when there are multiple NUMA nodes. Number of pages freed on a
+	// CPU in a different node from the page, and the latencies of frees
+	// split up on that basis.
+	NUMARemoteFrees     uint64
+	LocalFreeLatencies  []time.Duration
+	RemoteFreeLatencies []time.Duration
+	// Only for MeasureLatencies. Exact extremes of the latencies, which the
+	// samples above are likely to miss. Zero if there were no latencies.
+	MinAllocLatency, MaxAllocLatency time.Duration
+	MinFreeLatency, MaxFreeLatency   time.Duration
+	// Only for LatencyHistogramBounds. Allocation latency counts for each
+	// bucket, the last being the +Inf overflow bucket. Unlike the latency
+	// samples this counts every allocation.
+	AllocLatencyHistogram []uint64
+	// Only for VerifyContents. Pages whose contents changed while they
+	// were allocated.
+	Corruptions uint64
+	// Memory the kmod was still holding once the workload finished, which
+	// should be zero. This is across all users of the kmod, so it's only
+	// meaningful if nothing else is using it. -1 if the kmod doesn't
+	// report it.
+	KmodBytesHeld pab.ByteSize
+	// Order to number of allocations and frees, which is interesting with
+	// Options.OrderWeights. Orders with none are omitted.
+	AllocationsByOrder map[int]uint64
+	FreesByOrder       map[int]uint64
+	// Only when there are multiple NUMA nodes. Node ID of the page to number
+	// of allocations. Nodes with none are omitted.
+	AllocationsByNode map[int]uint64
+}
+
+// Returns a map from index to value for the nonzero counters.
+func nonZeroCounts(counters []atomic.Uint64) map[int]uint64 {
+	counts := make(map[int]uint64)
+	for i := range counters {
+		if n := counters[i].Load(); n != 0 {
+			counts[i] = n
+		}
+	}
+	return counts
 }
 
 func (s *stats) String() string {
 	return fmt.Sprintf("pagesAllocated=%d pagesFreed=%d ", s.pagesAllocated.Load(), s.pagesFreed.Load())
 }
 
+// The parts of kmod.Connection the workload uses, so that tests can fake them.
+type kmodConn interface {
+	AllocPage(order int) (*kmod.Page, error)
+	AllocPages(order, count int) ([]*kmod.Page, error)
+	FreePage(page *kmod.Page) (*time.Duration, error)
+	FreePages(pages []*kmod.Page) ([]time.Duration, error)
+	WritePage(page *kmod.Page, pattern byte) error
+	ChecksumPage(page *kmod.Page) (uint32, error)
+	Stats() (kmod.KmodStats, error)
+	NewThread(cpus linux.CPUMask) (*kmod.Thread, error)
+	Close() error
+}
+
+// The parts of kmod.Thread the workload uses, see kmodConn.
+type kmodThread interface {
+	AllocPageOnNodeGFPContext(ctx context.Context, order, nid int, gfp uint) (*kmod.Page, error)
+	FreePageContext(ctx context.Context, page *kmod.Page) (*time.Duration, error)
+}
+
 type Workload struct {
-	kmod               *kmod.Connection
+	kmod               kmodConn
 	stats              *stats
 	testDataPath       string // Path to a file with some data in it. Optional.
 	pagesPerCPU        int64
+	cpus               []int        // CPU for each worker.
+	threads            []kmodThread // For each worker, pinned to the same CPU. Set by Run.
+	workerNodes        []int        // NUMA node of each worker's CPU.
 	numThreads         int
 	steadyStateThreads atomic.Int32
 	steadyStateReached chan struct{} // Will be closed when stateStateThreads reaches numThreads
 	cpuToNode          map[int]int
-	order              int
+	allocNode          int // -1 for any node.
+	gfp                uint
+	verifyContents     bool
+	contentChecksums   [][]uint32 // Only for verifyContents, expected checksums by worker then order.
+	orders             []int      // Orders to pick from...
+	orderCumWeights    []float64  // ...with these cumulative weights.
 	measureLatencies   bool
+	measureWarmCold    bool
+	trackNUMA          bool
+	lastFreeErrorLog   atomic.Int64 // UnixNano timestamp, for rate-limiting.
+	// Only for CrossCPUFree. Pages handed off by other workers, to be freed
+	// by the worker with the same index.
+	handoff        []chan *kmod.Page
+	fallbackOrders bool
+	// Only for FillToMemFree.
+	fillToMemFree pab.ByteSize
+	filled        atomic.Bool // Whether MemFree was below fillToMemFree when last checked.
+	readMeminfo   func() (*linux.Meminfo, error)
+	// Only for ProbeMaxOrderInterval.
+	probeMaxOrderInterval time.Duration
+	maxProbeOrder         int
+	// See Options.TargetPages.
+	targetPages, swingPages int
+	noFree                  bool
 }
 
 // Run once on the system before each iteration of the workload.
@@ -95,37 +336,246 @@ func (w *Workload) setup(ctx context.Context) error {
 	return err
 }
 
+// pageQueue is a FIFO of allocated pages. Unlike appending to a slice and
+// reslicing off the front, it reuses its backing array, so that the hot loop
+// doesn't churn the Go heap (GC activity would perturb the measurements).
+type pageQueue struct {
+	buf  []*kmod.Page
+	head int // Index in buf of the oldest page.
+	len  int
+}
+
+func (q *pageQueue) push(page *kmod.Page) {
+	if q.len == len(q.buf) {
+		// Full, grow it. Unwrap the contents while we're at it.
+		buf := make([]*kmod.Page, max(2*len(q.buf), 1024))
+		n := copy(buf, q.buf[q.head:])
+		copy(buf[n:], q.buf[:q.head])
+		q.buf = buf
+		q.head = 0
+	}
+	q.buf[(q.head+q.len)%len(q.buf)] = page
+	q.len++
+}
+
+// pop removes and returns the oldest page. The queue must not be empty.
+func (q *pageQueue) pop() *kmod.Page {
+	page := q.buf[q.head]
+	q.buf[q.head] = nil
+	q.head = (q.head + 1) % len(q.buf)
+	q.len--
+	return page
+}
+
+// Free pages that other workers handed off to this worker, without blocking.
+func (w *Workload) drainHandoff(ctx context.Context, worker int) error {
+	for {
+		select {
+		case page := <-w.handoff[worker]:
+			// Other failures are counted by freePageOnCPU.
+			if err := w.freePageOnCPU(ctx, worker, page); errors.Is(err, ErrModuleGone) {
+				return err
+			}
+			w.stats.crossCPUFrees.Add(1)
+		default:
+			return nil
+		}
+	}
+}
+
+// Try to pass a page to the next CPU's worker to free. Returns false if
+// that worker is backed up, in which case the caller still owns the page.
+func (w *Workload) handOff(worker int, page *kmod.Page) bool {
+	select {
+	case w.handoff[(worker+1)%w.numThreads] <- page:
+		return true
+	default:
+		return false
+	}
+}
+
+// How often to check MemFree for FillToMemFree. Workers also wait this long
+// between checking whether they should resume allocating.
+const memFreePollInterval = 100 * time.Millisecond
+
+// Periodically checks MemFree and updates w.filled, until ctx is cancelled.
+// For FillToMemFree.
+func (w *Workload) monitorMemFree(ctx context.Context) error {
+	steady := false
+	for {
+		meminfo, err := w.readMeminfo()
+		if err != nil {
+			return fmt.Errorf("reading meminfo: %v", err)
+		}
+		memFree, ok := meminfo.Sizes["MemFree"]
+		if !ok {
+			return fmt.Errorf("no MemFree in meminfo")
+		}
+		filled := memFree < w.fillToMemFree
+		w.filled.Store(filled)
+		// The steady state is when we first hit the target.
+		if filled && !steady {
+			close(w.steadyStateReached)
+			steady = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(memFreePollInterval):
+		}
+	}
+}
+
+// Returns the largest order up to w.maxProbeOrder that can be allocated right
+// now, or -1 if none can. Pages are freed immediately and don't count in the
+// stats.
+func (w *Workload) probeMaxOrder() (int, error) {
+	for order := 0; order <= w.maxProbeOrder; order++ {
+		page, err := w.kmod.AllocPage(order)
+		if errors.Is(err, syscall.ENOMEM) {
+			return order - 1, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("allocating order %d page: %w", order, err)
+		}
+		if _, err := w.kmod.FreePage(page); err != nil {
+			return 0, fmt.Errorf("freeing order %d page: %w", order, err)
+		}
+	}
+	return w.maxProbeOrder, nil
+}
+
+// Calls probeMaxOrder periodically until ctx is cancelled, returns the
+// results.
+func (w *Workload) probeMaxOrderSeries(ctx context.Context) ([]MaxOrderProbe, error) {
+	var probes []MaxOrderProbe
+	start := time.Now()
+	for {
+		order, err := w.probeMaxOrder()
+		if errors.Is(err, syscall.ENODEV) {
+			return probes, ErrModuleGone
+		}
+		if err != nil {
+			return probes, err
+		}
+		probes = append(probes, MaxOrderProbe{Time: time.Since(start), Order: order})
+
+		select {
+		case <-ctx.Done():
+			return probes, nil
+		case <-time.After(w.probeMaxOrderInterval):
+		}
+	}
+}
+
+// Alternative to runCPU for FillToMemFree.
+func (w *Workload) runCPUFill(ctx context.Context, worker int) error {
+	var pages pageQueue
+	defer func() {
+		var remaining []*kmod.Page
+		for pages.len > 0 {
+			remaining = append(remaining, pages.pop())
+		}
+		w.freePagesOnCPU(worker, remaining)
+	}()
+
+	random := rand.New(rand.NewSource(int64(worker)))
+	for ctx.Err() == nil {
+		if w.filled.Load() {
+			select {
+			case <-ctx.Done():
+			case <-time.After(memFreePollInterval):
+			}
+			continue
+		}
+		page, err := w.allocPageOnCPU(ctx, w.pickOrder(random), worker)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		pages.push(page)
+	}
+	return nil
+}
+
+// Alternative to runCPU for NoFree.
+func (w *Workload) runCPUNoFree(ctx context.Context, worker int) error {
+	var pages pageQueue
+	defer func() {
+		var remaining []*kmod.Page
+		for pages.len > 0 {
+			remaining = append(remaining, pages.pop())
+		}
+		w.freePagesOnCPU(worker, remaining)
+	}()
+
+	random := rand.New(rand.NewSource(int64(worker)))
+	held := int64(0) // In base pages.
+	for held < w.pagesPerCPU {
+		page, err := w.allocPageOnCPU(ctx, w.pickOrder(random), worker)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		pages.push(page)
+		held += 1 << page.Order
+	}
+	w.markSteady()
+	<-ctx.Done()
+	return nil
+}
+
+// Called by each worker once it reaches its steady state.
+func (w *Workload) markSteady() {
+	if w.steadyStateThreads.Add(1) >= int32(w.numThreads) {
+		close(w.steadyStateReached)
+	}
+}
+
 // per-CPU element of a workload. Assumes that the calling goroutine is already
-// pinned to an appropriate CPU.
-func (w *Workload) runCPU(ctx context.Context, cpu int) error {
-	var pages []*kmod.Page
+// pinned to the worker's CPU.
+func (w *Workload) runCPU(ctx context.Context, worker int) error {
+	var pages pageQueue
 
 	defer func() {
-		for _, page := range pages {
-			w.freePageOnCPU(cpu, page)
+		var remaining []*kmod.Page
+		for pages.len > 0 {
+			remaining = append(remaining, pages.pop())
 		}
+		w.freePagesOnCPU(worker, remaining)
 	}()
 
 	// Give each CPU its own pattern of behaviour, but keep the pattern
 	// stable between runs (at least for the same build)..
-	random := rand.New(rand.NewSource(int64(cpu)))
+	random := rand.New(rand.NewSource(int64(worker)))
 	steady := false
 
 	for ctx.Err() == nil {
+		if w.handoff != nil {
+			if err := w.drainHandoff(ctx, worker); err != nil {
+				return err
+			}
+		}
+
 		// Pattern is to allocate and free in alternate bursts while
 		// keeping the overall number of allocated pages bouncing around
 		// a roughly stable "middle" value.
-		middle := 1000
+		middle := w.targetPages
 		var target int
 		if random.Uint32()%2 == 0 {
-			target = middle + (int(random.Uint64() % 1000))
+			target = middle + (int(random.Uint64() % uint64(w.swingPages)))
 		} else {
-			target = middle - (int(random.Uint64() % 1000))
+			target = middle - (int(random.Uint64() % uint64(w.swingPages)))
 		}
 
 		// Allocate up to target.
-		for len(pages) < target {
-			page, err := w.allocPageOnCPU(ctx, w.order, cpu)
+		for pages.len < target {
+			page, err := w.allocPageOnCPU(ctx, w.pickOrder(random), worker)
 			if err != nil {
 				if ctx.Err() != nil {
 					// Don't care about this error, and it's
@@ -134,90 +584,310 @@ func (w *Workload) runCPU(ctx context.Context, cpu int) error {
 				}
 				return err
 			}
-			pages = append(pages, page)
+			pages.push(page)
+			if w.measureWarmCold && plausibleLatency(page.Latency) {
+				w.stats.coldAllocLatencies[worker].Add(page.Latency)
+			}
 
 			// We are steady once we hit the middle at least once.
 			// Note it might take a few iterations before we hit
 			// this point, that's fine.
-			if len(pages) == middle && !steady {
-				if w.steadyStateThreads.Add(1) >= int32(w.numThreads) {
-					close(w.steadyStateReached)
-				}
+			if pages.len == middle && !steady {
+				w.markSteady()
 				steady = true
 			}
 		}
 
 		// Free down to target.
-		for len(pages) > target {
-			if err := w.freePageOnCPU(cpu, pages[0]); err != nil {
-				return fmt.Errorf("freeing page: %v", err)
+		warm := false
+		for pages.len > target {
+			page := pages.pop()
+			order := page.Order
+			freed := false
+			if w.handoff == nil || !w.handOff(worker, page) {
+				// Other failures are counted by freePageOnCPU, the
+				// page is leaked but the workload carries on.
+				err := w.freePageOnCPU(ctx, worker, page)
+				if errors.Is(err, ErrModuleGone) {
+					return err
+				}
+				if ctx.Err() != nil {
+					return nil
+				}
+				freed = err == nil
+			}
+
+			// Only an allocation straight after a free on this CPU
+			// is warm, a page handed off to another CPU doesn't
+			// count.
+			if !w.measureWarmCold || !freed {
+				continue
+			}
+			warm = !warm
+			if !warm {
+				continue
+			}
+			page, err := w.allocPageOnCPU(ctx, order, worker)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			pages.push(page)
+			if plausibleLatency(page.Latency) {
+				w.stats.warmAllocLatencies[worker].Add(page.Latency)
 			}
-			pages = pages[1:]
 		}
 	}
 
 	return nil
 }
 
-// Allocate a page, update stats. Caller must be running on the stated CPU.
-func (w *Workload) allocPageOnCPU(ctx context.Context, order int, cpu int) (*kmod.Page, error) {
+// Randomly pick the order for an allocation according to the weights.
+func (w *Workload) pickOrder(random *rand.Rand) int {
+	if len(w.orders) == 1 {
+		return w.orders[0]
+	}
+	x := random.Float64() * w.orderCumWeights[len(w.orderCumWeights)-1]
+	for i, cum := range w.orderCumWeights {
+		if x < cum {
+			return w.orders[i]
+		}
+	}
+	return w.orders[len(w.orders)-1]
+}
+
+// Latencies reported by the kmod above this are assumed to be bogus, e.g. due
+// to a clock glitch or a kmod bug.
+const maxPlausibleLatency = 10 * time.Second
+
+func plausibleLatency(d time.Duration) bool {
+	return d >= 0 && d <= maxPlausibleLatency
+}
+
+// Like plausibleLatency but counts the rejects.
+func (w *Workload) checkLatency(d time.Duration) bool {
+	if plausibleLatency(d) {
+		return true
+	}
+	w.stats.implausibleLatencies.Add(1)
+	return false
+}
+
+// Allocate a page, update stats. Caller must be running on the worker's CPU.
+func (w *Workload) allocPageOnCPU(ctx context.Context, order int, worker int) (*kmod.Page, error) {
 	// Exponential backoff in case of allocation failures.
 	backoff := 500 * time.Millisecond
 	var page *kmod.Page
 	var err error
 	for {
-		page, err = w.kmod.AllocPage(order)
+		// Via the worker's thread, so that a slow allocation (e.g. stuck
+		// in reclaim) doesn't hold up cancellation.
+		thread := w.threads[worker]
+		page, err = thread.AllocPageOnNodeGFPContext(ctx, order, w.allocNode, w.gfp)
+		if w.fallbackOrders {
+			for fallback := order - 1; fallback >= 0 && errors.Is(err, syscall.ENOMEM); fallback-- {
+				page, err = thread.AllocPageOnNodeGFPContext(ctx, fallback, w.allocNode, w.gfp)
+				if err == nil {
+					w.stats.fallbacks[fallback].Add(1)
+				}
+			}
+		}
 		if errors.Is(err, syscall.ENOMEM) {
 			w.stats.allocFailures.Add(1)
+			start := time.Now()
 			select {
 			case <-time.After(backoff):
+				w.stats.backoffNS.Add(int64(time.Since(start)))
 				backoff += backoff / 2
 				continue
 			case <-ctx.Done():
+				w.stats.backoffNS.Add(int64(time.Since(start)))
 				return nil, ctx.Err()
 			}
 		}
 		break
 	}
+	if errors.Is(err, syscall.ENODEV) {
+		return nil, ErrModuleGone
+	}
 	if err != nil {
 		return nil, fmt.Errorf("allocating page: %v", err)
 	}
 
+	if w.verifyContents {
+		err := w.kmod.WritePage(page, contentPattern(worker))
+		if errors.Is(err, syscall.ENODEV) {
+			return nil, ErrModuleGone
+		}
+		if err != nil {
+			return nil, fmt.Errorf("writing page contents: %v", err)
+		}
+	}
+
 	w.stats.pagesAllocated.Add(1)
-	if page.NID != w.cpuToNode[cpu] {
+	w.stats.zoneAllocations[page.Zone].Add(1)
+	w.stats.orderAllocations[page.Order].Add(1)
+	if w.trackNUMA && page.NID != w.workerNodes[worker] {
 		w.stats.numaRemoteAllocations.Add(1)
 	}
-	if w.measureLatencies {
-		w.stats.allocLatencies[cpu].Add(page.Latency)
+	if w.trackNUMA && page.NID >= 0 && page.NID < maxNodes {
+		w.stats.nodeAllocations[page.NID].Add(1)
+	}
+	if w.measureLatencies && w.checkLatency(page.Latency) {
+		w.stats.allocSamples[worker].Add(AllocSample{
+			CPU:     w.cpus[worker],
+			Node:    w.workerNodes[worker],
+			Order:   page.Order,
+			Latency: page.Latency,
+		})
+		if w.stats.allocLatencyHistograms != nil {
+			w.stats.allocLatencyHistograms[worker].Add(page.Latency)
+		}
 	}
 	return page, nil
 }
 
-var freeErrorLogged = false
+// ErrModuleGone is returned by Run if the kernel module disappears (i.e. gets
+// unloaded) while the workload is running.
+var ErrModuleGone = errors.New("kernel module went away, was it unloaded?")
 
-// Free a page, update stats. Caller must be running on the stated CPU.
-func (w *Workload) freePageOnCPU(cpu int, page *kmod.Page) error {
-	latency, err := w.kmod.FreePage(page)
-	if err != nil && !freeErrorLogged {
+// Wraps ErrModuleGone with how many pages the module took with it.
+func (w *Workload) moduleGoneError() error {
+	outstanding := w.stats.pagesAllocated.Load() - w.stats.pagesFreed.Load() - w.stats.freeFailures.Load()
+	return fmt.Errorf("%w (%d pages were outstanding, unloading it should have freed them)",
+		ErrModuleGone, outstanding)
+}
+
+// Free errors tend to come all at once, don't spam more often than this.
+const freeErrorLogInterval = 10 * time.Second
+
+// Count a page that couldn't be freed, maybe log about it.
+func (w *Workload) recordFreeFailure(err error) {
+	w.stats.freeFailures.Add(1)
+	now := time.Now().UnixNano()
+	last := w.lastFreeErrorLog.Load()
+	if now-last >= int64(freeErrorLogInterval) && w.lastFreeErrorLog.CompareAndSwap(last, now) {
 		// The kmod also frees on rmmod so it might be OK.
-		fmt.Fprintf(os.Stderr, "Couldn't free one or more kernel pages, consider rebooting: %v\n", err)
-		freeErrorLogged = true
+		fmt.Fprintf(os.Stderr, "Couldn't free one or more kernel pages (%d failures so far), consider rebooting: %v\n",
+			w.stats.freeFailures.Load(), err)
+	}
+}
+
+// Free a batch of pages, for cleaning up at the end of the run. This doesn't
+// record latencies since frees in bulk aren't representative of the workload,
+// it only updates the counters. Caller must be running on the worker's CPU.
+func (w *Workload) freePagesOnCPU(worker int, pages []*kmod.Page) {
+	for len(pages) > 0 {
+		latencies, err := w.kmod.FreePages(pages)
+		w.stats.pagesFreed.Add(uint64(len(latencies)))
+		for _, page := range pages[:len(latencies)] {
+			w.stats.orderFrees[page.Order].Add(1)
+		}
+		if w.trackNUMA {
+			for _, page := range pages[:len(latencies)] {
+				if page.NID != w.workerNodes[worker] {
+					w.stats.numaRemoteFrees.Add(1)
+				}
+			}
+		}
+		if err == nil || errors.Is(err, syscall.ENODEV) {
+			return
+		}
+		// Skip the page that failed, carry on with the rest.
+		w.recordFreeFailure(err)
+		pages = pages[len(latencies)+1:]
+	}
+}
+
+// The pattern the worker fills pages with, for VerifyContents.
+func contentPattern(worker int) byte {
+	return byte(0xa5 + worker)
+}
+
+// Free a page via the worker's thread, update stats. If ctx is done first it
+// returns ctx.Err(), the page still gets freed but isn't counted.
+func (w *Workload) freePageOnCPU(ctx context.Context, worker int, page *kmod.Page) error {
+	if w.verifyContents {
+		crc, err := w.kmod.ChecksumPage(page)
+		if errors.Is(err, syscall.ENODEV) {
+			return ErrModuleGone
+		}
+		if err != nil {
+			return fmt.Errorf("checksumming page contents: %v", err)
+		}
+		if crc != w.contentChecksums[worker][page.Order] {
+			w.stats.corruptions.Add(1)
+		}
+	}
+	// Like allocations, via the worker's thread so that a slow free
+	// doesn't hold up cancellation.
+	latency, err := w.threads[worker].FreePageContext(ctx, page)
+	if err != nil && err == ctx.Err() {
+		return err
+	}
+	if errors.Is(err, syscall.ENODEV) {
+		// Not a failure as such, the module frees everything on unload.
+		return ErrModuleGone
+	}
+	if err != nil {
+		w.recordFreeFailure(err)
 		return err
 	}
 	w.stats.pagesFreed.Add(1)
-	if w.measureLatencies && latency != nil {
-		w.stats.freeLatencies[cpu].Add(*latency)
+	w.stats.orderFrees[page.Order].Add(1)
+	remote := w.trackNUMA && page.NID != w.workerNodes[worker]
+	if remote {
+		w.stats.numaRemoteFrees.Add(1)
+	}
+	if w.measureLatencies && latency != nil && w.checkLatency(*latency) {
+		w.stats.freeLatencies[worker].Add(*latency)
+		if remote {
+			w.stats.remoteFreeLatencies[worker].Add(*latency)
+		} else if w.trackNUMA {
+			w.stats.localFreeLatencies[worker].Add(*latency)
+		}
 	}
 	return nil
 }
 
-// samples concatenates all the output samples from the given reservoirs.
-func samples[T any](rs []*sampling.Reservoir[T]) []T {
-	var ret []T
-	for _, r := range rs {
-		ret = append(ret, r.Samples()...)
+// samples combines the output samples from the given reservoirs, merging them
+// with the given seed.
+func samples[T any](seed int64, rs []*sampling.Reservoir[T]) []T {
+	if len(rs) == 0 {
+		return nil
+	}
+	return sampling.Merge(seed, rs...).Samples()
+}
+
+// statsSamples is samples for Stats.
+func statsSamples[T any](seed int64, ss []*sampling.Stats[T]) []T {
+	var rs []*sampling.Reservoir[T]
+	for _, s := range ss {
+		rs = append(rs, s.Reservoir)
+	}
+	return samples(seed, rs)
+}
+
+// latencyRange returns the overall min and max latencies across ss.
+func latencyRange[T any](ss []*sampling.Stats[T], latency func(T) time.Duration) (lo, hi time.Duration) {
+	found := false
+	for _, s := range ss {
+		sMin, ok := s.Min()
+		if !ok {
+			continue
+		}
+		sMax, _ := s.Max()
+		if !found || latency(sMin) < lo {
+			lo = latency(sMin)
+		}
+		if !found || latency(sMax) > hi {
+			hi = latency(sMax)
+		}
+		found = true
 	}
-	return ret
+	return lo, hi
 }
 
 // Run runs the workload. This workload runs continuously until cancellation,
@@ -228,10 +898,21 @@ func (w *Workload) Run(ctx context.Context) (*Result, error) {
 	fmt.Printf("Running global workload setup\n")
 	w.setup(ctx)
 
-	fmt.Printf("Started %d threads, each allocating %d pages\n", runtime.NumCPU(), w.pagesPerCPU)
+	fmt.Printf("Started %d threads, each allocating %d pages\n", w.numThreads, w.pagesPerCPU)
 
 	eg, ctx := errgroup.WithContext(ctx)
-	for cpu := 0; cpu < w.numThreads; cpu++ {
+	if w.fillToMemFree != 0 {
+		eg.Go(func() error { return w.monitorMemFree(ctx) })
+	}
+	var maxOrderProbes []MaxOrderProbe
+	if w.probeMaxOrderInterval != 0 {
+		eg.Go(func() error {
+			var err error
+			maxOrderProbes, err = w.probeMaxOrderSeries(ctx)
+			return err
+		})
+	}
+	for worker, cpu := range w.cpus {
 		eg.Go(func() error {
 			// This means that the goroutine gets the thread to
 			// itself and the thread never gets migrated between
@@ -243,29 +924,200 @@ func (w *Workload) Run(ctx context.Context) (*Result, error) {
 			if err != nil {
 				return fmt.Errorf("SchedSetaffinity(%+v): %c", cpuMask, err)
 			}
+			// Catch affinity bugs early, they'd silently ruin the results.
+			if actual, _, err := linux.GetCPU(); err == nil && actual != cpu {
+				return fmt.Errorf("pinned worker to CPU %d but it's running on CPU %d", cpu, actual)
+			}
+			thread, err := w.kmod.NewThread(cpuMask)
+			if err != nil {
+				return fmt.Errorf("starting kmod thread for CPU %d: %v", cpu, err)
+			}
+			defer thread.Close()
+			w.threads[worker] = thread
 
-			err = w.runCPU(ctx, cpu)
+			if w.fillToMemFree != 0 {
+				err = w.runCPUFill(ctx, worker)
+			} else if w.noFree {
+				err = w.runCPUNoFree(ctx, worker)
+			} else {
+				err = w.runCPU(ctx, worker)
+			}
 			if err != nil {
-				return fmt.Errorf("workload failed on CPU %d: %v", cpu, err)
+				return fmt.Errorf("workload failed on CPU %d: %w", cpu, err)
 			}
 			return nil
 		})
 	}
 
-	if err := eg.Wait(); err != nil {
+	err := eg.Wait()
+	// Free whatever the workers left behind in each other's queues.
+	for worker, ch := range w.handoff {
+		var remaining []*kmod.Page
+		for len(ch) > 0 {
+			remaining = append(remaining, <-ch)
+		}
+		w.freePagesOnCPU(worker, remaining)
+	}
+	if errors.Is(err, ErrModuleGone) {
+		return nil, w.moduleGoneError()
+	}
+	if err != nil {
 		return nil, err
 	}
+	kmodBytesHeld := pab.ByteSize(-1)
+	if kmodStats, err := w.kmod.Stats(); err == nil {
+		kmodBytesHeld = kmodStats.Bytes
+	} else if !errors.Is(err, kmod.ErrUnsupported) {
+		return nil, fmt.Errorf("getting kmod stats: %v", err)
+	}
+	var fallbacks map[int]uint64
+	if w.fallbackOrders {
+		fallbacks = make(map[int]uint64)
+		for order := range w.stats.fallbacks {
+			if n := w.stats.fallbacks[order].Load(); n != 0 {
+				fallbacks[order] = n
+			}
+		}
+	}
 	r := Result{
+		MaxOrderProbes:        maxOrderProbes,
+		Fallbacks:             fallbacks,
 		AllocFailures:         w.stats.allocFailures.Load(),
 		PagesAllocated:        w.stats.pagesAllocated.Load(),
 		PagesFreed:            w.stats.pagesFreed.Load(),
+		FreeFailures:          w.stats.freeFailures.Load(),
 		NUMARemoteAllocations: w.stats.numaRemoteAllocations.Load(),
-		AllocLatencies:        samples(w.stats.allocLatencies),
-		FreeLatencies:         samples(w.stats.freeLatencies),
+		AllocationsByZone:     nonZeroCounts(w.stats.zoneAllocations[:]),
+		TotalBackoff:          time.Duration(w.stats.backoffNS.Load()),
+		CrossCPUFrees:         w.stats.crossCPUFrees.Load(),
+		ImplausibleLatencies:  w.stats.implausibleLatencies.Load(),
+		Corruptions:           w.stats.corruptions.Load(),
+		KmodBytesHeld:         kmodBytesHeld,
+		AllocationsByOrder:    nonZeroCounts(w.stats.orderAllocations[:]),
+		FreesByOrder:          nonZeroCounts(w.stats.orderFrees[:]),
+		AllocSamples:          statsSamples(w.stats.mergeSeed, w.stats.allocSamples),
+		FreeLatencies:         statsSamples(w.stats.mergeSeed, w.stats.freeLatencies),
+		WarmAllocLatencies:    samples(w.stats.mergeSeed, w.stats.warmAllocLatencies),
+		ColdAllocLatencies:    samples(w.stats.mergeSeed, w.stats.coldAllocLatencies),
+	}
+	for _, s := range r.AllocSamples {
+		r.AllocLatencies = append(r.AllocLatencies, s.Latency)
+	}
+	r.MinAllocLatency, r.MaxAllocLatency = latencyRange(w.stats.allocSamples,
+		func(s AllocSample) time.Duration { return s.Latency })
+	r.MinFreeLatency, r.MaxFreeLatency = latencyRange(w.stats.freeLatencies,
+		func(d time.Duration) time.Duration { return d })
+	_, r.AllocLatencyHistogram, _ = w.AllocLatencyHistogram()
+	if w.trackNUMA {
+		r.NUMARemoteFrees = w.stats.numaRemoteFrees.Load()
+		r.AllocationsByNode = nonZeroCounts(w.stats.nodeAllocations[:])
+		r.LocalFreeLatencies = samples(w.stats.mergeSeed, w.stats.localFreeLatencies)
+		r.RemoteFreeLatencies = samples(w.stats.mergeSeed, w.stats.remoteFreeLatencies)
+		r.AllocLatenciesByNode = make(map[int][]time.Duration)
+		for _, s := range r.AllocSamples {
+			r.AllocLatenciesByNode[s.Node] = append(r.AllocLatenciesByNode[s.Node], s.Latency)
+		}
 	}
 	return &r, nil
 }
 
+// VerifyFrees checks that freeing pages via the kernel module really returns
+// them to the allocator. It allocates up to TotalMemory (or until allocation
+// fails), frees it all, then checks that the same amount can be allocated
+// again. Unlike the main workload, this doesn't back off on allocation failure.
+// Call this before Run, not concurrently with it.
+func (w *Workload) VerifyFrees(ctx context.Context) error {
+	target := w.pagesPerCPU * int64(w.numThreads)
+	var pages []*kmod.Page
+	freeAll := func() error {
+		defer func() { pages = nil }()
+		if _, err := w.kmod.FreePages(pages); err != nil {
+			return fmt.Errorf("freeing pages: %v", err)
+		}
+		return nil
+	}
+	// Returns number of pages allocated. Stops early on ENOMEM.
+	allocate := func(n int64) (int64, error) {
+		const batch = 256
+		for int64(len(pages)) < n && ctx.Err() == nil {
+			batchPages, err := w.kmod.AllocPages(0, int(min(n-int64(len(pages)), batch)))
+			pages = append(pages, batchPages...)
+			if errors.Is(err, syscall.ENOMEM) {
+				break
+			}
+			if err != nil {
+				return 0, fmt.Errorf("allocating pages: %v", err)
+			}
+		}
+		return int64(len(pages)), ctx.Err()
+	}
+
+	allocated, err := allocate(target)
+	if err != nil {
+		freeAll()
+		return err
+	}
+	if err := freeAll(); err != nil {
+		return err
+	}
+	reallocated, err := allocate(allocated)
+	if err != nil {
+		freeAll()
+		return err
+	}
+	if err := freeAll(); err != nil {
+		return err
+	}
+	if reallocated < allocated {
+		return fmt.Errorf("allocated %d pages, freed them, then could only allocate %d again. "+
+			"Are frees not returning pages to the allocator?", allocated, reallocated)
+	}
+	return nil
+}
+
+// Counters is a snapshot of the raw counters of a running workload.
+type Counters struct {
+	PagesAllocated uint64
+	PagesFreed     uint64
+	AllocFailures  uint64
+	FreeFailures   uint64
+	CrossCPUFrees  uint64
+	TotalBackoff   time.Duration
+	RemoteAllocs   uint64 // From a different NUMA node to the CPU's.
+}
+
+// Counters returns the current counter values. Safe to call concurrently with
+// Run. Counters only increase over the lifetime of the Workload.
+func (w *Workload) Counters() Counters {
+	return Counters{
+		PagesAllocated: w.stats.pagesAllocated.Load(),
+		PagesFreed:     w.stats.pagesFreed.Load(),
+		AllocFailures:  w.stats.allocFailures.Load(),
+		FreeFailures:   w.stats.freeFailures.Load(),
+		CrossCPUFrees:  w.stats.crossCPUFrees.Load(),
+		TotalBackoff:   time.Duration(w.stats.backoffNS.Load()),
+		RemoteAllocs:   w.stats.numaRemoteAllocations.Load(),
+	}
+}
+
+// AllocLatencyHistogram returns the bucket bounds and counts of the allocation
+// latency histogram so far, summed across CPU workers, along with the sum of
+// the latencies. See Options.LatencyHistogramBounds, all the results are nil
+// or zero if that isn't set. Safe to call concurrently with Run.
+func (w *Workload) AllocLatencyHistogram() (bounds []time.Duration, buckets []uint64, sum time.Duration) {
+	for _, h := range w.stats.allocLatencyHistograms {
+		bounds = h.Bounds()
+		if buckets == nil {
+			buckets = make([]uint64, len(bounds)+1)
+		}
+		for i, n := range h.Buckets() {
+			buckets[i] += n
+		}
+		sum += h.Sum()
+	}
+	return bounds, buckets, sum
+}
+
 // AwaitSteadyState blocks until the workload can be expected to be allocating
 // and freeing pages at the same rate.
 func (w *Workload) AwaitSteadyState(ctx context.Context) {
@@ -275,49 +1127,233 @@ func (w *Workload) AwaitSteadyState(ctx context.Context) {
 	}
 }
 
-func reservoirPerCPU(size int) []*sampling.Reservoir[time.Duration] {
-	r := make([]*sampling.Reservoir[time.Duration], runtime.NumCPU())
+// reservoirPerWorker creates a reservoir for each worker. If seeds is non-nil
+// it's used to seed them, otherwise they're seeded from the current time.
+func reservoirPerWorker[T any](workers, size int, seeds *rand.Rand) []*sampling.Reservoir[T] {
+	r := make([]*sampling.Reservoir[T], workers)
 	for i := 0; i < len(r); i++ {
-		r[i] = sampling.NewReservoir[time.Duration](size)
+		cfg := sampling.Config{Size: size}
+		if seeds != nil {
+			cfg.Seed = seeds.Int63()
+		}
+		r[i] = sampling.New[T](cfg)
 	}
 	return r
 }
 
+// statsPerWorker is like reservoirPerWorker but also tracks min and max.
+func statsPerWorker[T any](workers, size int, seeds *rand.Rand, less func(a, b T) bool) []*sampling.Stats[T] {
+	var ss []*sampling.Stats[T]
+	for _, r := range reservoirPerWorker[T](workers, size, seeds) {
+		ss = append(ss, sampling.NewStats(r, less))
+	}
+	return ss
+}
+
+// Validates the orders from opts and returns them in increasing order, with
+// their cumulative weights, for pickOrder.
+func orderTable(opts *Options) ([]int, []float64, error) {
+	orderWeights := opts.OrderWeights
+	if len(orderWeights) == 0 {
+		orderWeights = map[int]float64{opts.Order: 1}
+	}
+	var orders []int
+	for order, weight := range orderWeights {
+		if order < 0 || order >= kmod.NumOrders {
+			return nil, nil, fmt.Errorf("order %d out of range, must be in [0, %d)", order, kmod.NumOrders)
+		}
+		if weight < 0 {
+			return nil, nil, fmt.Errorf("negative weight %v for order %d", weight, order)
+		}
+		orders = append(orders, order)
+	}
+	slices.Sort(orders) // Keep it deterministic.
+	var orderCumWeights []float64
+	cum := float64(0)
+	for _, order := range orders {
+		cum += orderWeights[order]
+		orderCumWeights = append(orderCumWeights, cum)
+	}
+	if cum <= 0 {
+		return nil, nil, fmt.Errorf("order weights sum to %v, must be positive", cum)
+	}
+	return orders, orderCumWeights, nil
+}
+
+// Returns each worker's target and swing for runCPU, see Options.TargetPages.
+func workingSet(opts *Options) (int, int, error) {
+	targetPages := opts.TargetPages
+	if targetPages == 0 {
+		targetPages = DefaultTargetPages
+	}
+	swingPages := opts.SwingPages
+	if swingPages == 0 {
+		swingPages = DefaultSwingPages
+	}
+	if targetPages < 1 || swingPages < 1 || swingPages > targetPages {
+		return 0, 0, fmt.Errorf("need 1 <= SwingPages (%d) <= TargetPages (%d)", swingPages, targetPages)
+	}
+	return targetPages, swingPages, nil
+}
+
 func New(ctx context.Context, opts *Options) (*Workload, error) {
-	file, err := os.Open("/proc/page_alloc_bench")
+	orders, orderCumWeights, err := orderTable(opts)
 	if err != nil {
-		return nil, fmt.Errorf("opening /proc/page_alloc_bench: %v", err)
+		return nil, err
 	}
-	kmod := kmod.Connection{file}
 
-	nodes, err := linux.NUMANodes()
-	if err != nil {
-		return nil, fmt.Errorf("parsing NUMA nodes: %v", err)
+	cpuMask := opts.CPUs
+	if cpuMask == nil {
+		var err error
+		cpuMask, err = linux.SchedGetaffinity(linux.PIDCallingThread)
+		if err != nil {
+			return nil, fmt.Errorf("getting CPU affinity: %v", err)
+		}
+	}
+	cpus := cpuMask.CPUs()
+	if len(cpus) == 0 {
+		return nil, fmt.Errorf("no CPUs to run on")
 	}
-	cpuToNode := make(map[int]int)
-	for nid, mask := range nodes {
-		for _, cpu := range mask {
-			cpuToNode[int(cpu)] = nid
+
+	var handoff []chan *kmod.Page
+	if opts.CrossCPUFree {
+		for range cpus {
+			handoff = append(handoff, make(chan *kmod.Page, 1024))
+		}
+	}
+
+	if opts.VerifyContents && opts.CrossCPUFree {
+		return nil, fmt.Errorf("VerifyContents is incompatible with CrossCPUFree")
+	}
+	var contentChecksums [][]uint32
+	if opts.VerifyContents {
+		for worker := range cpus {
+			var checksums []uint32
+			for order := 0; order <= orders[len(orders)-1]; order++ {
+				checksums = append(checksums, kmod.PatternChecksum(order, contentPattern(worker)))
+			}
+			contentChecksums = append(contentChecksums, checksums)
+		}
+	}
+
+	cpuToNode := opts.CPUToNode
+	if cpuToNode == nil {
+		cpuToNode, err = linux.CPUToNode()
+		if err != nil {
+			return nil, fmt.Errorf("parsing NUMA nodes: %v", err)
 		}
 	}
-	for cpu := 0; cpu < runtime.NumCPU(); cpu++ {
-		if _, ok := cpuToNode[cpu]; !ok {
-			return nil, fmt.Errorf("found no NUMA node for CPU %d (nodes: %+v)", cpu, nodes)
+	nodes := make(map[int]bool)
+	for _, nid := range cpuToNode {
+		nodes[nid] = true
+	}
+	var workerNodes []int
+	for _, cpu := range cpus {
+		nid, ok := cpuToNode[cpu]
+		if !ok {
+			return nil, fmt.Errorf("found no NUMA node for CPU %d (CPU to node mapping: %+v)", cpu, cpuToNode)
 		}
+		workerNodes = append(workerNodes, nid)
+	}
+
+	trackNUMA := len(nodes) > 1
+	if opts.TrackNUMA != nil {
+		trackNUMA = *opts.TrackNUMA
+	}
+
+	if opts.MeasureWarmCold && !opts.MeasureLatencies {
+		return nil, fmt.Errorf("MeasureWarmCold requires MeasureLatencies")
+	}
+	if opts.LatencyHistogramBounds != nil && !opts.MeasureLatencies {
+		return nil, fmt.Errorf("LatencyHistogramBounds requires MeasureLatencies")
+	}
+	allocNode := -1
+	if opts.AllocNode != nil {
+		allocNode = *opts.AllocNode
+	}
+	var seeds *rand.Rand
+	if opts.SamplingSeed != 0 {
+		seeds = rand.New(rand.NewSource(opts.SamplingSeed))
+	}
+	stats := &stats{
+		allocSamples: statsPerWorker(len(cpus), 50000, seeds, func(a, b AllocSample) bool {
+			return a.Latency < b.Latency
+		}),
+		freeLatencies: statsPerWorker(len(cpus), 50000, seeds, func(a, b time.Duration) bool {
+			return a < b
+		}),
+	}
+	if seeds != nil {
+		stats.mergeSeed = seeds.Int63()
+	}
+	maxProbeOrder := opts.MaxProbeOrder
+	if maxProbeOrder == 0 {
+		maxProbeOrder = DefaultMaxProbeOrder
+	}
+	targetPages, swingPages, err := workingSet(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.NoFree && opts.FillToMemFree != 0 {
+		return nil, fmt.Errorf("NoFree and FillToMemFree are incompatible")
+	}
+
+	if trackNUMA {
+		stats.localFreeLatencies = reservoirPerWorker[time.Duration](len(cpus), 50000, seeds)
+		stats.remoteFreeLatencies = reservoirPerWorker[time.Duration](len(cpus), 50000, seeds)
+	}
+	if opts.FallbackOrders {
+		stats.fallbacks = make([]atomic.Uint64, orders[len(orders)-1])
+	}
+	if opts.LatencyHistogramBounds != nil {
+		for range cpus {
+			stats.allocLatencyHistograms = append(stats.allocLatencyHistograms,
+				sampling.NewHistogram(opts.LatencyHistogramBounds))
+		}
+	}
+	if opts.MeasureWarmCold {
+		stats.warmAllocLatencies = reservoirPerWorker[time.Duration](len(cpus), 50000, seeds)
+		stats.coldAllocLatencies = reservoirPerWorker[time.Duration](len(cpus), 50000, seeds)
+	}
+
+	// Last, so there's nothing to close if the options are bad.
+	devicePath := opts.DevicePath
+	if devicePath == "" {
+		devicePath = kmod.DefaultDevicePath
+	}
+	conn, err := kmod.Open(devicePath)
+	if err != nil {
+		return nil, err
 	}
 
 	return &Workload{
-		kmod: &kmod,
-		stats: &stats{
-			allocLatencies: reservoirPerCPU(50000),
-			freeLatencies:  reservoirPerCPU(50000),
-		},
-		pagesPerCPU:        opts.TotalMemory.Pages() / int64(runtime.NumCPU()),
-		testDataPath:       opts.TestDataPath,
-		steadyStateReached: make(chan struct{}),
-		numThreads:         runtime.NumCPU(),
-		cpuToNode:          cpuToNode,
-		order:              opts.Order,
-		measureLatencies:   opts.MeasureLatencies,
+		kmod:                  conn,
+		stats:                 stats,
+		pagesPerCPU:           opts.TotalMemory.Pages() / int64(len(cpus)),
+		cpus:                  cpus,
+		threads:               make([]kmodThread, len(cpus)),
+		workerNodes:           workerNodes,
+		testDataPath:          opts.TestDataPath,
+		steadyStateReached:    make(chan struct{}),
+		numThreads:            len(cpus),
+		cpuToNode:             cpuToNode,
+		allocNode:             allocNode,
+		gfp:                   opts.GFP,
+		verifyContents:        opts.VerifyContents,
+		contentChecksums:      contentChecksums,
+		orders:                orders,
+		orderCumWeights:       orderCumWeights,
+		measureLatencies:      opts.MeasureLatencies,
+		measureWarmCold:       opts.MeasureWarmCold,
+		trackNUMA:             trackNUMA,
+		handoff:               handoff,
+		fallbackOrders:        opts.FallbackOrders,
+		fillToMemFree:         opts.FillToMemFree,
+		readMeminfo:           linux.ReadMeminfo,
+		probeMaxOrderInterval: opts.ProbeMaxOrderInterval,
+		maxProbeOrder:         maxProbeOrder,
+		targetPages:           targetPages,
+		swingPages:            swingPages,
+		noFree:                opts.NoFree,
 	}, nil
 }
@@ -0,0 +1,1086 @@
+// Copyright 2024 Google LLC
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; If not, see <http://www.gnu.org/licenses/>.
+
+package kallocfree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/page_alloc_bench/kmod"
+	"github.com/google/page_alloc_bench/linux"
+	"github.com/google/page_alloc_bench/pab"
+)
+
+// Fake kernel module. Allocations always succeed, frees fail as configured.
+type fakeKmod struct {
+	// Called before each single-page free, if it returns an error the free
+	// fails with it.
+	freeErr func(n int) error
+	frees   int // Number of FreePage calls so far.
+	// If set, WritePage fails with this.
+	writeErr error
+}
+
+func (f *fakeKmod) AllocPage(order int) (*kmod.Page, error) {
+	return &kmod.Page{Order: order}, nil
+}
+
+func (f *fakeKmod) AllocPages(order, count int) ([]*kmod.Page, error) {
+	var pages []*kmod.Page
+	for i := 0; i < count; i++ {
+		pages = append(pages, &kmod.Page{Order: order})
+	}
+	return pages, nil
+}
+
+func (f *fakeKmod) FreePage(page *kmod.Page) (*time.Duration, error) {
+	f.frees++
+	if f.freeErr != nil {
+		if err := f.freeErr(f.frees); err != nil {
+			return nil, err
+		}
+	}
+	latency := time.Microsecond
+	return &latency, nil
+}
+
+func (f *fakeKmod) FreePages(pages []*kmod.Page) ([]time.Duration, error) {
+	return make([]time.Duration, len(pages)), nil
+}
+
+func (f *fakeKmod) WritePage(page *kmod.Page, pattern byte) error { return f.writeErr }
+func (f *fakeKmod) ChecksumPage(page *kmod.Page) (uint32, error)  { return 0, nil }
+func (f *fakeKmod) Stats() (kmod.KmodStats, error)                { return kmod.KmodStats{}, nil }
+func (f *fakeKmod) Close() error                                  { return nil }
+
+func (f *fakeKmod) NewThread(cpus linux.CPUMask) (*kmod.Thread, error) {
+	return nil, errors.New("fakeKmod doesn't do threads")
+}
+
+// Fake kmod thread. Calls cancel once it has allocated limit pages, and if
+// failAfter is nonzero, fails with err after that many allocations (or from
+// the start if it's negative).
+type fakeThread struct {
+	allocs    atomic.Int64
+	limit     int64
+	cancel    context.CancelFunc
+	failAfter int64
+	err       error
+	onAlloc   func() // Optional, called after each successful allocation.
+	// Optional. The nth allocation is from zones[n%len(zones)], and from
+	// nids[n%len(nids)].
+	zones []int
+	nids  []int
+}
+
+func (t *fakeThread) AllocPageOnNodeGFPContext(ctx context.Context, order, nid int, gfp uint) (*kmod.Page, error) {
+	n := t.allocs.Add(1)
+	if t.failAfter != 0 && n > t.failAfter {
+		return nil, t.err
+	}
+	if n >= t.limit {
+		t.cancel()
+	}
+	if t.onAlloc != nil {
+		t.onAlloc()
+	}
+	page := &kmod.Page{Order: order}
+	if len(t.zones) != 0 {
+		page.Zone = t.zones[n%int64(len(t.zones))]
+	}
+	if len(t.nids) != 0 {
+		page.NID = t.nids[n%int64(len(t.nids))]
+	}
+	return page, nil
+}
+
+// The allocating half of kmodThread, which is all the fake threads implement.
+type fakeAllocator interface {
+	AllocPageOnNodeGFPContext(ctx context.Context, order, nid int, gfp uint) (*kmod.Page, error)
+}
+
+// Makes a fake thread into a kmodThread, which frees pages straight on the
+// fake connection.
+type fakeThreadOn struct {
+	fakeAllocator
+	conn kmodConn
+}
+
+func (t fakeThreadOn) FreePageContext(ctx context.Context, page *kmod.Page) (*time.Duration, error) {
+	return t.conn.FreePage(page)
+}
+
+// A single-worker Workload on the fakes, without any of the optional features.
+func newFakeWorkload(conn kmodConn, thread fakeAllocator) *Workload {
+	return &Workload{
+		kmod:               conn,
+		stats:              &stats{},
+		cpus:               []int{0},
+		threads:            []kmodThread{fakeThreadOn{thread, conn}},
+		workerNodes:        []int{0},
+		numThreads:         1,
+		steadyStateReached: make(chan struct{}),
+		allocNode:          -1,
+		orders:             []int{0},
+		orderCumWeights:    []float64{1},
+		targetPages:        20,
+		swingPages:         10,
+	}
+}
+
+// A single-worker Workload from New, with its connection and thread swapped
+// for the fakes. The device is just an empty file, so this doesn't need the
+// kernel module.
+func newFakeWorkloadFromOptions(t *testing.T, opts *Options, conn kmodConn, thread fakeAllocator) *Workload {
+	t.Helper()
+	opts.DevicePath = filepath.Join(t.TempDir(), "page_alloc_bench")
+	if err := os.WriteFile(opts.DevicePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts.CPUs = linux.NewCPUMask(0)
+	opts.CPUToNode = map[int]int{0: 0}
+	w, err := New(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	w.kmod.Close()
+	w.kmod = conn
+	w.threads[0] = fakeThreadOn{thread, conn}
+	return w
+}
+
+func TestRunCPUCountsFreeFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Fail a few frees, scattered through the run.
+	failing := map[int]bool{1: true, 2: true, 10: true, 50: true, 51: true}
+	conn := &fakeKmod{freeErr: func(n int) error {
+		if failing[n] {
+			return syscall.EIO
+		}
+		return nil
+	}}
+	thread := &fakeThread{limit: 1000, cancel: cancel}
+	w := newFakeWorkload(conn, thread)
+
+	if err := w.runCPU(ctx, 0); err != nil {
+		t.Fatalf("runCPU failed: %v", err)
+	}
+	if conn.frees <= 51 {
+		t.Fatalf("only %d frees, want enough to hit all the failures", conn.frees)
+	}
+	if got, want := w.stats.freeFailures.Load(), uint64(len(failing)); got != want {
+		t.Errorf("counted %d free failures, want %d", got, want)
+	}
+	// Everything else got freed, either in the loop or when cleaning up.
+	allocated := w.stats.pagesAllocated.Load()
+	if got, want := w.stats.pagesFreed.Load(), allocated-uint64(len(failing)); got != want {
+		t.Errorf("freed %d pages, want %d (%d allocated)", got, want, allocated)
+	}
+}
+
+func TestPageQueue(t *testing.T) {
+	// Each step pushes then pops some pages. The queue starts with room for
+	// 1024, so the later steps make it wrap around and then grow while wrapped.
+	type step struct{ push, pop int }
+	for _, tc := range []struct {
+		name  string
+		steps []step
+	}{
+		{name: "simple", steps: []step{{push: 3, pop: 3}}},
+		{name: "grow unwrapped", steps: []step{{push: 3000, pop: 3000}}},
+		{name: "wrap", steps: []step{{push: 1000, pop: 900}, {push: 500, pop: 600}}},
+		{name: "grow while wrapped", steps: []step{{push: 1000, pop: 900}, {push: 1000, pop: 0}, {push: 5, pop: 1105}}},
+		{name: "grow twice while wrapped", steps: []step{{push: 1024, pop: 1000}, {push: 1500, pop: 10}, {push: 2000, pop: 3514}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var q pageQueue
+			// Pages are identified by PFN, pushed in increasing order.
+			pushed, popped := 0, 0
+			for _, s := range tc.steps {
+				for i := 0; i < s.push; i++ {
+					q.push(&kmod.Page{PFN: uint64(pushed)})
+					pushed++
+				}
+				for i := 0; i < s.pop; i++ {
+					if got := q.pop().PFN; got != uint64(popped) {
+						t.Fatalf("popped page %d, want %d", got, popped)
+					}
+					popped++
+				}
+				if got, want := q.len, pushed-popped; got != want {
+					t.Fatalf("queue has %d pages, want %d", got, want)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPageQueue(b *testing.B) {
+	page := &kmod.Page{}
+	var q pageQueue
+	// Keep it part-full so that it wraps, like a worker's working set.
+	for i := 0; i < 512; i++ {
+		q.push(page)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.push(page)
+		q.pop()
+	}
+}
+
+// Compare the sub-benchmarks to see what TrackNUMA costs on the hot path.
+func BenchmarkAllocPageOnCPU(b *testing.B) {
+	for _, trackNUMA := range []bool{false, true} {
+		b.Run(fmt.Sprintf("TrackNUMA=%v", trackNUMA), func(b *testing.B) {
+			w := newFakeWorkload(&fakeKmod{}, &fakeThread{limit: math.MaxInt64})
+			w.trackNUMA = trackNUMA
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := w.allocPageOnCPU(ctx, 0, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRunCPUModuleGone(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		verifyContents bool
+		conn           *fakeKmod
+		thread         *fakeThread
+	}{
+		{
+			name:   "alloc",
+			conn:   &fakeKmod{},
+			thread: &fakeThread{limit: 1000, failAfter: 100, err: syscall.ENODEV},
+		},
+		{
+			name: "free",
+			conn: &fakeKmod{freeErr: func(n int) error {
+				if n > 5 {
+					return syscall.ENODEV
+				}
+				return nil
+			}},
+			thread: &fakeThread{limit: 1000},
+		},
+		{
+			name:           "write",
+			verifyContents: true,
+			conn:           &fakeKmod{writeErr: syscall.ENODEV},
+			thread:         &fakeThread{limit: 1000},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tc.thread.cancel = cancel
+			w := newFakeWorkload(tc.conn, tc.thread)
+			w.verifyContents = tc.verifyContents
+
+			err := w.runCPU(ctx, 0)
+			if !errors.Is(err, ErrModuleGone) {
+				t.Fatalf("runCPU returned %v, want ErrModuleGone", err)
+			}
+			// It should stop straight away, not keep hammering the
+			// dead module.
+			if n := tc.thread.allocs.Load(); n >= tc.thread.limit {
+				t.Errorf("runCPU kept going for %d allocations", n)
+			}
+			if got := w.stats.freeFailures.Load(); got != 0 {
+				t.Errorf("counted %d free failures, want 0", got)
+			}
+			outstanding := w.stats.pagesAllocated.Load() - w.stats.pagesFreed.Load()
+			want := fmt.Sprintf("%d pages were outstanding", outstanding)
+			if msg := w.moduleGoneError().Error(); !strings.Contains(msg, want) {
+				t.Errorf("got error %q, want it to mention %q", msg, want)
+			}
+		})
+	}
+}
+
+func TestOrderTableRejectsBadOrders(t *testing.T) {
+	for _, opts := range []*Options{
+		{Order: -1},
+		{Order: -1, FallbackOrders: true},
+		{Order: kmod.NumOrders},
+		{OrderWeights: map[int]float64{0: 1, 99: 1}},
+		{OrderWeights: map[int]float64{-3: 1}},
+		{OrderWeights: map[int]float64{0: 1, 1: -1}},
+		{OrderWeights: map[int]float64{0: 0}},
+	} {
+		if _, _, err := orderTable(opts); err == nil {
+			t.Errorf("orderTable(%+v) succeeded, want error", opts)
+		}
+		// New has to reject it before it gets anywhere near the module.
+		if _, err := New(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "order") {
+			t.Errorf("New(%+v) returned %v, want error about orders", opts, err)
+		}
+	}
+}
+
+func TestOrderWeightsUsed(t *testing.T) {
+	orders, cumWeights, err := orderTable(&Options{OrderWeights: map[int]float64{0: 1, 4: 1}})
+	if err != nil {
+		t.Fatalf("orderTable: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := newFakeWorkload(&fakeKmod{}, &fakeThread{limit: 1000, cancel: cancel})
+	w.orders, w.orderCumWeights = orders, cumWeights
+
+	if err := w.runCPU(ctx, 0); err != nil {
+		t.Fatalf("runCPU failed: %v", err)
+	}
+	for _, order := range []int{0, 4} {
+		if w.stats.orderAllocations[order].Load() == 0 {
+			t.Errorf("no allocations of order %d", order)
+		}
+		if w.stats.orderFrees[order].Load() == 0 {
+			t.Errorf("no frees of order %d", order)
+		}
+	}
+	for order := range w.stats.orderAllocations {
+		if order != 0 && order != 4 && w.stats.orderAllocations[order].Load() != 0 {
+			t.Errorf("unexpected allocations of order %d", order)
+		}
+	}
+}
+
+func TestZoneTallies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	zones := []int{0, 2, 2, 3}
+	thread := &fakeThread{limit: 1000, cancel: cancel, zones: zones}
+	w := newFakeWorkload(&fakeKmod{}, thread)
+
+	if err := w.runCPU(ctx, 0); err != nil {
+		t.Fatalf("runCPU failed: %v", err)
+	}
+	want := make(map[int]uint64)
+	for n := int64(1); n <= thread.allocs.Load(); n++ {
+		want[zones[n%int64(len(zones))]]++
+	}
+	if got := nonZeroCounts(w.stats.zoneAllocations[:]); !reflect.DeepEqual(got, want) {
+		t.Errorf("got allocations by zone %v, want %v", got, want)
+	}
+}
+
+func TestNodeTallies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nids := []int{0, 1, 1, 3}
+	thread := &fakeThread{limit: 1000, cancel: cancel, nids: nids}
+	w := newFakeWorkload(&fakeKmod{}, thread)
+	w.trackNUMA = true
+
+	if err := w.runCPU(ctx, 0); err != nil {
+		t.Fatalf("runCPU failed: %v", err)
+	}
+	want := make(map[int]uint64)
+	var remote uint64
+	for n := int64(1); n <= thread.allocs.Load(); n++ {
+		nid := nids[n%int64(len(nids))]
+		want[nid]++
+		if nid != 0 {
+			remote++
+		}
+	}
+	if got := nonZeroCounts(w.stats.nodeAllocations[:]); !reflect.DeepEqual(got, want) {
+		t.Errorf("got allocations by node %v, want %v", got, want)
+	}
+	if got := w.stats.numaRemoteAllocations.Load(); got != remote {
+		t.Errorf("got %d remote allocations, want %d", got, remote)
+	}
+}
+
+func TestWorkingSet(t *testing.T) {
+	for _, tc := range []struct {
+		name                  string
+		opts                  Options
+		wantTarget, wantSwing int
+		wantErr               bool
+	}{
+		{name: "defaults", opts: Options{}, wantTarget: DefaultTargetPages, wantSwing: DefaultSwingPages},
+		{name: "defaults ignore TotalMemory", opts: Options{TotalMemory: pab.Megabyte}, wantTarget: DefaultTargetPages, wantSwing: DefaultSwingPages},
+		{name: "explicit target", opts: Options{TargetPages: 2000}, wantTarget: 2000, wantSwing: DefaultSwingPages},
+		{name: "fixed working set", opts: Options{TargetPages: 100, SwingPages: 1}, wantTarget: 100, wantSwing: 1},
+		{name: "default swing bigger than target", opts: Options{TargetPages: 100}, wantErr: true},
+		{name: "swing bigger than target", opts: Options{TargetPages: 10, SwingPages: 11}, wantErr: true},
+		{name: "negative swing", opts: Options{TargetPages: 10, SwingPages: -1}, wantErr: true},
+		{name: "negative target", opts: Options{TargetPages: -10, SwingPages: 1}, wantErr: true},
+	} {
+		target, swing, err := workingSet(&tc.opts)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: got target %d swing %d, want error", tc.name, target, swing)
+			}
+			continue
+		}
+		if err != nil || target != tc.wantTarget || swing != tc.wantSwing {
+			t.Errorf("%s: got target %d swing %d (err %v), want %d and %d",
+				tc.name, target, swing, err, tc.wantTarget, tc.wantSwing)
+		}
+	}
+}
+
+func TestFixedWorkingSet(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := newFakeWorkloadFromOptions(t, &Options{TargetPages: 50, SwingPages: 1}, &fakeKmod{}, &fakeThread{limit: 1000})
+	done := make(chan error)
+	go func() { done <- w.runCPU(ctx, 0) }()
+
+	<-w.steadyStateReached
+	// Give it a chance to go wrong.
+	time.Sleep(10 * time.Millisecond)
+	if got := w.stats.pagesAllocated.Load(); got != 50 {
+		t.Errorf("allocated %d pages, want exactly 50", got)
+	}
+	if got := w.stats.pagesFreed.Load(); got != 0 {
+		t.Errorf("freed %d pages before stopping, want 0", got)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("runCPU failed: %v", err)
+	}
+}
+
+func TestNoFree(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := newFakeWorkloadFromOptions(t, &Options{TotalMemory: pab.Megabyte, NoFree: true}, &fakeKmod{}, &fakeThread{limit: 1 << 62})
+	done := make(chan error)
+	go func() { done <- w.runCPUNoFree(ctx, 0) }()
+
+	<-w.steadyStateReached
+	// Give it a chance to go wrong.
+	time.Sleep(10 * time.Millisecond)
+	if got, want := w.stats.pagesAllocated.Load(), uint64(w.pagesPerCPU); got != want {
+		t.Errorf("allocated %d pages, want exactly %d", got, want)
+	}
+	if got := w.stats.pagesFreed.Load(); got != 0 {
+		t.Errorf("freed %d pages before stopping, want 0", got)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("runCPUNoFree failed: %v", err)
+	}
+	if allocated, freed := w.stats.pagesAllocated.Load(), w.stats.pagesFreed.Load(); allocated != freed {
+		t.Errorf("allocated %d pages but freed %d when stopping", allocated, freed)
+	}
+}
+
+func TestNoFreeRejectsFillToMemFree(t *testing.T) {
+	devicePath := filepath.Join(t.TempDir(), "page_alloc_bench")
+	if err := os.WriteFile(devicePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := New(context.Background(), &Options{
+		TotalMemory:   pab.Megabyte,
+		DevicePath:    devicePath,
+		CPUs:          linux.NewCPUMask(0),
+		CPUToNode:     map[int]int{0: 0},
+		NoFree:        true,
+		FillToMemFree: pab.Megabyte,
+	})
+	if err == nil {
+		t.Errorf("New accepted NoFree with FillToMemFree, want error")
+	}
+}
+
+// Bad options are rejected before the device is opened, so there's nothing to
+// leak. The device doesn't exist, so opening it first would give that error.
+func TestNewValidatesBeforeOpen(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		opts Options
+	}{
+		{desc: "NoFree with FillToMemFree", opts: Options{NoFree: true, FillToMemFree: pab.Megabyte}},
+		{desc: "MeasureWarmCold without MeasureLatencies", opts: Options{MeasureWarmCold: true}},
+		{desc: "histogram without MeasureLatencies", opts: Options{LatencyHistogramBounds: []time.Duration{time.Microsecond}}},
+		{desc: "swing bigger than target", opts: Options{TargetPages: 10, SwingPages: 11}},
+		{desc: "CPU with no NUMA node", opts: Options{CPUs: linux.NewCPUMask(4)}},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := tc.opts
+			opts.TotalMemory = pab.Megabyte
+			opts.DevicePath = filepath.Join(t.TempDir(), "missing")
+			if opts.CPUs == nil {
+				opts.CPUs = linux.NewCPUMask(0)
+			}
+			opts.CPUToNode = map[int]int{0: 0}
+			_, err := New(context.Background(), &opts)
+			if err == nil || errors.Is(err, os.ErrNotExist) {
+				t.Errorf("New returned %v, want an error about the options", err)
+			}
+		})
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	for name, weights := range Profiles {
+		sum := 0.0
+		for _, weight := range weights {
+			sum += weight
+		}
+		if math.Abs(sum-1) > 1e-9 {
+			t.Errorf("profile %q weights sum to %v, want 1", name, sum)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		thread := &fakeThread{limit: 10000, cancel: cancel}
+		w := newFakeWorkloadFromOptions(t, &Options{TotalMemory: pab.Megabyte, OrderWeights: weights}, &fakeKmod{}, thread)
+		err := w.runCPU(ctx, 0)
+		cancel()
+		if err != nil {
+			t.Fatalf("profile %q: runCPU failed: %v", name, err)
+		}
+		for order := range w.stats.orderAllocations {
+			n := w.stats.orderAllocations[order].Load()
+			if _, ok := weights[order]; ok && n == 0 {
+				t.Errorf("profile %q: no allocations of order %d", name, order)
+			}
+			if _, ok := weights[order]; !ok && n != 0 {
+				t.Errorf("profile %q: %d allocations of order %d, which isn't in the profile", name, n, order)
+			}
+		}
+	}
+}
+
+func TestAllocBackoff(t *testing.T) {
+	// Out of memory from the start. The first backoff is 500ms and the
+	// second 750ms, so this gives up during the second.
+	ctx, cancel := context.WithTimeout(context.Background(), 700*time.Millisecond)
+	defer cancel()
+	thread := &fakeThread{limit: 1000, cancel: cancel, failAfter: -1, err: syscall.ENOMEM}
+	w := newFakeWorkload(&fakeKmod{}, thread)
+
+	start := time.Now()
+	if _, err := w.allocPageOnCPU(ctx, 0, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("allocPageOnCPU returned %v, want context.DeadlineExceeded", err)
+	}
+	elapsed := time.Since(start)
+	counters := w.Counters()
+	if counters.AllocFailures != 2 {
+		t.Errorf("counted %d allocation failures, want 2", counters.AllocFailures)
+	}
+	if counters.TotalBackoff < 600*time.Millisecond || counters.TotalBackoff > elapsed {
+		t.Errorf("got %v of backoff in %v, want most of it", counters.TotalBackoff, elapsed)
+	}
+}
+
+// Latencies from pcpThread.
+const (
+	warmLatency = time.Microsecond
+	coldLatency = 5 * time.Microsecond
+)
+
+// Fake kernel module that remembers whether a page was just freed, for
+// pcpThread.
+type pcpKmod struct {
+	fakeKmod
+	justFreed atomic.Bool
+}
+
+func (k *pcpKmod) FreePage(page *kmod.Page) (*time.Duration, error) {
+	k.justFreed.Store(true)
+	return k.fakeKmod.FreePage(page)
+}
+
+// Fake kmod thread that models the per-CPU page cache: an allocation straight
+// after a free takes warmLatency, any other allocation takes coldLatency.
+type pcpThread struct {
+	fakeThread
+	kmod *pcpKmod
+}
+
+func (t *pcpThread) AllocPageOnNodeGFPContext(ctx context.Context, order, nid int, gfp uint) (*kmod.Page, error) {
+	page, err := t.fakeThread.AllocPageOnNodeGFPContext(ctx, order, nid, gfp)
+	if err != nil {
+		return nil, err
+	}
+	page.Latency = coldLatency
+	if t.kmod.justFreed.Swap(false) {
+		page.Latency = warmLatency
+	}
+	return page, nil
+}
+
+func TestWarmCold(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := &pcpKmod{}
+	thread := &pcpThread{fakeThread: fakeThread{limit: 1000, cancel: cancel}, kmod: conn}
+	opts := &Options{TotalMemory: pab.Megabyte, MeasureLatencies: true, MeasureWarmCold: true, TargetPages: 20, SwingPages: 10}
+	w := newFakeWorkloadFromOptions(t, opts, conn, thread)
+
+	if err := w.runCPU(ctx, 0); err != nil {
+		t.Fatalf("runCPU failed: %v", err)
+	}
+	warm, cold := w.stats.warmAllocLatencies[0].Samples(), w.stats.coldAllocLatencies[0].Samples()
+	if len(warm) == 0 || len(cold) == 0 {
+		t.Fatalf("got %d warm and %d cold allocations, want some of each", len(warm), len(cold))
+	}
+	// Every allocation is either warm or cold.
+	if got := w.stats.pagesAllocated.Load(); got != uint64(len(warm)+len(cold)) {
+		t.Errorf("allocated %d pages, but %d warm + %d cold", got, len(warm), len(cold))
+	}
+	for _, latency := range warm {
+		if latency != warmLatency {
+			t.Fatalf("got a %v allocation classified as warm, want only %v", latency, warmLatency)
+		}
+	}
+	// The first allocation of each burst comes straight after a free, so
+	// the fake makes it fast even though the workload rightly counts it as
+	// cold. The bursts are several allocations long, so most cold ones are
+	// slow.
+	slow := 0
+	for _, latency := range cold {
+		if latency == coldLatency {
+			slow++
+		}
+	}
+	if slow <= len(cold)/2 {
+		t.Errorf("only %d of the %d cold allocations took %v, want most of them", slow, len(cold), coldLatency)
+	}
+
+	// It needs the latencies.
+	opts = &Options{MeasureWarmCold: true, DevicePath: opts.DevicePath, CPUs: opts.CPUs, CPUToNode: opts.CPUToNode, TotalMemory: pab.Megabyte}
+	if _, err := New(context.Background(), opts); err == nil {
+		t.Errorf("New with MeasureWarmCold but not MeasureLatencies succeeded")
+	}
+}
+
+func TestWarmColdCrossCPUFree(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	thread := &fakeThread{limit: 1000, cancel: cancel}
+	opts := &Options{TotalMemory: pab.Megabyte, MeasureLatencies: true, MeasureWarmCold: true, TargetPages: 20, SwingPages: 10}
+	w := newFakeWorkloadFromOptions(t, opts, &fakeKmod{}, thread)
+	// The only worker hands its pages off to itself, there's always room.
+	w.handoff = []chan *kmod.Page{make(chan *kmod.Page, 1024)}
+
+	if err := w.runCPU(ctx, 0); err != nil {
+		t.Fatalf("runCPU failed: %v", err)
+	}
+	// Nothing was freed straight before an allocation, so nothing was warm.
+	warm, cold := w.stats.warmAllocLatencies[0].Count(), w.stats.coldAllocLatencies[0].Count()
+	if warm != 0 {
+		t.Errorf("got %d warm allocations with every page handed off, want 0", warm)
+	}
+	if got := w.stats.pagesAllocated.Load(); got != uint64(cold) {
+		t.Errorf("allocated %d pages, but %d cold", got, cold)
+	}
+}
+
+func TestTrackNUMA(t *testing.T) {
+	devicePath := filepath.Join(t.TempDir(), "page_alloc_bench")
+	if err := os.WriteFile(devicePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	yes, no := true, false
+	for _, tc := range []struct {
+		name      string
+		cpuToNode map[int]int
+		trackNUMA *bool
+		want      bool
+	}{
+		{name: "one node", cpuToNode: map[int]int{0: 0, 1: 0}, want: false},
+		{name: "two nodes", cpuToNode: map[int]int{0: 0, 1: 1}, want: true},
+		{name: "forced on", cpuToNode: map[int]int{0: 0, 1: 0}, trackNUMA: &yes, want: true},
+		{name: "forced off", cpuToNode: map[int]int{0: 0, 1: 1}, trackNUMA: &no, want: false},
+	} {
+		w, err := New(context.Background(), &Options{
+			TotalMemory: pab.Megabyte,
+			DevicePath:  devicePath,
+			CPUs:        linux.NewCPUMask(0),
+			CPUToNode:   tc.cpuToNode,
+			TrackNUMA:   tc.trackNUMA,
+		})
+		if err != nil {
+			t.Fatalf("%s: New: %v", tc.name, err)
+		}
+		w.kmod.Close()
+		if w.trackNUMA != tc.want {
+			t.Errorf("%s: got trackNUMA %v, want %v", tc.name, w.trackNUMA, tc.want)
+		}
+		if got := w.stats.localFreeLatencies != nil; got != tc.want {
+			t.Errorf("%s: got per-locality free latencies %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// Fake kernel module with a limited amount of memory, whose frees might only
+// give some of it back.
+type finiteKmod struct {
+	fakeKmod
+	free int // Pages left to allocate.
+	leak bool
+}
+
+func (f *finiteKmod) AllocPages(order, count int) ([]*kmod.Page, error) {
+	n := min(count, f.free)
+	f.free -= n
+	pages, _ := f.fakeKmod.AllocPages(order, n)
+	if n < count {
+		return pages, syscall.ENOMEM
+	}
+	return pages, nil
+}
+
+func (f *finiteKmod) FreePages(pages []*kmod.Page) ([]time.Duration, error) {
+	if f.leak {
+		f.free += len(pages) / 2
+	} else {
+		f.free += len(pages)
+	}
+	return f.fakeKmod.FreePages(pages)
+}
+
+func TestVerifyFrees(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		conn    *finiteKmod
+		wantErr bool
+	}{
+		{name: "plenty of memory", conn: &finiteKmod{free: 10000}},
+		{name: "runs out", conn: &finiteKmod{free: 600}},
+		// Leaking doesn't matter if there's memory to spare.
+		{name: "leaky frees", conn: &finiteKmod{free: 10000, leak: true}},
+		{name: "leaky frees, runs out", conn: &finiteKmod{free: 1000, leak: true}, wantErr: true},
+	} {
+		w := newFakeWorkload(tc.conn, &fakeThread{})
+		w.pagesPerCPU = 1000
+		err := w.VerifyFrees(context.Background())
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("%s: VerifyFrees returned %v, want error: %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestCrossCPUFree(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := newFakeWorkload(&fakeKmod{}, &fakeThread{limit: 1000, cancel: cancel})
+	w.cpus, w.workerNodes, w.numThreads = []int{0, 1}, []int{0, 0}, 2
+	w.threads = append(w.threads, fakeThreadOn{&fakeThread{}, w.kmod})
+	w.handoff = []chan *kmod.Page{make(chan *kmod.Page, 1024), make(chan *kmod.Page, 1024)}
+
+	// Only worker 0 runs, so its pages pile up for worker 1.
+	if err := w.runCPU(ctx, 0); err != nil {
+		t.Fatalf("runCPU failed: %v", err)
+	}
+	handedOff := len(w.handoff[1])
+	if handedOff == 0 {
+		t.Fatalf("worker 0 didn't hand off any pages")
+	}
+	if err := w.drainHandoff(context.Background(), 1); err != nil {
+		t.Fatalf("drainHandoff: %v", err)
+	}
+	if got := w.Counters().CrossCPUFrees; got != uint64(handedOff) {
+		t.Errorf("counted %d cross-CPU frees, want %d", got, handedOff)
+	}
+	if allocated, freed := w.stats.pagesAllocated.Load(), w.stats.pagesFreed.Load(); allocated != freed {
+		t.Errorf("allocated %d pages but freed %d", allocated, freed)
+	}
+}
+
+// Fake kmod thread for fragmented memory, where allocations above maxOrder
+// fail with ENOMEM. Calls cancel once it has allocated limit pages.
+type fragmentedThread struct {
+	maxOrder int
+	allocs   int
+	limit    int
+	cancel   context.CancelFunc
+}
+
+func (t *fragmentedThread) AllocPageOnNodeGFPContext(ctx context.Context, order, nid int, gfp uint) (*kmod.Page, error) {
+	if order > t.maxOrder {
+		return nil, syscall.ENOMEM
+	}
+	t.allocs++
+	if t.allocs >= t.limit {
+		t.cancel()
+	}
+	return &kmod.Page{Order: order}, nil
+}
+
+func TestFallbackOrders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := &Options{TotalMemory: pab.Megabyte, Order: 3, FallbackOrders: true}
+	w := newFakeWorkloadFromOptions(t, opts, &fakeKmod{}, &fragmentedThread{maxOrder: 1, limit: 1000, cancel: cancel})
+
+	if err := w.runCPU(ctx, 0); err != nil {
+		t.Fatalf("runCPU failed: %v", err)
+	}
+	allocated := w.stats.pagesAllocated.Load()
+	if got := w.stats.orderAllocations[1].Load(); got != allocated {
+		t.Errorf("%d of %d allocations fell back to order 1", got, allocated)
+	}
+	for order := range w.stats.fallbacks {
+		want := uint64(0)
+		if order == 1 {
+			want = allocated
+		}
+		if got := w.stats.fallbacks[order].Load(); got != want {
+			t.Errorf("counted %d fallbacks to order %d, want %d", got, order, want)
+		}
+	}
+	if got := w.stats.allocFailures.Load(); got != 0 {
+		t.Errorf("counted %d allocation failures, want 0 since the fallbacks succeeded", got)
+	}
+}
+
+func TestPlausibleLatency(t *testing.T) {
+	w := newFakeWorkload(&fakeKmod{}, &fakeThread{})
+	implausible := 0
+	for _, tc := range []struct {
+		d    time.Duration
+		want bool
+	}{
+		{d: 0, want: true},
+		{d: time.Microsecond, want: true},
+		{d: maxPlausibleLatency, want: true},
+		{d: maxPlausibleLatency + 1, want: false},
+		{d: -1, want: false},
+		{d: time.Duration(1<<63 - 1), want: false},
+	} {
+		if got := plausibleLatency(tc.d); got != tc.want {
+			t.Errorf("plausibleLatency(%v) = %v, want %v", tc.d, got, tc.want)
+		}
+		if got := w.checkLatency(tc.d); got != tc.want {
+			t.Errorf("checkLatency(%v) = %v, want %v", tc.d, got, tc.want)
+		}
+		if !tc.want {
+			implausible++
+		}
+	}
+	if got := w.stats.implausibleLatencies.Load(); got != uint64(implausible) {
+		t.Errorf("counted %d implausible latencies, want %d", got, implausible)
+	}
+}
+
+func TestFillToMemFree(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	thread := &fakeThread{limit: 1 << 62, onAlloc: func() { time.Sleep(50 * time.Microsecond) }}
+	w := newFakeWorkload(&fakeKmod{}, thread)
+	w.fillToMemFree = 800 * pab.PageSize()
+	// The system has 1000 free pages, plus whatever else is freed.
+	var freedElsewhere atomic.Int64
+	held := func() int64 {
+		return int64(w.stats.pagesAllocated.Load() - w.stats.pagesFreed.Load())
+	}
+	w.readMeminfo = func() (*linux.Meminfo, error) {
+		free := pab.ByteSize(1000+freedElsewhere.Load()-held()) * pab.PageSize()
+		return &linux.Meminfo{Sizes: map[string]pab.ByteSize{"MemFree": free}}, nil
+	}
+	done := make(chan error, 2)
+	go func() { done <- w.monitorMemFree(ctx) }()
+	go func() { done <- w.runCPUFill(ctx, 0) }()
+
+	select {
+	case <-w.steadyStateReached:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("never reached steady state, holding %d pages", held())
+	}
+	filled := held()
+	if filled <= 200 {
+		t.Errorf("reached steady state holding %d pages, want more than 200", filled)
+	}
+	time.Sleep(3 * memFreePollInterval)
+	if got := held(); got > filled+1 {
+		t.Errorf("kept allocating after filling up, from %d to %d pages", filled, got)
+	}
+
+	// Once memory is freed, it resumes.
+	freedElsewhere.Store(1000)
+	time.Sleep(3 * memFreePollInterval)
+	if got := held(); got <= filled+1 {
+		t.Errorf("still holding %d pages after more memory was freed, want more than %d", got, filled+1)
+	}
+
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("got error %v", err)
+		}
+	}
+	if got := held(); got != 0 {
+		t.Errorf("still holding %d pages after stopping", got)
+	}
+}
+
+func TestRemoteFrees(t *testing.T) {
+	w := newFakeWorkload(&fakeKmod{}, &fakeThread{})
+	w.trackNUMA, w.measureLatencies = true, true
+	w.stats.freeLatencies = statsPerWorker(1, 100, nil, func(a, b time.Duration) bool { return a < b })
+	w.stats.localFreeLatencies = reservoirPerWorker[time.Duration](1, 100, nil)
+	w.stats.remoteFreeLatencies = reservoirPerWorker[time.Duration](1, 100, nil)
+
+	// The worker is on node 0.
+	for _, nid := range []int{0, 1, 1, 0, 2} {
+		if err := w.freePageOnCPU(context.Background(), 0, &kmod.Page{NID: nid}); err != nil {
+			t.Fatalf("freePageOnCPU: %v", err)
+		}
+	}
+	// The batch frees at the end of the run count too.
+	w.freePagesOnCPU(0, []*kmod.Page{{NID: 0}, {NID: 3}})
+
+	if got := w.stats.numaRemoteFrees.Load(); got != 4 {
+		t.Errorf("counted %d remote frees, want 4", got)
+	}
+	// Only the individual frees have latencies.
+	if local, remote := w.stats.localFreeLatencies[0].Count(), w.stats.remoteFreeLatencies[0].Count(); local != 2 || remote != 3 {
+		t.Errorf("got %d local and %d remote free latencies, want 2 and 3", local, remote)
+	}
+}
+
+// Fake kernel module for fragmented memory, see fragmentedThread.
+type fragmentedKmod struct {
+	fakeKmod
+	maxOrder int
+}
+
+func (f *fragmentedKmod) AllocPage(order int) (*kmod.Page, error) {
+	if order > f.maxOrder {
+		return nil, syscall.ENOMEM
+	}
+	return f.fakeKmod.AllocPage(order)
+}
+
+// Fake kernel module whose memory gets more fragmented with each probe: the
+// nth probe can allocate up to maxOrders[n]. The last one calls cancel, and
+// any more see the same as it.
+type degradingKmod struct {
+	fakeKmod
+	maxOrders []int
+	cancel    context.CancelFunc
+	probes    int
+}
+
+func (f *degradingKmod) AllocPage(order int) (*kmod.Page, error) {
+	// Every probe starts with order 0.
+	if order == 0 {
+		f.probes++
+		if f.probes == len(f.maxOrders) {
+			f.cancel()
+		}
+	}
+	if order > f.maxOrders[min(f.probes, len(f.maxOrders))-1] {
+		return nil, syscall.ENOMEM
+	}
+	return f.fakeKmod.AllocPage(order)
+}
+
+func TestProbeMaxOrder(t *testing.T) {
+	for _, tc := range []struct {
+		maxOrder, want int
+	}{
+		{maxOrder: 3, want: 3},
+		{maxOrder: -1, want: -1},
+		{maxOrder: 20, want: DefaultMaxProbeOrder},
+	} {
+		conn := &fragmentedKmod{maxOrder: tc.maxOrder}
+		w := newFakeWorkload(conn, &fakeThread{})
+		w.maxProbeOrder = DefaultMaxProbeOrder
+		got, err := w.probeMaxOrder()
+		if err != nil || got != tc.want {
+			t.Errorf("with max order %d, probeMaxOrder() = %d, %v, want %d", tc.maxOrder, got, err, tc.want)
+		}
+		// Everything it allocated got freed.
+		if want := max(tc.want+1, 0); conn.frees != want {
+			t.Errorf("with max order %d, freed %d pages, want %d", tc.maxOrder, conn.frees, want)
+		}
+	}
+
+	// The series shows memory getting more fragmented.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	maxOrders := []int{5, 5, 4, 2, 2, 0, -1}
+	w := newFakeWorkload(&degradingKmod{maxOrders: maxOrders, cancel: cancel}, &fakeThread{})
+	w.maxProbeOrder, w.probeMaxOrderInterval = DefaultMaxProbeOrder, time.Millisecond
+	probes, err := w.probeMaxOrderSeries(ctx)
+	if err != nil {
+		t.Fatalf("probeMaxOrderSeries: %v", err)
+	}
+	// It might get one more probe in before noticing the cancellation.
+	if len(probes) < len(maxOrders) || len(probes) > len(maxOrders)+1 {
+		t.Fatalf("got %d probes, want %d", len(probes), len(maxOrders))
+	}
+	for i, probe := range probes {
+		want := maxOrders[min(i, len(maxOrders)-1)]
+		if probe.Order != want || (i > 0 && probe.Time <= probes[i-1].Time) {
+			t.Errorf("got probes %+v, want orders %v at increasing times", probes, maxOrders)
+			break
+		}
+	}
+}
+
+func TestCPUs(t *testing.T) {
+	devicePath := filepath.Join(t.TempDir(), "page_alloc_bench")
+	if err := os.WriteFile(devicePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{
+		TotalMemory: pab.Megabyte,
+		DevicePath:  devicePath,
+		CPUs:        linux.NewCPUMask(1, 3),
+		CPUToNode:   map[int]int{0: 0, 1: 0, 2: 1, 3: 1},
+	}
+	w, err := New(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	w.kmod.Close()
+	if w.numThreads != 2 || len(w.threads) != 2 || !reflect.DeepEqual(w.cpus, []int{1, 3}) {
+		t.Errorf("got %d workers on CPUs %v, want 2 on CPUs [1 3]", w.numThreads, w.cpus)
+	}
+	if !reflect.DeepEqual(w.workerNodes, []int{0, 1}) {
+		t.Errorf("got worker nodes %v, want [0 1]", w.workerNodes)
+	}
+	if want := pab.Megabyte.Pages() / 2; w.pagesPerCPU != want {
+		t.Errorf("got %d pages per CPU, want %d", w.pagesPerCPU, want)
+	}
+
+	opts.CPUs = linux.NewCPUMask()
+	if _, err := New(context.Background(), opts); err == nil {
+		t.Errorf("New with no CPUs succeeded")
+	}
+	opts.CPUs = linux.NewCPUMask(4)
+	if _, err := New(context.Background(), opts); err == nil {
+		t.Errorf("New with a CPU that has no NUMA node succeeded")
+	}
+}